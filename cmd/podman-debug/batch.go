@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rsturla/podman-debug/pkg/debug"
+)
+
+// batchTarget is the positional argument that reads targets from stdin.
+const batchTarget = "-"
+
+// batchResult is the outcome of one target in batch mode, as emitted
+// by --output json.
+type batchResult struct {
+	Target   string `json:"target"`
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	Error    string `json:"error,omitempty"`
+}
+
+// validateBatch checks the flags that only make sense in, or conflict
+// with, batch mode.
+func validateBatch(nameOrID string) error {
+	if flagOutput != "text" && flagOutput != "json" {
+		return fmt.Errorf("invalid --output %q: expected text or json", flagOutput)
+	}
+	if nameOrID != batchTarget {
+		if flagOutput == "json" && !flagTimings {
+			return fmt.Errorf("--output json is only supported when reading targets from stdin (-) or with --timings")
+		}
+		return nil
+	}
+	if !hasCommand() {
+		return fmt.Errorf("reading targets from stdin requires a command (-c, --script or after --)")
+	}
+	if flagCommit != "" {
+		return fmt.Errorf("--commit cannot be used when reading targets from stdin")
+	}
+	if flagExportChanges != "" {
+		return fmt.Errorf("--export-changes cannot be used when reading targets from stdin")
+	}
+	if flagCoredump != 0 {
+		return fmt.Errorf("--coredump cannot be used when reading targets from stdin")
+	}
+	if flagListen != "" {
+		return fmt.Errorf("--listen cannot be used when reading targets from stdin")
+	}
+	if flagKeepSession {
+		return fmt.Errorf("--keep-session cannot be used when reading targets from stdin")
+	}
+	if flagOutputFile != "" {
+		return fmt.Errorf("--output-file cannot be used when reading targets from stdin")
+	}
+	return nil
+}
+
+// readTargets reads one target per line, skipping blank lines and
+// #-comments.
+func readTargets(r io.Reader) ([]string, error) {
+	var targets []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		targets = append(targets, line)
+	}
+	return targets, scanner.Err()
+}
+
+// runBatch runs the command against every target read from r in turn.
+// A target that fails does not stop the batch; the returned status is
+// the highest one seen, with targets that could not be debugged at all
+// counting as 125.
+func runBatch(r io.Reader, nixPath string, shellArgs []string) (int, error) {
+	targets, err := readTargets(r)
+	if err != nil {
+		return 0, fmt.Errorf("reading targets: %w", err)
+	}
+	if len(targets) == 0 {
+		return 0, fmt.Errorf("no targets given on stdin")
+	}
+
+	// stdin holds the target list, so sessions get /dev/null.
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return 0, err
+	}
+	defer devNull.Close()
+
+	var results []batchResult
+	status, failed := 0, 0
+	for i, target := range targets {
+		var res batchResult
+		if flagOutput == "json" {
+			res, err = runCaptured(target, nixPath, shellArgs, devNull)
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("==> %s <==\n", target)
+			res = runTarget(target, nixPath, shellArgs, devNull, os.Stdout, os.Stderr)
+			if res.Error != "" {
+				debug.Log.Error("%s: %s", target, res.Error)
+			} else if res.ExitCode != 0 {
+				debug.Log.Note("%s exited with status %d.", target, res.ExitCode)
+			}
+		}
+
+		if res.ExitCode != 0 {
+			failed++
+		}
+		status = max(status, res.ExitCode)
+		results = append(results, res)
+	}
+
+	if flagOutput == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return 0, err
+		}
+	} else if failed > 0 {
+		debug.Log.Note("%d of %d targets failed.", failed, len(targets))
+	}
+	return status, nil
+}
+
+// runTarget debugs one target with the given streams.
+func runTarget(target, nixPath string, shellArgs []string, stdin, stdout, stderr *os.File) batchResult {
+	res := batchResult{Target: target}
+	code, err := debugTarget(target, nixPath, shellArgs, streamsFor(stdin, stdout, stderr))
+	if err != nil {
+		res.ExitCode = flagToolErrorCode
+		res.Error = err.Error()
+		return res
+	}
+	res.ExitCode = code
+	return res
+}
+
+// runCaptured debugs one target, capturing its output for --output json.
+func runCaptured(target, nixPath string, shellArgs []string, stdin *os.File) (batchResult, error) {
+	stdout, err := os.CreateTemp("", "podman-debug-stdout-*")
+	if err != nil {
+		return batchResult{}, err
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+
+	stderr, err := os.CreateTemp("", "podman-debug-stderr-*")
+	if err != nil {
+		return batchResult{}, err
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+
+	res := runTarget(target, nixPath, shellArgs, stdin, stdout, stderr)
+
+	out, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		return batchResult{}, err
+	}
+	errOut, err := os.ReadFile(stderr.Name())
+	if err != nil {
+		return batchResult{}, err
+	}
+	res.Stdout = string(out)
+	res.Stderr = string(errOut)
+	return res, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/rsturla/podman-debug/pkg/debug"
+	"golang.org/x/sys/unix"
+)
+
+// cleanups are the teardown steps the run still owes, by registration
+// order.  Each is taken out of the map before it runs, so it runs once
+// whether its defer or an interrupt gets to it first.
+var cleanups struct {
+	sync.Mutex
+	next  int
+	funcs map[int]func()
+}
+
+// addCleanup registers fn to run if the run is interrupted and returns
+// a func that runs it now instead, at most once.  Callers defer that.
+func addCleanup(fn func()) func() {
+	cleanups.Lock()
+	defer cleanups.Unlock()
+	if cleanups.funcs == nil {
+		cleanups.funcs = make(map[int]func())
+	}
+	id := cleanups.next
+	cleanups.next++
+	cleanups.funcs[id] = fn
+	return func() {
+		if fn := takeCleanup(id); fn != nil {
+			fn()
+		}
+	}
+}
+
+func takeCleanup(id int) func() {
+	cleanups.Lock()
+	defer cleanups.Unlock()
+	fn := cleanups.funcs[id]
+	delete(cleanups.funcs, id)
+	return fn
+}
+
+// runCleanups runs the outstanding cleanups, most recent first, as the
+// defers would have.
+func runCleanups() {
+	cleanups.Lock()
+	last := cleanups.next
+	cleanups.Unlock()
+	for id := last - 1; id >= 0; id-- {
+		if fn := takeCleanup(id); fn != nil {
+			fn()
+		}
+	}
+}
+
+// holdMount records a podman mount the run holds and returns the func
+// that releases it (see unmount), for the caller to defer.  An
+// interrupt releases it too.
+func holdMount(fn func(string) error, command, name string) func() {
+	return addCleanup(func() { unmount(fn, command, name) })
+}
+
+// handleInterrupts makes SIGINT, SIGTERM, and SIGHUP release what the
+// run holds (podman mounts, the terminal's raw mode) before exiting
+// with the shell's 128+signal status, instead of dying with mounts
+// that need a manual podman unmount.  The session overlay needs
+// nothing: it lives in a mount namespace that goes away with the
+// process.  While a session command runs they are passed on to it
+// instead, and the run ends through its usual teardown once it exits.
+// The returned func stops handling them.
+func handleInterrupts() func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if debug.ForwardSignal(sig.(syscall.Signal)) {
+					continue
+				}
+				runCleanups()
+				debug.Log.Error("interrupted by %s", unix.SignalName(sig.(syscall.Signal)))
+				os.Exit(128 + int(sig.(syscall.Signal)))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rsturla/podman-debug/pkg/debug"
+	"github.com/rsturla/podman-debug/pkg/podman"
+)
+
+// printPlan prints what debugging nameOrID would do, for --dry-run:
+// the images it would pull, the mode, and the session's setup steps
+// (see debug.Plan).  It only inspects; nothing is pulled, mounted, or
+// joined.
+func printPlan(nameOrID string, shellArgs []string) error {
+	w := os.Stdout
+	for i, image := range flagImage {
+		role := "Debug image"
+		if i > 0 {
+			role = "  fallback"
+		}
+		fmt.Fprintf(w, "%s: %s (%s)\n", role, image, pullPlan(image, flagPull))
+	}
+
+	mode, pid, rootfs, ep, err := planTarget(w, nameOrID)
+	if err != nil {
+		return err
+	}
+
+	opts := sessionOptions()
+	opts.Mode, opts.Entrypoint, opts.Target = mode, ep, targetName
+	modeOptions(opts)
+	if mode != debug.ModeImage {
+		opts.Mounts, _ = containerMounts(targetName)
+		debug.ResolveVolumeSources(opts.Mounts)
+	}
+	opts.Writable = flagWritable && mode == debug.ModeLive
+	opts.WritableVolumes = flagWritable
+	opts.NoVolumes = !flagMountVolumes
+
+	shell := flagShell
+	if shell == "auto" {
+		shell = "SHELL"
+	}
+	fmt.Fprintf(w, "Mode: %s\n", mode)
+	fmt.Fprintln(w, "Steps:")
+	for i, s := range debug.Plan(pid, rootfs, shell, shellArgs, opts) {
+		fmt.Fprintf(w, "  %2d. %s\n", i+1, s)
+	}
+	if flagShell == "auto" {
+		fmt.Fprintln(w, "SHELL is chosen once the debug image is mounted; 'podman-debug shells' shows which.")
+	}
+	return nil
+}
+
+// planTarget resolves nameOrID the way debugTarget does, using only
+// inspect calls, and prints what it found.  It returns the session
+// mode and, in live mode, the container's PID; otherwise rootfs is a
+// description of where the target's filesystem would be mounted.
+func planTarget(w *os.File, nameOrID string) (debug.Mode, int, string, *podman.EntrypointInfo, error) {
+	if podman.IsArchiveReference(nameOrID) {
+		fmt.Fprintf(w, "Target: %s (image archive, loaded into storage)\n", nameOrID)
+		targetName = nameOrID
+		return debug.ModeImage, 0, "(the image's mountpoint)", nil, nil
+	}
+
+	ref := nameOrID
+	if flagPodContainer != "" {
+		pod, err := podman.InspectPod(nameOrID)
+		if err != nil {
+			return 0, 0, "", nil, fmt.Errorf("--container needs a pod: %w", err)
+		}
+		member, err := debug.PodMember(pod, flagPodContainer)
+		if err != nil {
+			return 0, 0, "", nil, err
+		}
+		ref = member.ID
+	}
+	ctr, err := podman.InspectContainer(ref)
+	if isNotFound(err) && flagPodContainer == "" {
+		if pod, perr := podman.InspectPod(nameOrID); perr == nil {
+			member, merr := debug.PodMember(pod, flagPodContainer)
+			if merr != nil {
+				return 0, 0, "", nil, merr
+			}
+			ctr, err = podman.InspectContainer(member.ID)
+		}
+	}
+	switch {
+	case err == nil:
+		mode, ok := debug.ModeForState(ctr.State)
+		if !ok {
+			return 0, 0, "", nil, fmt.Errorf("container %s is in unsupported state: %s", nameOrID, ctr.State)
+		}
+		fmt.Fprintf(w, "Target: container %s (%s)\n", ctr.Name, ctr.State)
+		targetName = ctr.Name
+		if err := checkSavedInspect(ctr.ID, ctr.Name); err != nil {
+			return 0, 0, "", nil, err
+		}
+		ep, _ := containerEntrypoint(ctr.ID)
+		return mode, ctr.PID, "(the container's mountpoint)", ep, nil
+	case !isNotFound(err):
+		return 0, 0, "", nil, err
+	}
+
+	policy := "missing"
+	if flagOffline {
+		policy = "never"
+	}
+	fmt.Fprintf(w, "Target: image %s (%s)\n", nameOrID, pullPlan(nameOrID, policy))
+	targetName = nameOrID
+	ep, _ := podman.InspectImageEntrypoint(nameOrID)
+	return debug.ModeImage, 0, "(the image's mountpoint)", ep, nil
+}
+
+// pullPlan describes what PullImage would do for image under policy.
+func pullPlan(image, policy string) string {
+	platform := ""
+	if flagPlatform != "" {
+		platform = " for " + flagPlatform
+	}
+	if policy == "always" {
+		return "would pull" + platform
+	}
+	exists, err := podman.ImageExists(image)
+	switch {
+	case err != nil:
+		return err.Error()
+	case exists && platform != "":
+		return "present locally; pulled again if not built" + platform
+	case exists:
+		return "present locally"
+	case policy == "never":
+		return "not found locally, and pull policy is 'never'"
+	}
+	return "would pull" + platform
+}
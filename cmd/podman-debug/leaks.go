@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/rsturla/podman-debug/pkg/debug"
+	"github.com/rsturla/podman-debug/pkg/podman"
+)
+
+// podmanMounts is what podman had mounted at one point in time.
+type podmanMounts struct {
+	containers []string
+	images     []string
+}
+
+func listPodmanMounts() podmanMounts {
+	containers, _ := podman.MountedContainers()
+	images, _ := podman.MountedImages()
+	return podmanMounts{containers, images}
+}
+
+// reportLeaks warns about anything the run left mounted: session
+// mounts still visible in our mount namespace, and podman container or
+// image mounts that were not there before the run.  It runs after all
+// cleanup, for --report-leaks.  Mounts kept on purpose by
+// --no-cleanup-on-error are not reported.
+func reportLeaks(before podmanMounts) {
+	var leaks []string
+	if mounts, err := debug.LeftoverMounts(); err == nil {
+		for _, mp := range mounts {
+			leaks = append(leaks, "mount "+mp)
+		}
+	}
+	after := before
+	if !keepMounts {
+		after = listPodmanMounts()
+	}
+	for _, id := range after.containers {
+		if !slices.Contains(before.containers, id) {
+			leaks = append(leaks, "container "+id+" (release with: podman unmount "+id+")")
+		}
+	}
+	for _, image := range after.images {
+		if !slices.Contains(before.images, image) {
+			leaks = append(leaks, "image "+image+" (release with: podman image unmount "+image+")")
+		}
+	}
+
+	if len(leaks) == 0 {
+		return
+	}
+	debug.Log.Warn("podman-debug left these mounted:")
+	for _, l := range leaks {
+		debug.Log.Print("  %s", l)
+	}
+}
+
+// cleanupLeaks is --cleanup: it unmounts the session mounts crashed
+// runs left in our mount namespace, then has podman release every
+// container and image mount, since which of them a crashed run made
+// can't be told apart from the rest.
+func cleanupLeaks() error {
+	podman.Timeout = flagPodmanTimeout
+	if _, err := podman.EnsureAvailable(); err != nil {
+		return err
+	}
+
+	unmounted, err := debug.UnmountLeftovers()
+	for _, mp := range unmounted {
+		debug.Log.Print("Unmounted %s", mp)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := podman.UnmountAll(); err != nil {
+		return err
+	}
+	debug.Log.Print("Released all podman container and image mounts.")
+	return nil
+}
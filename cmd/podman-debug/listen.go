@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/creack/pty"
+	"github.com/rsturla/podman-debug/pkg/debug"
+	xterm "golang.org/x/term"
+)
+
+// Frame types of the --listen protocol.  Every frame is a one-byte
+// type, the payload length as a big-endian uint32, and the payload.
+const (
+	frameStdin  = 'i' // client: input bytes
+	frameResize = 'r' // client: terminal size, uint16 rows then uint16 columns
+	frameEOF    = 'e' // client: no more input (sessions without a pty)
+	frameStdout = 'o' // server: output bytes
+	frameStderr = 'E' // server: error output bytes (sessions without a pty)
+	frameExit   = 'x' // server: int32 exit status, always the last frame
+)
+
+// maxFrame bounds the payload of a client frame.
+const maxFrame = 1 << 20
+
+// listenSession carries one debug session over a unix socket
+// connection instead of the terminal.
+type listenSession struct {
+	conn    net.Conn
+	wmu     sync.Mutex // serialises frame writes
+	streams debug.Streams
+
+	input   io.WriteCloser // where stdin frames go
+	master  *os.File       // outer pty master for interactive sessions
+	ends    []*os.File     // the session's ends, closed once it is over
+	pumps   sync.WaitGroup // output copies still running
+	hangup  chan struct{}
+	hungUp  sync.Once
+	inputMu sync.Mutex
+}
+
+// acceptSession listens on the unix socket path, accepts a single
+// client, and returns a session whose streams talk to it.  The socket
+// is only reachable by the current user and is removed as soon as the
+// client has connected.  An interactive session gets a pty pair: the
+// client's input and output pass through it unchanged, and resize
+// frames resize it.
+func acceptSession(path string, interactive bool) (*listenSession, error) {
+	old := syscall.Umask(0o177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	if err != nil {
+		return nil, fmt.Errorf("--listen: %w", err)
+	}
+	defer os.Remove(path)
+	defer ln.Close()
+
+	debug.Log.Print("Listening on %s.", path)
+	conn, err := ln.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("--listen: %w", err)
+	}
+
+	s := &listenSession{conn: conn, hangup: make(chan struct{})}
+	if err := s.setupStreams(interactive); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go s.readFrames()
+	return s, nil
+}
+
+func (s *listenSession) setupStreams(interactive bool) error {
+	if interactive {
+		master, slave, err := pty.Open()
+		if err != nil {
+			return fmt.Errorf("--listen: allocating a pty: %w", err)
+		}
+		// The client's terminal does the line editing; ours only
+		// passes bytes through.
+		if _, err := xterm.MakeRaw(int(slave.Fd())); err != nil {
+			master.Close()
+			slave.Close()
+			return fmt.Errorf("--listen: %w", err)
+		}
+		s.master, s.input = master, master
+		s.ends = []*os.File{slave}
+		s.streams = debug.Streams{Stdout: slave, Stderr: slave}
+		if flagInteractive {
+			s.streams.Stdin = slave
+		}
+		s.pump(master, frameStdout)
+	} else {
+		stdoutR, stdoutW, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		stderrR, stderrW, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		s.ends = []*os.File{stdoutW, stderrW}
+		s.streams = debug.Streams{Stdout: stdoutW, Stderr: stderrW}
+		if flagInteractive {
+			stdinR, stdinW, err := os.Pipe()
+			if err != nil {
+				return err
+			}
+			s.input = stdinW
+			s.ends = append(s.ends, stdinR)
+			s.streams.Stdin = stdinR
+		}
+		s.pump(stdoutR, frameStdout)
+		s.pump(stderrR, frameStderr)
+	}
+	s.streams.Hangup = s.hangup
+	return nil
+}
+
+// pump forwards everything read from r to the client as frames of
+// type typ, until r is exhausted.
+func (s *listenSession) pump(r *os.File, typ byte) {
+	s.pumps.Add(1)
+	go func() {
+		defer s.pumps.Done()
+		defer r.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				_ = s.writeFrame(typ, buf[:n])
+			}
+			// A pty master reports EIO once the last slave is closed.
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// readFrames handles the client's frames until it disconnects, which
+// hangs up the session.
+func (s *listenSession) readFrames() {
+	defer s.hangupSession()
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(header[1:])
+		if n > maxFrame {
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return
+		}
+
+		switch header[0] {
+		case frameStdin:
+			s.inputMu.Lock()
+			if s.input != nil {
+				_, _ = s.input.Write(payload)
+			}
+			s.inputMu.Unlock()
+		case frameResize:
+			if s.master != nil && len(payload) == 4 {
+				_ = pty.Setsize(s.master, &pty.Winsize{
+					Rows: binary.BigEndian.Uint16(payload[0:]),
+					Cols: binary.BigEndian.Uint16(payload[2:]),
+				})
+				// The session resizes its own pty on SIGWINCH,
+				// which the outer pty can't deliver to us.
+				_ = syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+			}
+		case frameEOF:
+			if s.master == nil {
+				s.closeInput()
+			}
+		}
+	}
+}
+
+// closeInput closes the session's stdin pipe.
+func (s *listenSession) closeInput() {
+	s.inputMu.Lock()
+	defer s.inputMu.Unlock()
+	if s.input != nil && s.master == nil {
+		s.input.Close()
+		s.input = nil
+	}
+}
+
+func (s *listenSession) hangupSession() {
+	s.hungUp.Do(func() {
+		close(s.hangup)
+		s.closeInput()
+	})
+}
+
+func (s *listenSession) writeFrame(typ byte, payload []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	header := make([]byte, 5)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := s.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(payload)
+	return err
+}
+
+// finish flushes the session's remaining output, reports err (if the
+// session could not be run) and the exit status to the client, and
+// disconnects.
+func (s *listenSession) finish(code int, err error) {
+	for _, f := range s.ends {
+		f.Close()
+	}
+	s.pumps.Wait()
+
+	if err != nil {
+		_ = s.writeFrame(frameStderr, []byte(fmt.Sprintf("Error: %v\n", err)))
+	}
+	status := make([]byte, 4)
+	binary.BigEndian.PutUint32(status, uint32(int32(code)))
+	_ = s.writeFrame(frameExit, status)
+
+	s.hangupSession()
+	if err := s.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		debug.Log.Warn("closing --listen connection: %v", err)
+	}
+	if s.master != nil {
+		s.master.Close()
+	}
+}
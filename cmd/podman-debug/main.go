@@ -1,48 +1,207 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"net/netip"
 	"os"
+	"os/user"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rsturla/podman-debug/pkg/debug"
 	"github.com/rsturla/podman-debug/pkg/podman"
 	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
 	xterm "golang.org/x/term"
 )
 
 var (
-	flagShell       string
-	flagCommand     string
-	flagImage       string
-	flagPull        string
-	flagInteractive bool
-	flagTTY         bool
-	flagWritable    bool
+	flagShell          string
+	flagShellRCFile    string
+	flagCommand        string
+	flagImage          []string
+	flagPull           string
+	flagPlatform       string
+	flagInteractive    bool
+	flagTTY            bool
+	flagWritable       bool
+	flagMountVolumes   bool
+	flagNixpkgsRef     string
+	flagNoHistoryHints bool
+	flagNoCleanup      bool
+	flagKeepSession    bool
+	flagMinimalDev     bool
+	flagNoSeccomp      bool
+	flagCommit         string
+	flagCgroupLimit    string
+	flagMemoryLimit    string
+	flagCPULimit       string
+	flagOutput         string
+	flagLogFormat      string
+	flagTZ             string
+	flagHostPID        bool
+	flagNoPIDNS        bool
+	flagNoJoinIPC      bool
+	flagNoJoinUTS      bool
+	flagEnvFrom        string
+	flagEnv            []string
+	flagInheritEnv     bool
+	flagInspectEP      bool
+	flagListTools      bool
+	flagOffline        bool
+	flagBuiltins       string
+	flagUpperDir       string
+	flagWorkDir        string
+	flagInspectFile    string
+	flagExportChanges  string
+	flagCompress       string
+	flagTimings        bool
+	flagPostInstall    string
+	flagSessionName    string
+	flagScript         []string
+	flagCommandFile    string
+	flagOutputFile     string
+	flagOutputStderr   bool
+	flagNoPicker       bool
+	flagSelect         string
+	flagAll            bool
+	flagLast           bool
+	flagCopyOut        []string
+	flagCoredump       int
+	flagRestrictSys    bool
+	flagListen         string
+	flagLayerDebug     bool
+	flagWaitHealthy    bool
+	flagWaitTimeout    time.Duration
+	flagTimeout        time.Duration
+	flagAsImageUser    bool
+	flagUser           string
+	flagCwd            string
+	flagPodmanTimeout  time.Duration
+	flagPullTimeout    time.Duration
+	flagPullRetry      int
+	flagPodmanPath     string
+	flagConnection     string
+	flagPreserve       bool
+	flagMountRO        []string
+	flagAddHost        []string
+	flagDNS            []string
+	flagNetwork        string
+	flagReportLeaks    bool
+	flagCleanup        bool
+	flagDryRun         bool
+	flagOverlaySize    string
+	flagPodContainer   string
 )
 
+// flagToolErrorCode is the status podman-debug exits with when it fails
+// itself, as opposed to the session command failing.  It is read from
+// the arguments early (see earlyToolErrorCode) so that failures before
+// flag parsing honour it too.
+var flagToolErrorCode = 125
+
+// timings records setup phase durations for --timings, nil when off.
+var timings *debug.Timings
+
+// savedInspect holds the --inspect-file contents, nil when the
+// container's configuration comes from podman.
+var savedInspect []byte
+
+// enabledBuiltins holds the parsed --builtins allowlist, nil for all.
+var enabledBuiltins map[string]bool
+
+// copyOutDir and copyOutPaths are the two forms of --copy-out: the
+// host directory attached in the session, and the paths copied out
+// after it.
+var (
+	copyOutDir   string
+	copyOutPaths []debug.CopyOutPath
+)
+
+// hostMounts holds the parsed --mount-ro values.
+var hostMounts []debug.HostMount
+
+// extraHosts holds the --add-host values as /etc/hosts lines.
+var extraHosts []string
+
+// nameservers holds the parsed --dns values.
+var nameservers []string
+
+// sessionEnv holds the environment borrowed with --env-from-container.
+var sessionEnv []string
+
+// inheritImageEnv is set when --inherit-env was given explicitly, the
+// only way image sessions start from the image's environment.
+var inheritImageEnv bool
+
+// cgroupLimits holds the parsed --cgroup-limit spec.
+var cgroupLimits debug.CgroupLimits
+
+// sessionScript holds the --script contents, nil when not given.
+var sessionScript []byte
+
+// shellRCFile holds the --shell-rcfile contents, nil when not given.
+var shellRCFile []byte
+
+// outputFile is the opened --output-file, nil when not given.
+var outputFile *os.File
+
+// targetName is the name of the container or image --dry-run plans a
+// session for, as the session prompt would show it.
+var targetName string
+
+// commandArgv is the command given after "--", run verbatim.
+var commandArgv []string
+
+// podmanVersion is the version of the podman client in use, for
+// gating features that need a newer podman.
+var podmanVersion string
+
+// exitCode is the status main exits with once debugRun has returned
+// and its deferred unmounts have run.
+var exitCode int
+
+// keepMounts is set when session setup fails under
+// --no-cleanup-on-error, so the deferred podman unmounts leave the
+// mounts in place for inspection.
+var keepMounts bool
+
 func main() {
 	// Init-proc mode: when invoked as "podman-debug --init-proc <shell> [args...]",
-	// mount a fresh /proc and exec the shell.  Used by snapshot/image mode to
+	// mount a fresh /proc and run the shell.  Used by snapshot/image mode to
 	// provide an isolated PID namespace — this process runs as PID 1 inside
 	// a CLONE_NEWPID child, so the fresh /proc only shows debug session processes.
-	if len(os.Args) >= 3 && os.Args[1] == "--init-proc" {
-		initProc(os.Args[2], os.Args[3:])
+	// "--init-proc-restricted" is the same for --restrict-sys sessions.
+	if len(os.Args) >= 3 && (os.Args[1] == "--init-proc" || os.Args[1] == "--init-proc-restricted") {
+		initProc(os.Args[2], os.Args[3:], os.Args[1] == "--init-proc-restricted")
 		return
 	}
 
+	flagToolErrorCode = earlyToolErrorCode(os.Args[1:])
+	podman.Binary = earlyPodmanBinary(os.Args[1:])
+
 	// Rootless re-exec: when not running as root (uid 0), we need to
 	// be inside podman's user namespace so that podman image/container
 	// mount operations work and we have CAP_SYS_ADMIN for overlays,
-	// chroot, and namespace joins.
-	if os.Getuid() != 0 && os.Getenv("_PODMAN_DEBUG_UNSHARED") == "" {
+	// chroot, and namespace joins.  A remote connection does none of
+	// those here, and podman unshare is local only.
+	_, remote := earlyFlag(os.Args[1:], "--connection")
+	if os.Getuid() != 0 && os.Getenv("_PODMAN_DEBUG_UNSHARED") == "" && !remote {
 		reexecViaPodmanUnshare()
 		return
 	}
 
 	rootCmd := &cobra.Command{
-		Use:   "podman-debug [options] {CONTAINER|IMAGE} [COMMAND [ARG...]]",
+		Use:   "podman-debug [options] {CONTAINER|IMAGE} [[--] COMMAND [ARG...]]",
 		Short: "Get a shell into any container or image",
 		Long: `Get a debug shell into any container or image, even if it has no shell.
 
@@ -50,8 +209,17 @@ Uses a toolbox image with Nix to provide debugging tools without modifying the t
 The /nix directory is never visible to the actual container or image.
 
 By default, all filesystem changes are discarded when leaving the shell.
-Use --writable to make changes visible to a running or paused container.`,
-		Args:                  cobra.MinimumNArgs(1),
+Use --writable to make changes visible to a running or paused container.
+
+Pass - as the target to read container or image names from stdin, one per
+line, and run the -c command against each in turn.
+
+Exit status: the shell's or command's own status; 126 if the command
+could not be executed and 127 if it was not found; 122 if the target
+container exited during the session; 130 or 143 if podman-debug was
+interrupted; 125 (see --tool-error-exit-code) if podman-debug itself
+failed or the session could not be set up.`,
+		Args:                  cobra.ArbitraryArgs,
 		RunE:                  debugRun,
 		SilenceUsage:          true,
 		SilenceErrors:         true,
@@ -61,6 +229,8 @@ Use --writable to make changes visible to a running or paused container.`,
   podman-debug --shell sh my-container
   podman-debug -c "cat /etc/os-release" my-container
   podman-debug --image my-toolbox:v1 my-container
+  podman-debug --select label=app=web
+  podman-debug --last
   podman-debug nginx:latest
   podman-debug my-stopped-container`,
 	}
@@ -68,23 +238,226 @@ Use --writable to make changes visible to a running or paused container.`,
 	flags := rootCmd.Flags()
 	flags.SetInterspersed(false)
 
-	flags.StringVar(&flagShell, "shell", "auto", "Shell to use: bash, sh, auto")
+	flags.StringVar(&flagShell, "shell", "auto", "Shell to use: bash, sh, zsh, fish, a path, or auto (auto honours $PODMAN_DEBUG_SHELL, then the image SHELL)")
+	flags.StringVar(&flagShellRCFile, "shell-rcfile", "", "Host file an interactive bash or sh runs at startup, for aliases and a prompt")
 	flags.StringVarP(&flagCommand, "command", "c", "", "Execute command instead of interactive shell")
-	flags.StringVar(&flagImage, "image", podman.DefaultDebugImage, "Debug toolbox image")
+	flags.StringArrayVar(&flagScript, "script", nil, "Run a script instead of interactive shell; repeat to add lines, @FILE reads a file")
+	flags.StringVar(&flagCommandFile, "command-file", "", "Run this host script file with the session's shell instead of an interactive shell (same as --script @FILE)")
+	flags.StringVar(&flagOutputFile, "output-file", "", "Write the command's output to this host file instead of stdout")
+	flags.BoolVar(&flagOutputStderr, "output-file-stderr", false, "Write the command's stderr to --output-file too")
+	flags.StringSliceVar(&flagImage, "image", []string{podman.DefaultDebugImage}, "Debug toolbox image; repeat or comma-separate to list fallbacks tried in order")
 	flags.StringVar(&flagPull, "pull", "missing", `Pull policy: "always", "missing", "never"`)
+	flags.StringVar(&flagPlatform, "platform", "", "Pull the debug image and an image target for this OS/ARCH[/VARIANT], e.g. linux/amd64 (default: the host's)")
 	flags.BoolVarP(&flagInteractive, "interactive", "i", true, "Keep STDIN open")
 	flags.BoolVarP(&flagTTY, "tty", "t", true, "Allocate a pseudo-TTY")
 	flags.BoolVarP(&flagWritable, "writable", "w", false, "Make filesystem changes visible to the container")
+	flags.BoolVar(&flagMountVolumes, "mount-volumes", true, "Stopped containers: attach the container's volumes, bind mounts, and tmpfs mounts")
+	flags.BoolVar(&flagNoPicker, "no-interactive-picker", false, "Fail instead of offering a list of containers when no target is given")
+	flags.StringVar(&flagSelect, "select", "", "Debug the one running or paused container matching label=KEY[=VALUE]; arguments are then all command")
+	flags.BoolVar(&flagAll, "all", false, "With --select, consider stopped containers too")
+	flags.BoolVarP(&flagLast, "last", "l", false, "Debug the most recently created container, in any state; arguments are then all command")
+	flags.BoolVar(&flagNoHistoryHints, "no-history-hints", false, "Do not pre-populate shell history with builtin examples")
+	flags.BoolVar(&flagNoCleanup, "no-cleanup-on-error", false, "Leave mounts in place and print their paths if session setup fails")
+	flags.BoolVar(&flagKeepSession, "keep-session", false, "After the session ends, print its mount points and wait for Enter before tearing them down")
+	flags.BoolVar(&flagMinimalDev, "minimal-dev", false, "Populate /dev with a minimal device set instead of binding the host /dev")
+	flags.BoolVar(&flagLayerDebug, "layer-debug-image", false, "Stopped containers and images: show the debug image's files where the target has none")
+	flags.StringVarP(&flagUser, "user", "u", "", "Run the shell or command as this user[:group], by name or numeric ID")
+	flags.BoolVar(&flagAsImageUser, "as-image-user", false, "Run the shell or command as the container's configured USER, with its supplementary groups")
+	flags.BoolVar(&flagRestrictSys, "restrict-sys", false, "Stopped containers and images: read-only /sys without host submounts, /proc limited to processes")
+	flags.BoolVar(&flagNoSeccomp, "no-seccomp", false, "Relax session restrictions: do not set no_new_privs, so setuid and file-capability binaries work")
+	flags.StringVar(&flagCommit, "commit", "", "Save the session's filesystem changes as a new image on clean exit")
+	flags.StringVar(&flagCgroupLimit, "cgroup-limit", "", "Resource limits for the debug shell, e.g. memory=512M,pids=256,cpu=1 (cgroup v2)")
+	flags.StringVar(&flagMemoryLimit, "memory-limit", "", "Memory limit for the debug shell, e.g. 512M (same as --cgroup-limit memory=SIZE)")
+	flags.StringVar(&flagCPULimit, "cpu-limit", "", "CPU limit for the debug shell as a number of CPUs, e.g. 0.5 (same as --cgroup-limit cpu=CPUS)")
+	flags.StringVar(&flagOverlaySize, "overlay-size", debug.DefaultOverlaySize, "Capacity of the tmpfs holding the session's changes and installed packages, e.g. 4G or 512M")
+	flags.StringVar(&flagCwd, "cwd", "", `Directory the shell or command starts in, or "auto" for the target's WORKDIR (default /)`)
+	flags.StringVar(&flagUpperDir, "upperdir", "", "Stopped containers and images: keep the session's changes in this host directory")
+	flags.StringVar(&flagWorkDir, "workdir", "", "Overlay work directory for --upperdir, on the same filesystem")
+	flags.StringVar(&flagSessionName, "session-name", "", "Name shown for this session in ps on the host, as podman-debug[NAME] (default: the target)")
+	flags.StringVar(&flagPodContainer, "container", "", "Pods: debug this member container, by name or ID (default: the infra container)")
+	flags.BoolVar(&flagWaitHealthy, "wait-healthy", false, "Wait until the container's healthcheck reports healthy before starting the session")
+	flags.DurationVar(&flagWaitTimeout, "wait-timeout", 5*time.Minute, "How long --wait-healthy waits before giving up")
+	flags.DurationVar(&flagTimeout, "timeout", 0, "End the shell or command if it is still running after this long, with status 124 (0 for no limit)")
+	flags.StringVar(&flagListen, "listen", "", "Serve the session to one client on this unix socket instead of the terminal")
+	flags.StringArrayVar(&flagAddHost, "add-host", nil, "Add NAME:IP to the session's /etc/hosts, after the existing entries (repeatable)")
+	flags.StringVar(&flagNetwork, "network", "", `"none" to cut the session off from the network, leaving only loopback`)
+	flags.StringArrayVar(&flagDNS, "dns", nil, "Use this nameserver in the session's /etc/resolv.conf instead of the usual ones (repeatable)")
+	flags.StringArrayVar(&flagMountRO, "mount-ro", nil, "Bind host path SRC read-only at DEST in the session, as SRC:DEST (repeatable)")
+	flags.StringArrayVar(&flagCopyOut, "copy-out", nil, "DIR: host directory attached at /.podman-debug/out; /SRC:DEST: copy SRC to the host after the session (repeatable)")
+	flags.IntVar(&flagCoredump, "coredump", 0, "Running containers: write a core dump of this PID (as seen in the container) to --copy-out and exit")
+	flags.StringVar(&flagPostInstall, "post-install", "", "Shell command to run inside the session before the shell or command starts")
+	flags.StringVar(&flagPodmanPath, "podman-path", "", "podman executable to run (default: $PODMAN_DEBUG_PODMAN, then podman from PATH)")
+	flags.StringVar(&flagConnection, "connection", "", "Use this remote podman system connection; only --inspect-entrypoint is supported remotely")
+	flags.DurationVar(&flagPodmanTimeout, "podman-timeout", podman.Timeout, "Give up on a podman inspect, mount, or similar call after this long (0 for no limit)")
+	flags.DurationVar(&flagPullTimeout, "pull-timeout", podman.PullTimeout, "Give up on a podman pull or commit after this long (0 for no limit)")
+	flags.IntVar(&flagPullRetry, "pull-retry", podman.PullRetries, "Retry a pull that failed on a network error or registry timeout this many times, with backoff")
+	flags.IntVar(&flagToolErrorCode, "tool-error-exit-code", 125, "Exit status for podman-debug's own failures, to tell them apart from the command's")
+	flags.BoolVar(&flagCleanup, "cleanup", false, "Unmount what crashed runs left behind, then release all podman container and image mounts, and exit; needs no target")
+	flags.BoolVar(&flagDryRun, "dry-run", false, "Print which images would be pulled, the mode, and each namespace and mount step, then exit without doing them")
+	flags.BoolVar(&flagReportLeaks, "report-leaks", false, "After cleanup, warn about any mounts the run left behind")
+	flags.BoolVar(&flagTimings, "timings", false, "Print how long each setup phase took (as JSON with --output json)")
+	flags.BoolVar(&flagPreserve, "preserve-overlay", false, "Copy the session's filesystem changes to a new host directory after it ends, whatever its exit status")
+	flags.StringVar(&flagExportChanges, "export-changes", "", "Write the session's filesystem changes to this file as a tarball on clean exit")
+	flags.StringVar(&flagCompress, "compress", "gzip", `Compression for --export-changes: "gzip", "zstd", or "none"`)
+	flags.BoolVar(&flagListTools, "list-tools", false, "List the executables the debug image provides and exit; needs no target")
+	flags.BoolVar(&flagInspectEP, "inspect-entrypoint", false, "Print the target's entrypoint metadata as JSON and exit, without starting a session")
+	flags.StringVar(&flagInspectFile, "inspect-file", "", "Read the container's configuration from saved podman container inspect output")
+	flags.StringVar(&flagBuiltins, "builtins", "all", "Builtins to write into the session: all, none, or a list such as entrypoint,init")
+	flags.StringArrayVarP(&flagEnv, "env", "e", nil, "Set KEY=VALUE in the session environment, overriding its defaults (repeatable)")
+	flags.BoolVar(&flagInheritEnv, "inherit-env", true, "Start from the target's configured environment (default true for containers, false for images)")
+	flags.StringVar(&flagEnvFrom, "env-from-container", "", "Add another container's configured environment to the session")
+	flags.BoolVar(&flagHostPID, "host-pid", false, "Stopped containers and images: share the host PID namespace instead of an isolated one")
+	flags.BoolVar(&flagNoPIDNS, "no-pid-namespace", false, "Stopped containers and images: don't create a PID namespace, where that isn't permitted (implies --host-pid)")
+	flags.BoolVar(&flagNoJoinIPC, "no-join-ipc", false, "Running containers: keep the host IPC namespace instead of joining the container's")
+	flags.BoolVar(&flagNoJoinUTS, "no-join-uts", false, "Running containers: keep the host hostname (UTS namespace) instead of joining the container's")
+	flags.StringVar(&flagTZ, "tz", "", "Timezone for the session (default: the target's /etc/localtime)")
+	flags.StringVar(&flagOutput, "output", "text", `Output format for batch mode, --timings, and --list-tools: "text" or "json"`)
+	flags.StringVar(&flagLogFormat, "log-format", "text", `Format of notes, warnings, and errors on stderr: "text" or "json"`)
+	flags.BoolVar(&flagOffline, "offline", false, "No network: use only local images, and disable install in the session")
+	flags.StringVar(&flagNixpkgsRef, "nixpkgs-ref", "", "Flake reference used by install for plain package names (e.g. github:NixOS/nixpkgs/nixos-24.05)")
+
+	// Subcommand names shadow targets of the same name; such a target
+	// can still be given by ID.  No completion command: it would shadow
+	// one more name.
+	rootCmd.AddCommand(newShellsCommand())
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
 
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(125)
+		debug.Log.Error("%v", err)
+		var nsErr *debug.NamespaceError
+		if errors.As(err, &nsErr) && nsErr.Hint() != "" {
+			debug.Log.Hint("%s", nsErr.Hint())
+		}
+		os.Exit(flagToolErrorCode)
 	}
+	os.Exit(exitCode)
 }
 
 func debugRun(cmd *cobra.Command, args []string) error {
+	if flagLogFormat != "text" && flagLogFormat != "json" {
+		return fmt.Errorf("invalid --log-format %q: expected text or json", flagLogFormat)
+	}
+	debug.Log = debug.NewLogger(os.Stderr, flagLogFormat)
+	defer handleInterrupts()()
+
+	if flagOffline {
+		if flagPull == "always" {
+			return fmt.Errorf("--offline cannot be used with --pull always")
+		}
+		flagPull = "never"
+	}
+
+	if flagPullRetry < 0 {
+		return fmt.Errorf("invalid --pull-retry %d: expected 0 or more", flagPullRetry)
+	}
+
+	if flagPlatform != "" {
+		if err := podman.ValidatePlatform(flagPlatform); err != nil {
+			return fmt.Errorf("--platform: %w", err)
+		}
+	}
+
+	if flagConnection != "" {
+		// Sessions mount the target and join its processes'
+		// namespaces, neither of which reaches another host.
+		if !flagInspectEP {
+			return fmt.Errorf("--connection supports only --inspect-entrypoint: a debug session needs the target's filesystem and processes on this host")
+		}
+		podman.Connection = flagConnection
+	}
+
+	if flagListTools {
+		return listTools()
+	}
+
+	if flagCleanup {
+		if len(args) > 0 {
+			return fmt.Errorf("--cleanup takes no target")
+		}
+		return cleanupLeaks()
+	}
+
+	if flagAll && flagSelect == "" {
+		return fmt.Errorf("--all only applies to --select")
+	}
+
+	if flagLast && flagSelect != "" {
+		return fmt.Errorf("--last and --select cannot be used together")
+	}
+
+	if len(args) == 0 && flagSelect == "" && !flagLast && !canPick() {
+		return fmt.Errorf("requires at least 1 arg(s), only received 0")
+	}
+
+	if flagToolErrorCode < 1 || flagToolErrorCode > 255 {
+		code := flagToolErrorCode
+		flagToolErrorCode = 125
+		return fmt.Errorf("invalid --tool-error-exit-code %d: expected 1-255", code)
+	}
+
+	podman.Timeout, podman.PullTimeout = flagPodmanTimeout, flagPullTimeout
+	podman.PullRetries = flagPullRetry
+
+	version, err := podman.EnsureAvailable()
+	if err != nil {
+		return err
+	}
+	podmanVersion = version
+
+	// --select and --last name the target, so every argument is command.
+	if flagSelect != "" || flagLast {
+		var target string
+		if flagLast {
+			target, err = latestTarget()
+		} else {
+			target, err = selectTarget(flagSelect, flagAll)
+		}
+		if err != nil {
+			return err
+		}
+		if cmd.ArgsLenAtDash() == 0 {
+			// The flag parser drops a leading --; put it back.
+			args = append([]string{target, "--"}, args...)
+		} else {
+			args = append([]string{target}, args...)
+		}
+	}
+
+	if flagInspectEP {
+		if len(args) != 1 {
+			return fmt.Errorf("--inspect-entrypoint takes exactly one container or image")
+		}
+		return printEntrypoint(args[0])
+	}
+
+	// With no target, ask for one.
+	if len(args) == 0 {
+		target, err := pickTarget(os.Stdin, os.Stderr)
+		if err != nil {
+			return err
+		}
+		args = []string{target}
+	}
 	nameOrID := args[0]
 
+	if flagTimings {
+		timings = debug.NewTimings()
+		defer printTimings()
+	}
+
+	// "--" after the target passes the rest through as an argv,
+	// executed directly without a shell.
+	if len(args) > 1 && args[1] == "--" {
+		if flagCommand != "" {
+			return fmt.Errorf("-c and a command after -- cannot be used together")
+		}
+		if len(args) == 2 {
+			return fmt.Errorf("no command given after --")
+		}
+		commandArgv = args[2:]
+		args = args[:1]
+	}
+
 	// Handle positional command arguments.
 	if len(args) > 1 && flagCommand == "" {
 		cmdArgs := args[1:]
@@ -94,163 +467,1089 @@ func debugRun(cmd *cobra.Command, args []string) error {
 		flagCommand = strings.Join(cmdArgs, " ")
 	}
 
-	// Pull and mount the nix debug image.
-	debugImage := flagImage
-	if err := podman.PullImage(debugImage, flagPull); err != nil {
-		return fmt.Errorf("pulling debug image: %w", err)
+	// --command-file FILE is --script @FILE under the name -c users
+	// look for.
+	scriptFlag := "--script"
+	if flagCommandFile != "" {
+		if len(flagScript) > 0 {
+			return fmt.Errorf("--command-file and --script cannot be used together")
+		}
+		flagScript, scriptFlag = []string{"@" + flagCommandFile}, "--command-file"
+	}
+	if len(flagScript) > 0 {
+		if flagCommand != "" || len(commandArgv) > 0 {
+			return fmt.Errorf("%s cannot be combined with -c or a command", scriptFlag)
+		}
+		script, err := loadScript(flagScript)
+		if err != nil {
+			return fmt.Errorf("%s: %w", scriptFlag, err)
+		}
+		sessionScript = script
+	}
+
+	if flagShellRCFile != "" {
+		rc, err := os.ReadFile(flagShellRCFile)
+		if err != nil {
+			return fmt.Errorf("--shell-rcfile: %w", err)
+		}
+		if hasCommand() {
+			debug.Log.Note("--shell-rcfile has no effect on a command; only an interactive shell reads it.")
+		} else {
+			shellRCFile = rc
+		}
+	}
+
+	if err := parseCopyOut(flagCopyOut); err != nil {
+		return err
+	}
+	switch flagNetwork {
+	case "", "none":
+	default:
+		return fmt.Errorf("invalid --network %q: only none is supported", flagNetwork)
+	}
+	if flagNetwork == "none" && (len(flagAddHost) > 0 || len(flagDNS) > 0) {
+		return fmt.Errorf("--add-host and --dns cannot be used with --network none")
+	}
+	if err := parseAddHost(flagAddHost); err != nil {
+		return err
+	}
+	for _, v := range flagDNS {
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return fmt.Errorf("invalid --dns %q: not an IP address", v)
+		}
+		nameservers = append(nameservers, addr.String())
+	}
+	if err := parseMountRO(flagMountRO); err != nil {
+		return err
 	}
 
-	nixMountPoint, err := podman.MountImage(debugImage)
+	if flagCoredump < 0 {
+		return fmt.Errorf("invalid --coredump %d: expected a PID", flagCoredump)
+	}
+	if flagCoredump != 0 {
+		if hasCommand() {
+			return fmt.Errorf("--coredump cannot be combined with -c, --script or a command")
+		}
+		commandArgv = []string{"coredump", strconv.Itoa(flagCoredump)}
+		if copyOutDir == "" {
+			copyOutDir = "."
+		}
+	}
+
+	if err := validateBatch(nameOrID); err != nil {
+		return err
+	}
+
+	if flagTimeout < 0 {
+		return fmt.Errorf("invalid --timeout %s: must not be negative", flagTimeout)
+	}
+
+	if flagOutputStderr && flagOutputFile == "" {
+		return fmt.Errorf("--output-file-stderr needs --output-file")
+	}
+	if flagOutputFile != "" {
+		if !hasCommand() {
+			return fmt.Errorf("--output-file needs a command (-c, --script, or after --); an interactive session writes to the terminal")
+		}
+		if flagListen != "" {
+			return fmt.Errorf("--output-file cannot be used with --listen")
+		}
+	}
+
+	if !slices.Contains(debug.Compressions, flagCompress) {
+		return fmt.Errorf("invalid --compress %q: expected %s", flagCompress, strings.Join(debug.Compressions, ", "))
+	}
+
+	if flagNoPIDNS {
+		flagHostPID = true
+	}
+
+	if flagCwd != "" && flagCwd != "auto" && !filepath.IsAbs(flagCwd) {
+		return fmt.Errorf("invalid --cwd %q: expected an absolute path or auto", flagCwd)
+	}
+
+	if flagUser != "" && flagAsImageUser {
+		return fmt.Errorf("--user and --as-image-user cannot be used together")
+	}
+
+	if err := debug.ValidateOverlaySize(flagOverlaySize); err != nil {
+		return fmt.Errorf("--overlay-size: %w", err)
+	}
+
+	if (flagUpperDir == "") != (flagWorkDir == "") {
+		return fmt.Errorf("--upperdir and --workdir must be given together")
+	}
+	if flagPreserve && flagUpperDir != "" {
+		return fmt.Errorf("--preserve-overlay is not needed with --upperdir: the changes are kept there already")
+	}
+	if flagPreserve && flagWritable {
+		return fmt.Errorf("--preserve-overlay cannot be used with --writable: changes go straight to the container")
+	}
+
+	if flagInspectFile != "" {
+		if err := loadInspectFile(flagInspectFile); err != nil {
+			return err
+		}
+	}
+
+	builtins, err := debug.ParseBuiltins(flagBuiltins)
 	if err != nil {
-		return fmt.Errorf("mounting debug image: %w", err)
+		return fmt.Errorf("--builtins: %w", err)
+	}
+	enabledBuiltins = builtins
+	if flagCoredump != 0 && builtins != nil && !builtins["coredump"] {
+		return fmt.Errorf("--coredump needs the coredump builtin; add it to --builtins")
+	}
+
+	if copyOutDir != "" {
+		dir, err := filepath.Abs(copyOutDir)
+		if err != nil {
+			return fmt.Errorf("--copy-out: %w", err)
+		}
+		copyOutDir = dir
+	}
+	// A dry run creates nothing on the host either.
+	if !flagDryRun {
+		if copyOutDir != "" {
+			if err := os.MkdirAll(copyOutDir, 0755); err != nil {
+				return fmt.Errorf("--copy-out: %w", err)
+			}
+		}
+		for _, p := range copyOutPaths {
+			if err := os.MkdirAll(filepath.Dir(p.Dest), 0755); err != nil {
+				return fmt.Errorf("--copy-out: %w", err)
+			}
+		}
+	}
+
+	inheritImageEnv = flagInheritEnv && cmd.Flags().Changed("inherit-env")
+
+	if err := debug.ValidateEnv(flagEnv); err != nil {
+		return err
+	}
+
+	if flagEnvFrom != "" {
+		env, err := podman.InspectContainerEnv(flagEnvFrom)
+		if err != nil {
+			return fmt.Errorf("--env-from-container: %w", err)
+		}
+		sessionEnv = env
+	}
+
+	if flagCgroupLimit != "" || flagMemoryLimit != "" || flagCPULimit != "" {
+		limits, err := debug.ParseCgroupLimits(flagCgroupLimit)
+		if err != nil {
+			return err
+		}
+		// --memory-limit and --cpu-limit are shorthands for a key of
+		// --cgroup-limit each.
+		for _, l := range []struct{ flag, key, value string }{
+			{"--memory-limit", "memory", flagMemoryLimit},
+			{"--cpu-limit", "cpu", flagCPULimit},
+		} {
+			if l.value == "" {
+				continue
+			}
+			if strings.Contains(l.value, ",") {
+				return fmt.Errorf("invalid %s %q: expected a single value", l.flag, l.value)
+			}
+			extra, err := debug.ParseCgroupLimits(l.key + "=" + l.value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", l.flag, err)
+			}
+			for file, value := range extra {
+				if _, ok := limits[file]; ok {
+					return fmt.Errorf("%s and --cgroup-limit %s= cannot be used together", l.flag, l.key)
+				}
+				limits[file] = value
+			}
+		}
+		cgroupLimits = limits
 	}
-	defer podman.UnmountImage(debugImage)
 
-	nixPath := filepath.Join(nixMountPoint, "nix")
-	if _, err := os.Stat(nixPath); err != nil {
-		return fmt.Errorf("nix store not found in debug image at %s: %w", nixPath, err)
+	if flagSessionName != "" {
+		setProcTitle(flagSessionName)
+	} else if nameOrID != batchTarget {
+		setProcTitle(nameOrID)
 	}
 
-	shell := debug.DetectShell(flagShell)
 	var shellArgs []string
 	if flagCommand != "" {
 		shellArgs = []string{"-c", flagCommand}
+	} else if sessionScript != nil {
+		shellArgs = []string{debug.ScriptPath}
+	}
+
+	if flagDryRun {
+		if nameOrID == batchTarget {
+			return fmt.Errorf("--dry-run needs a single target, not -")
+		}
+		return printPlan(nameOrID, shellArgs)
+	}
+
+	// Opened here, on the host, so the path is resolved before any
+	// namespace or chroot.
+	if flagOutputFile != "" {
+		f, err := os.Create(flagOutputFile)
+		if err != nil {
+			return fmt.Errorf("--output-file: %w", err)
+		}
+		defer f.Close()
+		outputFile = f
+	}
+
+	// A crashed run may have left its overlay mounted; the session's
+	// would stack on top of it.
+	if unmounted, _ := debug.UnmountLeftovers(); len(unmounted) > 0 {
+		debug.Log.Note("Unmounted what an earlier podman-debug run left behind: %s", strings.Join(unmounted, ", "))
+	}
+
+	// Registered before any mount's cleanup, so it runs after all of
+	// them.
+	if flagReportLeaks {
+		defer reportLeaks(listPodmanMounts())
+	}
+
+	// vfs is usually what podman falls back to where overlay mounts
+	// don't work, such as on an overlay root inside another container;
+	// every session stacks an overlay on the target's root and the
+	// debug image's /nix.
+	if driver, err := podman.StorageDriver(); err == nil && driver == "vfs" {
+		debug.Log.Warn("podman uses the vfs storage driver, often a sign that overlay mounts don't work on this host; the session's overlay may fail to mount")
+	}
+
+	// Pull and mount the nix debug image.
+	debugImage, nixPath, err := mountDebugImage(flagImage)
+	if err != nil {
+		return err
+	}
+	defer holdMount(podman.UnmountImage, "podman image unmount", debugImage)()
+	debug.Log.Event("debug image mounted", "image", debugImage, "nix_path", nixPath)
+
+	// A shell named for the debug image can be checked before any
+	// target is touched; a path waits for the target's filesystem.
+	if flagShell != "auto" && !filepath.IsAbs(flagShell) {
+		if _, err := debug.DetectShell(flagShell, nixPath); err != nil {
+			return err
+		}
+	}
+
+	if len(flagImage) > 1 {
+		debug.Log.Note("Using debug image %s.", debugImage)
+	}
+
+	for _, note := range debug.Restrictions() {
+		debug.Log.Warn("%s.", note)
+	}
+
+	if nameOrID == batchTarget {
+		code, err := runBatch(os.Stdin, nixPath, shellArgs)
+		exitCode = code
+		return err
 	}
 
 	streams := resolveStreams()
+	var client *listenSession
+	if flagListen != "" {
+		client, err = acceptSession(flagListen, ttySession())
+		if err != nil {
+			return err
+		}
+		streams = client.streams
+	}
 
-	// Try as a container first, fall back to image.
-	exitCode, err := tryContainerDebug(nameOrID, nixPath, shell, shellArgs, streams)
-	if err == nil {
-		os.Exit(exitCode)
+	copiedBefore := listCopyOut()
+	code, err := debugTarget(nameOrID, nixPath, shellArgs, streams)
+	reportCopyOut(copiedBefore)
+	if client != nil {
+		if err != nil {
+			code = flagToolErrorCode
+		}
+		client.finish(code, err)
+	}
+	if err != nil {
+		return err
+	}
+	debug.Log.Event("session exited", "exit_code", code)
+	exitCode = code
+	return nil
+}
+
+// debugTarget debugs nameOrID through a debug.Session set up from the
+// flags; see debug.Session.Run for how the target is resolved.
+func debugTarget(nameOrID, nixPath string, shellArgs []string, streams debug.Streams) (int, error) {
+	policy := "missing"
+	if flagOffline {
+		policy = "never"
 	}
+	restoreTerminal, removeChanges := func() {}, func() {}
+	defer func() { restoreTerminal() }()
 
-	if !isNotFound(err) {
+	s := &debug.Session{
+		NixPath:     nixPath,
+		Shell:       flagShell,
+		ShellArgs:   shellArgs,
+		Streams:     streams,
+		PullPolicy:  policy,
+		Platform:    flagPlatform,
+		PodMember:   flagPodContainer,
+		WaitHealthy: flagWaitHealthy,
+		WaitTimeout: flagWaitTimeout,
+		Hold:        holdMount,
+		Prepare: func(t *debug.Target, opts *debug.Options) error {
+			restoreTerminal()
+			restoreTerminal = setupTerminal()
+			if err := prepareSession(t, opts); err != nil {
+				return err
+			}
+			cleanup, err := prepareChanges(opts)
+			if err != nil {
+				return err
+			}
+			removeChanges = cleanup
+			return nil
+		},
+		Finish: func(t *debug.Target, opts *debug.Options, code int, err error) (int, error) {
+			defer removeChanges()
+			code, err = setupResult(code, err)
+			if t.Container {
+				return saveSession(code, err, opts, t.Ref, "")
+			}
+			return saveSession(code, err, opts, "", t.Ref)
+		},
+	}
+	return s.Run(context.Background(), nameOrID, sessionOptions())
+}
+
+// listTools prints the executables in the debug image's default nix
+// profile, one per line, or as a JSON array with --output json.
+func listTools() error {
+	if flagOutput != "text" && flagOutput != "json" {
+		return fmt.Errorf("invalid --output %q: expected text or json", flagOutput)
+	}
+	podman.Timeout, podman.PullTimeout = flagPodmanTimeout, flagPullTimeout
+	podman.PullRetries = flagPullRetry
+	if _, err := podman.EnsureAvailable(); err != nil {
 		return err
 	}
 
-	exitCode, err = tryImageDebug(nameOrID, nixPath, shell, shellArgs, streams)
+	debugImage, nixPath, err := mountDebugImage(flagImage)
 	if err != nil {
-		return fmt.Errorf("no container or image found for %q: %w", nameOrID, err)
+		return err
 	}
+	defer holdMount(podman.UnmountImage, "podman image unmount", debugImage)()
 
-	os.Exit(exitCode)
+	tools, err := debug.ListTools(nixPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", debugImage, err)
+	}
+	if flagOutput == "json" {
+		if tools == nil {
+			tools = []string{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(tools)
+	}
+	for _, t := range tools {
+		fmt.Println(t)
+	}
 	return nil
 }
 
-func tryContainerDebug(nameOrID, nixPath, shell string, shellArgs []string, streams debug.Streams) (int, error) {
-	ctr, err := podman.InspectContainer(nameOrID)
+// printEntrypoint writes the entrypoint metadata of nameOrID, a
+// container or else a local image, to stdout as JSON: the same data
+// the entrypoint builtin shows with --json.
+func printEntrypoint(nameOrID string) error {
+	ep, err := podman.InspectContainerEntrypoint(nameOrID)
 	if err != nil {
-		return 0, err
+		if !isNotFound(err) {
+			return err
+		}
+		if ep, err = podman.InspectImageEntrypoint(nameOrID); err != nil {
+			return fmt.Errorf("no container or local image found for %q: %w", nameOrID, err)
+		}
 	}
+	if len(ep.Entrypoint) == 0 && len(ep.Cmd) == 0 {
+		return fmt.Errorf("%s has no entrypoint or cmd configured", nameOrID)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ep)
+}
 
-	// Resolve entrypoint metadata (best-effort, non-fatal).
-	ep, _ := podman.InspectContainerEntrypoint(nameOrID)
+// mountDebugImage pulls and mounts the first usable debug image from
+// images, trying each in order.  An image that pulls and mounts but
+// has no nix store is unmounted again before moving on.  Returns the
+// image used and the host-side path to its nix store.
+func mountDebugImage(images []string) (string, string, error) {
+	var errs []error
+	for _, image := range images {
+		pulled := timings.Track("debug image pull")
+		err := podman.PullImage(image, flagPull, flagPlatform)
+		pulled()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pulling debug image %s: %w", image, err))
+			continue
+		}
 
-	restoreTerminal := setupTerminal()
-	defer restoreTerminal()
+		mounted := timings.Track("debug image mount")
+		mountPoint, err := podman.MountImage(image)
+		mounted()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mounting debug image: %w", err))
+			continue
+		}
 
-	switch ctr.State {
-	case "running":
-		return runLiveDebug(ctr.PID, nixPath, shell, shellArgs, streams, ep)
-	case "paused":
-		fmt.Fprintln(os.Stderr, "Note: Container is paused. Processes are frozen but filesystem is accessible.")
-		return runLiveDebug(ctr.PID, nixPath, shell, shellArgs, streams, ep)
-	case "stopped", "exited", "created", "configured":
-		fmt.Fprintln(os.Stderr, "Note: Container is not running. Changes will be discarded on exit.")
-		return runSnapshotDebug(nameOrID, nixPath, shell, shellArgs, streams, ep)
-	default:
-		return 0, fmt.Errorf("container %s is in unsupported state: %s", nameOrID, ctr.State)
+		nixPath, err := podman.ValidateDebugImage(image, mountPoint)
+		if err != nil {
+			_ = podman.UnmountImage(image)
+			errs = append(errs, err)
+			continue
+		}
+
+		return image, nixPath, nil
+	}
+	if len(errs) == 0 {
+		return "", "", fmt.Errorf("no debug image specified")
+	}
+	return "", "", errors.Join(errs...)
+}
+
+// prepareSession fills in the options that depend on the resolved
+// target, and checks the flags against its mode.
+func prepareSession(t *debug.Target, opts *debug.Options) error {
+	if t.Container && savedInspect != nil {
+		if err := checkSavedInspect(t.ID, t.Name); err != nil {
+			return err
+		}
+		opts.Entrypoint, _ = podman.ParseContainerEntrypoint(savedInspect)
+		opts.Mounts, _ = podman.ParseContainerMounts(savedInspect)
+	}
+
+	switch opts.Mode {
+	case debug.ModeLive:
+		if flagUpperDir != "" {
+			return fmt.Errorf("--upperdir is only supported for stopped containers and images")
+		}
+		if flagExportChanges != "" && flagWritable {
+			return fmt.Errorf("--export-changes cannot be used with --writable: changes go straight to the container")
+		}
+		if os.Getuid() == 0 && os.Getenv("_PODMAN_DEBUG_UNSHARED") == "" {
+			warnRootlessTarget(t.Ref, t.PID)
+		}
+		if flagHostPID {
+			debug.Log.Note("--host-pid has no effect on a running container; joining its PID namespace.")
+		}
+		if flagRestrictSys {
+			debug.Log.Note("--restrict-sys has no effect on a running container; the session sees the container's own /sys and /proc.")
+		}
+		if flagLayerDebug {
+			debug.Log.Note("--layer-debug-image has no effect on a running container; only /nix is taken from the debug image.")
+		}
+		if !flagMountVolumes {
+			debug.Log.Note("--mount-volumes=false has no effect on a running container; its volumes are part of its mount namespace.")
+		}
+		opts.Writable = flagWritable
+	case debug.ModeSnapshot:
+		opts.WritableVolumes = flagWritable
+		opts.NoVolumes = !flagMountVolumes
+		if flagWritable && !flagMountVolumes {
+			debug.Log.Note("--writable has no effect with --mount-volumes=false; a stopped container's changes are discarded.")
+		}
+	}
+	modeOptions(opts)
+
+	if t.Container {
+		inheritContainerEnv(opts, t.Ref)
+	} else if inheritImageEnv {
+		env, _ := podman.InspectImageEnv(t.Ref)
+		opts.Env = slices.Concat(env, sessionEnv)
+	}
+	opts.TZ = sessionTimezone(t.Rootfs)
+	return nil
+}
+
+// inheritContainerEnv starts the session from the container's own
+// configured environment unless --inherit-env=false.  Anything
+// borrowed with --env-from-container comes after it and wins.
+func inheritContainerEnv(opts *debug.Options, nameOrID string) {
+	if !flagInheritEnv {
+		return
+	}
+	env, _ := podman.InspectContainerEnv(nameOrID)
+	opts.Env = slices.Concat(env, sessionEnv)
+}
+
+// prepareChanges creates the temporary file the session writes its
+// overlay changes to when --commit or --export-changes is set, and the
+// directory it copies them into for --preserve-overlay.  Writable
+// sessions change the container directly and need neither.  The
+// returned func removes the file again; the directory is kept.
+func prepareChanges(opts *debug.Options) (func(), error) {
+	if opts.Writable {
+		return func() {}, nil
+	}
+	if flagPreserve {
+		dir, err := os.MkdirTemp("", "podman-debug-overlay-")
+		if err != nil {
+			return nil, fmt.Errorf("--preserve-overlay: %w", err)
+		}
+		opts.PreserveOverlay = dir
+	}
+	if flagCommit == "" && flagExportChanges == "" {
+		return func() {}, nil
 	}
+	f, err := os.CreateTemp("", "podman-debug-changes-*.tar")
+	if err != nil {
+		return nil, fmt.Errorf("creating changes file: %w", err)
+	}
+	opts.ChangesOut = f
+	return func() {
+		f.Close()
+		os.Remove(f.Name())
+	}, nil
+}
+
+// saveSession exports and commits a session's changes as requested.
+func saveSession(code int, err error, opts *debug.Options, container, image string) (int, error) {
+	code, err = exportSession(code, err, opts)
+	return commitSession(code, err, opts, container, image)
 }
 
-func tryImageDebug(nameOrID, nixPath, shell string, shellArgs []string, streams debug.Streams) (int, error) {
-	fmt.Fprintln(os.Stderr, "Note: Debugging an image. Changes will be discarded on exit.")
+// exportSession writes a cleanly exited session's changes to the
+// --export-changes file, compressed as --compress says.  The tarball is
+// streamed through the compressor, so memory use does not grow with
+// the size of the change set.
+func exportSession(code int, err error, opts *debug.Options) (int, error) {
+	if flagExportChanges == "" || err != nil {
+		return code, err
+	}
+	if code != 0 {
+		debug.Log.Note("Session exited with status %d, not exporting changes.", code)
+		return code, nil
+	}
+
+	path := exportPath(flagExportChanges, flagCompress)
+	if err := writeExport(path, opts.ChangesOut); err != nil {
+		os.Remove(path)
+		return code, fmt.Errorf("exporting session changes: %w", err)
+	}
+	debug.Log.Note("Exported session changes to %s.", path)
+	return code, nil
+}
 
-	if err := podman.PullImage(nameOrID, "missing"); err != nil {
-		return 0, fmt.Errorf("pulling image %s: %w", nameOrID, err)
+// exportPath appends the extension for compression to path unless it
+// already has it.
+func exportPath(path, compression string) string {
+	ext := debug.CompressionExt(compression)
+	if strings.HasSuffix(path, ext) {
+		return path
 	}
+	return path + ext
+}
 
-	// Resolve entrypoint metadata (best-effort, non-fatal).
-	ep, _ := podman.InspectImageEntrypoint(nameOrID)
+// writeExport compresses the changes tarball into a new file at path.
+func writeExport(path string, changes *os.File) error {
+	if _, err := changes.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	mountPoint, err := podman.MountImage(nameOrID)
+	zw, err := debug.NewCompressor(f, flagCompress)
 	if err != nil {
-		return 0, fmt.Errorf("mounting image %s: %w", nameOrID, err)
+		return err
+	}
+	if _, err := io.Copy(zw, changes); err != nil {
+		return err
 	}
-	defer podman.UnmountImage(nameOrID)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
 
-	restoreTerminal := setupTerminal()
-	defer restoreTerminal()
+// commitSession saves a cleanly exited session as the --commit image.
+// Writable sessions commit the container as-is.  Otherwise the
+// session's changes are layered on a base: the image itself, or for a
+// container, the container committed first so its own changes are kept.
+func commitSession(code int, err error, opts *debug.Options, container, image string) (int, error) {
+	if flagCommit == "" || err != nil {
+		return code, err
+	}
+	if code != 0 {
+		debug.Log.Note("Session exited with status %d, not committing %s.", code, flagCommit)
+		return code, nil
+	}
 
-	opts := &debug.Options{
-		Mode:           debug.ModeImage,
-		HostMountpoint: mountPoint,
-		Entrypoint:     ep,
+	if container != "" {
+		if err := podman.Commit(container, flagCommit); err != nil {
+			return code, err
+		}
+	}
+	if !opts.Writable {
+		base := image
+		if container != "" {
+			base = flagCommit
+		}
+		err := podman.CommitChanges(base, flagCommit, func(rootfs string) error {
+			if _, err := opts.ChangesOut.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			return debug.ApplyChanges(opts.ChangesOut, rootfs)
+		})
+		if err != nil {
+			return code, fmt.Errorf("committing session changes: %w", err)
+		}
 	}
 
-	return debug.ExecSnapshot(nixPath, mountPoint, shell, shellArgs, streams, opts)
+	debug.Log.Note("Committed session changes as %s.", flagCommit)
+	return code, nil
 }
 
-func runLiveDebug(pid int, nixPath, shell string, shellArgs []string, streams debug.Streams, ep *podman.EntrypointInfo) (int, error) {
-	opts := &debug.Options{
-		Mode:       debug.ModeLive,
-		Writable:   flagWritable,
-		Entrypoint: ep,
+// resolveShell applies the --shell / $PODMAN_DEBUG_SHELL / image SHELL
+// precedence against the target's root filesystem at rootfs.
+func resolveShell(nixPath, rootfs string, ep *podman.EntrypointInfo) (string, error) {
+	var imageShell []string
+	if ep != nil {
+		imageShell = ep.Shell
 	}
-	return debug.ExecLive(pid, nixPath, shell, shellArgs, streams, opts)
+	return debug.ResolveShell(flagShell, imageShell, nixPath, rootfs)
 }
 
-func runSnapshotDebug(nameOrID, nixPath, shell string, shellArgs []string, streams debug.Streams, ep *podman.EntrypointInfo) (int, error) {
-	mountPoint, err := podman.MountContainer(nameOrID)
+// loadInspectFile reads and validates saved podman container inspect
+// output for --inspect-file.
+func loadInspectFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("--inspect-file: %w", err)
+	}
+	info, err := podman.ParseContainerInspect(data)
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("--inspect-file %s: %w", path, err)
+	}
+	debug.Log.Note("Using configuration of container %s from %s.", cmp.Or(info.Name, info.ID[:min(12, len(info.ID))]), path)
+	savedInspect = data
+	return nil
+}
+
+// checkSavedInspect rejects --inspect-file output of a container other
+// than the target, which has the given ID and name.
+func checkSavedInspect(id, name string) error {
+	if savedInspect == nil {
+		return nil
+	}
+	if err := podman.CheckInspectTarget(savedInspect, id, name); err != nil {
+		return fmt.Errorf("--inspect-file %s: %w", flagInspectFile, err)
+	}
+	return nil
+}
+
+// containerEntrypoint returns a container's entrypoint metadata, from
+// --inspect-file when given.
+func containerEntrypoint(nameOrID string) (*podman.EntrypointInfo, error) {
+	if savedInspect != nil {
+		return podman.ParseContainerEntrypoint(savedInspect)
 	}
-	defer podman.UnmountContainer(nameOrID)
+	return podman.InspectContainerEntrypoint(nameOrID)
+}
 
-	opts := &debug.Options{
-		Mode:           debug.ModeSnapshot,
-		HostMountpoint: mountPoint,
-		Entrypoint:     ep,
+// containerMounts returns a container's configured mounts, from
+// --inspect-file when given.
+func containerMounts(nameOrID string) ([]podman.Mount, error) {
+	if savedInspect != nil {
+		return podman.ParseContainerMounts(savedInspect)
 	}
+	return podman.InspectContainerMounts(nameOrID)
+}
 
-	return debug.ExecSnapshot(nixPath, mountPoint, shell, shellArgs, streams, opts)
+// warnRootlessTarget warns when root is about to debug a container
+// that runs in another user's rootless podman: the session joins the
+// container's namespaces but not its user namespace, so file ownership
+// inside shows up shifted into that user's subordinate ID range.
+func warnRootlessTarget(nameOrID string, pid int) {
+	uid, ok := debug.RootlessOwner(pid)
+	if !ok {
+		return
+	}
+	owner := strconv.Itoa(uid)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	debug.Log.Warn("%s is a rootless container of user %s.  Running as root, the session does not share its user namespace, so files will show shifted owners (e.g. 100000 instead of 0) and permission checks may differ.", nameOrID, owner)
+	debug.Log.Hint("Run podman-debug as the container's owner instead: sudo -iu %s podman-debug %s", owner, nameOrID)
 }
 
-func setupTerminal() func() {
-	// Only enter raw mode for interactive sessions (no -c command).
-	// Raw mode disables output processing (\n -> \r\n translation),
-	// which corrupts output from non-interactive commands.
-	if flagTTY && flagInteractive && flagCommand == "" {
-		if xterm.IsTerminal(int(os.Stdin.Fd())) {
-			oldState, err := xterm.MakeRaw(int(os.Stdin.Fd()))
-			if err == nil {
-				return func() {
-					_ = xterm.Restore(int(os.Stdin.Fd()), oldState)
-				}
+// parseCopyOut sorts the --copy-out values into copyOutDir (a plain
+// directory, at most one) and copyOutPaths (/SRC:DEST), resolving host
+// paths against the current directory.
+func parseCopyOut(values []string) error {
+	for _, v := range values {
+		src, dest, ok := strings.Cut(v, ":")
+		if !ok {
+			if copyOutDir != "" {
+				return fmt.Errorf("--copy-out: only one directory can be attached, got %s and %s", copyOutDir, v)
+			}
+			copyOutDir = v
+			continue
+		}
+		if !filepath.IsAbs(src) || dest == "" {
+			return fmt.Errorf("invalid --copy-out %q: expected DIR or /SRC:DEST", v)
+		}
+		dest, err := filepath.Abs(dest)
+		if err != nil {
+			return fmt.Errorf("--copy-out: %w", err)
+		}
+		copyOutPaths = append(copyOutPaths, debug.CopyOutPath{Src: filepath.Clean(src), Dest: dest})
+	}
+	return nil
+}
+
+// parseMountRO parses the --mount-ro values into hostMounts, resolving
+// host paths against the current directory.
+func parseMountRO(values []string) error {
+	for _, v := range values {
+		src, dest, ok := strings.Cut(v, ":")
+		if !ok || src == "" || dest == "" {
+			return fmt.Errorf("invalid --mount-ro %q: expected SRC:DEST", v)
+		}
+		if err := debug.CheckHostMountDest(dest); err != nil {
+			return fmt.Errorf("invalid --mount-ro %q: %w", v, err)
+		}
+		src, err := filepath.Abs(src)
+		if err != nil {
+			return fmt.Errorf("--mount-ro: %w", err)
+		}
+		if _, err := os.Stat(src); err != nil {
+			return fmt.Errorf("--mount-ro: %w", err)
+		}
+		hostMounts = append(hostMounts, debug.HostMount{Source: src, Dest: filepath.Clean(dest)})
+	}
+	return nil
+}
+
+// parseAddHost parses the --add-host values into extraHosts.  The name
+// comes first, so an IPv6 address keeps its colons.
+func parseAddHost(values []string) error {
+	for _, v := range values {
+		name, ip, ok := strings.Cut(v, ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \t#") {
+			return fmt.Errorf("invalid --add-host %q: expected NAME:IP", v)
+		}
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return fmt.Errorf("invalid --add-host %q: %q is not an IP address", v, ip)
+		}
+		extraHosts = append(extraHosts, addr.String()+"\t"+name)
+	}
+	return nil
+}
+
+// listCopyOut returns the modification times of the files in the
+// --copy-out directory, nil when there is none.
+func listCopyOut() map[string]time.Time {
+	if copyOutDir == "" {
+		return nil
+	}
+	files := map[string]time.Time{}
+	entries, _ := os.ReadDir(copyOutDir)
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && info.Mode().IsRegular() {
+			files[e.Name()] = info.ModTime()
+		}
+	}
+	return files
+}
+
+// reportCopyOut prints the host path of every file the session wrote to
+// the --copy-out directory, given its contents beforehand.
+func reportCopyOut(before map[string]time.Time) {
+	if before == nil {
+		return
+	}
+	after := listCopyOut()
+	for _, name := range slices.Sorted(maps.Keys(after)) {
+		if old, ok := before[name]; !ok || !old.Equal(after[name]) {
+			debug.Log.Print("Copied out: %s", filepath.Join(copyOutDir, name))
+		}
+	}
+}
+
+// earlyToolErrorCode finds --tool-error-exit-code in args before cobra
+// has parsed them, for the failures that can happen first (the rootless
+// re-exec).  Flag values can't be told from the target here, so it
+// scans up to any "--"; it returns 125 when the flag is absent or
+// invalid.
+func earlyToolErrorCode(args []string) int {
+	value, ok := earlyFlag(args, "--tool-error-exit-code")
+	if !ok {
+		return 125
+	}
+	if code, err := strconv.Atoi(value); err == nil && code >= 1 && code <= 255 {
+		return code
+	}
+	return 125
+}
+
+// earlyPodmanBinary returns the podman executable to use, from
+// --podman-path, then $PODMAN_DEBUG_PODMAN, before cobra has parsed the
+// flags: the rootless re-exec already runs podman.
+func earlyPodmanBinary(args []string) string {
+	if value, ok := earlyFlag(args, "--podman-path"); ok && value != "" {
+		return value
+	}
+	if value := os.Getenv("PODMAN_DEBUG_PODMAN"); value != "" {
+		return value
+	}
+	return "podman"
+}
+
+// earlyFlag returns the value of the first use of the string flag
+// name in args, given as "name=value" or "name value", scanning up to
+// any "--".
+func earlyFlag(args []string, name string) (string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if value, ok := strings.CutPrefix(arg, name+"="); ok {
+			return value, true
+		}
+		if arg == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// sessionTimezone returns the TZ for the session: --tz if given,
+// otherwise the zone the target's rootfs is configured for, so log
+// timestamps read the same inside and outside the session.
+func sessionTimezone(rootfs string) string {
+	if flagTZ != "" {
+		return flagTZ
+	}
+	return debug.ContainerTimezone(rootfs)
+}
+
+// setupResult passes through the result of a debug session, noting a
+// setup failure so the deferred unmounts honour --no-cleanup-on-error.
+func setupResult(code int, err error) (int, error) {
+	if err != nil && flagNoCleanup {
+		keepMounts = true
+	}
+	return code, err
+}
+
+// unmount releases a podman mount via fn, unless keepMounts is set, in
+// which case it prints the command that releases it later instead.
+func unmount(fn func(string) error, command, name string) {
+	if keepMounts {
+		debug.Log.Print("Left mounted for inspection: %s (release with: %s %s)", name, command, name)
+		return
+	}
+	_ = fn(name)
+}
+
+// sessionOptions builds the debug options shared by every mode from
+// the command-line flags.
+func sessionOptions() *debug.Options {
+	return &debug.Options{
+		NixpkgsRef:       flagNixpkgsRef,
+		HistoryHints:     historyHints(),
+		NoCleanupOnError: flagNoCleanup,
+		KeepSession:      flagKeepSession,
+		MinimalDev:       flagMinimalDev,
+		AllowNewPrivs:    flagNoSeccomp,
+		CgroupLimits:     cgroupLimits,
+		HostPID:          flagHostPID,
+		NoJoinIPC:        flagNoJoinIPC,
+		NoJoinUTS:        flagNoJoinUTS,
+		Env:              sessionEnv,
+		EnvOverride:      flagEnv,
+		Builtins:         enabledBuiltins,
+		Argv:             commandArgv,
+		Timings:          timings,
+		UpperDir:         flagUpperDir,
+		WorkDir:          flagWorkDir,
+		PostInstall:      flagPostInstall,
+		Script:           sessionScript,
+		RCFile:           shellRCFile,
+		Timeout:          flagTimeout,
+		CopyOut:          copyOutDir,
+		CopyOutPaths:     copyOutPaths,
+		HostMounts:       hostMounts,
+		ExtraHosts:       extraHosts,
+		Nameservers:      nameservers,
+		RestrictSys:      flagRestrictSys,
+		LayerDebugImage:  flagLayerDebug,
+		OverlaySize:      flagOverlaySize,
+		NoNetwork:        flagNetwork == "none",
+		Offline:          flagOffline || flagNetwork == "none", // without a network, install can only fail
+	}
+}
+
+// modeOptions fills in the options that depend on the session's mode
+// and the target's entrypoint, noting flags that have no effect there.
+func modeOptions(opts *debug.Options) {
+	mode, ep := opts.Mode, opts.Entrypoint
+	if flagCwd == "auto" {
+		if ep != nil {
+			opts.Cwd = ep.WorkingDir
+		}
+	} else {
+		opts.Cwd = flagCwd
+	}
+	if flagNoPIDNS && mode != debug.ModeLive {
+		debug.Log.Warn("Process isolation is disabled; ps and top show the host's processes, not just the session's.")
+	}
+	if flagNoJoinIPC || flagNoJoinUTS {
+		if mode == debug.ModeLive {
+			var kept []string
+			if flagNoJoinIPC {
+				kept = append(kept, "IPC")
+			}
+			if flagNoJoinUTS {
+				kept = append(kept, "UTS")
+			}
+			noun := "namespace"
+			if len(kept) > 1 {
+				noun = "namespaces"
+			}
+			debug.Log.Warn("The session keeps the host's %s %s; it is less isolated from the host than the container is.", strings.Join(kept, " and "), noun)
+		} else {
+			debug.Log.Note("--no-join-ipc and --no-join-uts have no effect on a stopped container or image; the session already uses the host's.")
+		}
+	}
+	if flagUser != "" {
+		opts.User = flagUser
+	}
+	if flagAsImageUser {
+		if ep == nil || ep.User == "" {
+			debug.Log.Note("No USER configured; --as-image-user runs the session as root.")
+		} else {
+			opts.User = ep.User
+		}
+	}
+}
+
+// printTimings writes the --timings report to stderr, so it never
+// mixes with the session's own output.
+func printTimings() {
+	fmt.Fprintln(os.Stderr)
+	if flagOutput == "json" {
+		_ = timings.WriteJSON(os.Stderr)
+	} else {
+		_ = timings.WriteTable(os.Stderr)
+	}
+}
+
+// hasCommand reports whether the session runs a command rather than an
+// interactive shell.
+func hasCommand() bool {
+	return flagCommand != "" || len(commandArgv) > 0 || sessionScript != nil
+}
+
+// loadScript assembles the --script values into one script, one value
+// per line.  A value starting with @ is replaced by the named file's
+// contents.
+func loadScript(values []string) ([]byte, error) {
+	var script []byte
+	for _, v := range values {
+		if name, ok := strings.CutPrefix(v, "@"); ok {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return nil, err
 			}
+			v = string(data)
+		}
+		script = append(script, v...)
+		if !strings.HasSuffix(v, "\n") {
+			script = append(script, '\n')
 		}
 	}
-	return func() {}
+	return script, nil
+}
+
+// historyHints reports whether the shell history should be seeded with
+// builtin examples.  Hints only make sense for interactive sessions.
+func historyHints() bool {
+	return !flagNoHistoryHints && !hasCommand()
+}
+
+// ttySession reports whether the session gets a terminal: only
+// interactive sessions (no -c command) do.  Raw mode disables output
+// processing (\n -> \r\n translation), which corrupts output from
+// non-interactive commands.
+func ttySession() bool {
+	return flagTTY && flagInteractive && !hasCommand()
+}
+
+// setupTerminal puts the terminal into raw mode for an interactive
+// session and returns the func that restores it.  When that isn't
+// possible the session still runs, with the terminal's line editing
+// and signal keys left on, and a warning says why.
+func setupTerminal() func() {
+	// With --listen the terminal isn't the session's.
+	if !ttySession() || flagListen != "" {
+		return func() {}
+	}
+	fd := int(os.Stdin.Fd())
+	if !xterm.IsTerminal(fd) {
+		return func() {}
+	}
+
+	// Changing the terminal from a background process group stops us
+	// with SIGTTOU, so don't try.
+	if fg, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP); err == nil && fg != unix.Getpgrp() {
+		debug.Log.Warn("podman-debug is in the background of its terminal; not switching it to raw mode.  Run it in the foreground for a fully interactive shell.")
+		return func() {}
+	}
+
+	oldState, err := xterm.MakeRaw(fd)
+	if err != nil {
+		debug.Log.Warn("cannot switch the terminal to raw mode (%v); line editing and Ctrl-C are handled by the local terminal.", err)
+		return func() {}
+	}
+	debug.Log.SetRaw(true)
+	return addCleanup(func() {
+		_ = xterm.Restore(fd, oldState)
+		debug.Log.SetRaw(false)
+	})
 }
 
 func resolveStreams() debug.Streams {
+	stdout, stderr := os.Stdout, os.Stderr
+	if outputFile != nil {
+		stdout = outputFile
+		if flagOutputStderr {
+			stderr = outputFile
+		}
+	}
+	return streamsFor(os.Stdin, stdout, stderr)
+}
+
+// streamsFor builds session streams, dropping stdin unless
+// --interactive is set.
+func streamsFor(stdin, stdout, stderr *os.File) debug.Streams {
 	s := debug.Streams{
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+		Stdout: stdout,
+		Stderr: stderr,
 	}
 	if flagInteractive {
-		s.Stdin = os.Stdin
+		s.Stdin = stdin
 	}
 	return s
 }
 
+// isNotFound reports whether err means the target is not a container,
+// so that it is worth trying as a pod or image.  A failed or ambiguous
+// lookup is reported instead.
 func isNotFound(err error) bool {
-	if err == nil {
-		return false
-	}
-	msg := err.Error()
-	return strings.Contains(msg, "no container with name or ID") ||
-		strings.Contains(msg, "no such container") ||
-		strings.Contains(msg, "inspecting container")
+	return errors.Is(err, podman.ErrContainerNotFound)
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rsturla/podman-debug/pkg/debug"
+	"github.com/rsturla/podman-debug/pkg/podman"
+	xterm "golang.org/x/term"
+)
+
+// canPick reports whether a missing target may be asked for
+// interactively: the picker is enabled and both stdin and stderr, where
+// the menu is drawn, are terminals.
+func canPick() bool {
+	return !flagNoPicker &&
+		xterm.IsTerminal(int(os.Stdin.Fd())) &&
+		xterm.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// pickTarget lists the containers podman knows about on out and reads
+// the number (or name) of the one to debug from in.
+func pickTarget(in io.Reader, out io.Writer) (string, error) {
+	containers, err := podman.ListContainers()
+	if err != nil {
+		return "", err
+	}
+	if len(containers) == 0 {
+		return "", fmt.Errorf("no containers found; pass an image or container to debug")
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tNAME\tSTATE\tIMAGE")
+	for i, c := range containers {
+		fmt.Fprintf(tw, "%d)\t%s\t%s\t%s\n", i+1, c.Name, c.State, c.Image)
+	}
+	_ = tw.Flush()
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprintf(out, "Debug which container? [1-%d] ", len(containers))
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return "", fmt.Errorf("no container selected")
+		}
+		answer := strings.TrimSpace(scanner.Text())
+		if answer == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(answer); err == nil {
+			if n >= 1 && n <= len(containers) {
+				return containers[n-1].Name, nil
+			}
+		} else {
+			for _, c := range containers {
+				if c.Name == answer {
+					return c.Name, nil
+				}
+			}
+		}
+		fmt.Fprintf(out, "No such container: %s\n", answer)
+	}
+}
+
+// selectTarget returns the name of the one container matching selector,
+// label=KEY or label=KEY=VALUE, for --select: a running or paused one
+// unless all is set.  Several matches are listed rather than guessed
+// between.
+func selectTarget(selector string, all bool) (string, error) {
+	label, ok := strings.CutPrefix(selector, "label=")
+	if !ok || label == "" || strings.HasPrefix(label, "=") {
+		return "", fmt.Errorf("invalid --select %q: expected label=KEY or label=KEY=VALUE", selector)
+	}
+	containers, err := podman.FindContainersByLabel(label, all)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case len(containers) == 1:
+		return containers[0].Name, nil
+	case len(containers) > 1:
+		names := make([]string, len(containers))
+		for i, c := range containers {
+			names[i] = fmt.Sprintf("%s (%s)", c.Name, c.State)
+		}
+		return "", fmt.Errorf("--select %s matches several containers: %s; pass one of them as the target instead", selector, strings.Join(names, ", "))
+	case all:
+		return "", fmt.Errorf("no container matches --select %s", selector)
+	}
+	return "", fmt.Errorf("no running or paused container matches --select %s; add --all to include stopped ones", selector)
+}
+
+// latestTarget returns the name of the most recently created container
+// for --last, whatever its state.
+func latestTarget() (string, error) {
+	c, err := podman.LatestContainer()
+	if err != nil {
+		return "", err
+	}
+	if c == nil {
+		return "", fmt.Errorf("--last: there are no containers; pass an image or container to debug")
+	}
+	debug.Log.Note("Debugging %s, the most recently created container (%s).", c.Name, c.State)
+	return c.Name, nil
+}
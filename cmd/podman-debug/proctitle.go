@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// procTitle holds the memory the process's command line is pointed at
+// by setProcTitle.  It is never unmapped.
+var procTitle []byte
+
+// setProcTitle renames the process to "podman-debug[name]", so ps on
+// the host shows which target a session belongs to.  The thread name
+// (ps's COMM column, at most 15 bytes) is always set.  The command line
+// (ps's ARGS column) is replaced only when we may change our own
+// memory map, which requires CAP_SYS_RESOURCE; otherwise it is left
+// alone.  Both are best-effort.
+func setProcTitle(name string) {
+	title := "podman-debug[" + name + "]"
+
+	// /proc/self/comm names the main thread, which is the one ps
+	// reports, whichever thread we happen to be running on.
+	_ = os.WriteFile("/proc/self/comm", []byte(title), 0)
+
+	args := strings.Join(append([]string{title}, os.Args[1:]...), "\x00") + "\x00"
+	buf, err := unix.Mmap(-1, 0, len(args), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return
+	}
+	copy(buf, args)
+
+	// The kernel rejects an argument area whose start lies after its
+	// end.  Fresh mappings sit below the stack, where the original
+	// arguments live, so moving the start first keeps them ordered.
+	start := uintptr(unsafe.Pointer(&buf[0]))
+	if setMM(unix.PR_SET_MM_ARG_START, start) != nil {
+		_ = unix.Munmap(buf)
+		return
+	}
+	_ = setMM(unix.PR_SET_MM_ARG_END, start+uintptr(len(args)))
+	procTitle = buf
+}
+
+func setMM(option int, addr uintptr) error {
+	return unix.Prctl(unix.PR_SET_MM, uintptr(option), addr, 0, 0)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rsturla/podman-debug/pkg/debug"
+	"github.com/rsturla/podman-debug/pkg/podman"
+	"github.com/spf13/cobra"
+)
+
+// shellsReport is the --output json form of the shells command.
+type shellsReport struct {
+	Shells []debug.ShellCandidate `json:"shells"`
+	Auto   string                 `json:"auto"`            // "" if auto finds no shell
+	Error  string                 `json:"error,omitempty"` // why auto finds none
+}
+
+// newShellsCommand returns the "shells" subcommand, which lists the
+// shells a session for a target could use.
+func newShellsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "shells [options] {CONTAINER|IMAGE}",
+		Short: "List the shells available for debugging a container or image",
+		Long: `List the shells found in a container or image and in the debug image's
+nix profile, and the one --shell auto would pick.  The target is mounted
+to look, but no session is started.`,
+		Args:                  cobra.ExactArgs(1),
+		RunE:                  shellsRun,
+		SilenceUsage:          true,
+		SilenceErrors:         true,
+		DisableFlagsInUseLine: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringSliceVar(&flagImage, "image", []string{podman.DefaultDebugImage}, "Debug toolbox image; repeat or comma-separate to list fallbacks tried in order")
+	flags.StringVar(&flagPull, "pull", "missing", `Pull policy for the debug image: "always", "missing", "never"`)
+	flags.StringVar(&flagPlatform, "platform", "", "Pull the debug image for this OS/ARCH[/VARIANT] (default: the host's)")
+	flags.StringVar(&flagOutput, "output", "text", `Output format: "text" or "json"`)
+	flags.StringVar(&flagPodmanPath, "podman-path", "", "podman executable to run (default: $PODMAN_DEBUG_PODMAN, then podman from PATH)")
+	return cmd
+}
+
+func shellsRun(cmd *cobra.Command, args []string) error {
+	nameOrID := args[0]
+	if flagOutput != "text" && flagOutput != "json" {
+		return fmt.Errorf("invalid --output %q: expected text or json", flagOutput)
+	}
+	if flagPlatform != "" {
+		if err := podman.ValidatePlatform(flagPlatform); err != nil {
+			return fmt.Errorf("--platform: %w", err)
+		}
+	}
+	defer handleInterrupts()()
+	if _, err := podman.EnsureAvailable(); err != nil {
+		return err
+	}
+
+	debugImage, nixPath, err := mountDebugImage(flagImage)
+	if err != nil {
+		return err
+	}
+	defer holdMount(podman.UnmountImage, "podman image unmount", debugImage)()
+
+	rootfs, ep, release, err := mountTarget(nameOrID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	report := shellsReport{Shells: debug.ListShells(rootfs, nixPath)}
+	if report.Auto, err = resolveShell(nixPath, rootfs, ep); err != nil {
+		report.Error = err.Error()
+	}
+	if report.Shells == nil {
+		report.Shells = []debug.ShellCandidate{}
+	}
+
+	if flagOutput == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tSOURCE")
+	for _, s := range report.Shells {
+		fmt.Fprintf(tw, "%s\t%s\n", s.Path, s.Source)
+	}
+	_ = tw.Flush()
+	if report.Error != "" {
+		fmt.Printf("\n--shell auto finds no shell: %s\n", report.Error)
+	} else {
+		fmt.Printf("\n--shell auto uses %s\n", report.Auto)
+	}
+	return nil
+}
+
+// mountTarget mounts nameOrID, a container or else a local image, for
+// reading, and returns its root filesystem, its entrypoint metadata
+// (nil if unknown), and a func that unmounts it again.
+func mountTarget(nameOrID string) (string, *podman.EntrypointInfo, func(), error) {
+	if _, err := podman.InspectContainer(nameOrID); err == nil {
+		rootfs, err := podman.MountContainer(nameOrID)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("mounting container %s: %w", nameOrID, err)
+		}
+		ep, _ := containerEntrypoint(nameOrID)
+		return rootfs, ep, holdMount(podman.UnmountContainer, "podman unmount", nameOrID), nil
+	}
+
+	rootfs, err := podman.MountImage(nameOrID)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("no container or local image found for %q: %w", nameOrID, err)
+	}
+	ep, _ := podman.InspectImageEntrypoint(nameOrID)
+	return rootfs, ep, holdMount(podman.UnmountImage, "podman image unmount", nameOrID), nil
+}
@@ -1,14 +1,30 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 
+	"github.com/rsturla/podman-debug/pkg/debug"
+	"github.com/rsturla/podman-debug/pkg/podman"
 	"golang.org/x/sys/unix"
+	xterm "golang.org/x/term"
 )
 
+// exitRootlessSetup is the status podman-debug exits with when, run
+// rootless, podman can't create its user namespace for want of
+// subordinate ID ranges or the tools that map them.  Unlike the
+// --tool-error-exit-code status it means the host needs setting up,
+// not that the target couldn't be debugged.
+const exitRootlessSetup = 123
+
 // reexecViaPodmanUnshare re-execs the current binary under "podman unshare"
 // so that we run inside podman's user namespace with full subordinate
 // UID/GID mappings and CAP_SYS_ADMIN.  This makes podman mount, overlay,
@@ -17,7 +33,7 @@ func reexecViaPodmanUnshare() {
 	self, err := os.Executable()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: cannot determine own executable path: %v\n", err)
-		os.Exit(125)
+		os.Exit(flagToolErrorCode)
 	}
 
 	// Build: podman unshare -- <self> <original args...>
@@ -25,33 +41,142 @@ func reexecViaPodmanUnshare() {
 	// argv[0] must be the program name for the exec'd binary.
 	args := append([]string{"podman", "unshare", "--", self}, os.Args[1:]...)
 
-	podmanBin, err := exec.LookPath("podman")
+	podmanBin, err := exec.LookPath(podman.Binary)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: podman not found in PATH: %v\n", err)
-		os.Exit(125)
+		if podman.Binary != "podman" {
+			fmt.Fprintf(os.Stderr, "Error: podman binary %s: %v\n", podman.Binary, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: podman not found in PATH: %v; install podman (https://podman.io/docs/installation) and try again\n", err)
+		}
+		os.Exit(flagToolErrorCode)
+	}
+
+	// Once exec'd, podman unshare reports a missing rootless setup in
+	// its own terms, with none of ours; try it first to explain that.
+	if err := podman.CheckUnshare(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if errors.Is(err, podman.ErrRootlessSetup) {
+			fmt.Fprintf(os.Stderr, "Hint: rootless podman needs subordinate ID ranges for %s in /etc/subuid and /etc/subgid, and newuidmap and newgidmap (from the shadow-utils or uidmap package); see https://github.com/containers/podman/blob/main/docs/tutorials/rootless_tutorial.md, then run podman system migrate\n", currentUser())
+			os.Exit(exitRootlessSetup)
+		}
+		os.Exit(flagToolErrorCode)
 	}
 
-	env := append(os.Environ(), "_PODMAN_DEBUG_UNSHARED=1")
+	env := unshareEnv()
 
 	// Use exec (replaces the process) to preserve TTY, signals, exit code.
 	if err := syscall.Exec(podmanBin, args, env); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: exec podman unshare: %v\n", err)
-		os.Exit(125)
+		os.Exit(flagToolErrorCode)
+	}
+}
+
+// unshareEnv is the environment the re-exec'd podman-debug starts
+// with: all of this one's, so that CONTAINERS_STORAGE_CONF,
+// CONTAINERS_CONF, XDG_CONFIG_HOME, XDG_DATA_HOME, XDG_RUNTIME_DIR and
+// the rest still pick the same storage for the podman calls made from
+// inside, plus the marker that stops a second re-exec.
+func unshareEnv() []string {
+	env := slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		return strings.HasPrefix(kv, "_PODMAN_DEBUG_UNSHARED=")
+	})
+	return append(env, "_PODMAN_DEBUG_UNSHARED=1")
+}
+
+// currentUser returns the name the /etc/subuid entry needs, or the UID
+// if it has no name.
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
 	}
+	return strconv.Itoa(os.Getuid())
 }
 
 // initProc is the --init-proc handler.  It runs as PID 1 inside a new
 // PID namespace (created by CLONE_NEWPID in the parent).  It mounts a
 // fresh /proc so that ps/top only show processes in this namespace,
-// then execs the shell.
-func initProc(shell string, args []string) {
+// then runs the shell under runInit.  A restricted /proc has only the
+// process directories (subset=pid, Linux 5.8+), hiding the host's
+// /proc/sys, /proc/kcore, and the like; older kernels get the usual
+// /proc.
+func initProc(shell string, args []string, restricted bool) {
 	// Mount a fresh /proc for the new PID namespace.
-	_ = unix.Mount("proc", "/proc", "proc", 0, "")
+	if !restricted || unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "subset=pid") != nil {
+		_ = unix.Mount("proc", "/proc", "proc", 0, "")
+	}
+
+	if err := debug.DropToEnvCred(); err != nil {
+		fmt.Fprintf(os.Stderr, "podman-debug: switching to the session user: %v\n", err)
+		os.Exit(debug.ExitCannotExec)
+	}
+	os.Exit(runInit(shell, args))
+}
+
+// initSignals are the signals init passes on to the shell.
+var initSignals = []os.Signal{unix.SIGHUP, unix.SIGINT, unix.SIGQUIT, unix.SIGTERM, unix.SIGUSR1, unix.SIGUSR2, unix.SIGWINCH}
+
+// runInit runs the shell as init's child and returns the status a
+// shell would report for it.  The shell can't be PID 1 itself: the
+// kernel drops a signal sent to a namespace's init from outside unless
+// it has a handler for it, so SIGTERM from podman-debug's interrupt
+// handling would never reach a plain -c command.  Instead init passes
+// the signals it gets on to the shell, and reaps whatever is orphaned
+// into the namespace until the shell exits.
+//
+// When init leads a process group (started with one, or on a pty of
+// its own), the shell gets a group of its own too, in the pty's
+// foreground, and signals are passed to that whole group.  Otherwise
+// init shares podman-debug's terminal and group, and the shell already
+// gets the terminal's Ctrl-C, Ctrl-\ and resizes from the terminal.
+func runInit(shell string, args []string) int {
+	ownGroup := unix.Getpgrp() == unix.Getpid()
+	attr := &syscall.SysProcAttr{Setpgid: ownGroup}
+	if sid, err := unix.Getsid(0); ownGroup && err == nil && sid == unix.Getpid() && xterm.IsTerminal(0) {
+		attr.Foreground = true
+	}
+
+	sigs := make(chan os.Signal, len(initSignals))
+	signal.Notify(sigs, initSignals...)
+	proc, err := os.StartProcess(shell, append([]string{shell}, args...), &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   attr,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "podman-debug: exec %s: %v\n", shell, err)
+		return debug.ExecFailureCode(err)
+	}
+
+	target := proc.Pid
+	if ownGroup {
+		target = -proc.Pid
+	}
+	go func() {
+		for sig := range sigs {
+			switch sig {
+			case unix.SIGINT, unix.SIGQUIT, unix.SIGWINCH:
+				if !ownGroup {
+					continue
+				}
+			}
+			_ = unix.Kill(target, sig.(unix.Signal))
+		}
+	}()
 
-	// Exec the shell (replaces this process).
-	argv := append([]string{shell}, args...)
-	if err := syscall.Exec(shell, argv, os.Environ()); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: exec %s: %v\n", shell, err)
-		os.Exit(125)
+	for {
+		var ws unix.WaitStatus
+		pid, err := unix.Wait4(-1, &ws, 0, nil)
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "podman-debug: waiting for %s: %v\n", shell, err)
+			return debug.ExitSetupFailed
+		case pid != proc.Pid:
+			continue
+		case ws.Signaled():
+			return 128 + int(ws.Signal())
+		}
+		return ws.ExitStatus()
 	}
 }
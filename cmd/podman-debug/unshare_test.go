@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestUnshareEnv(t *testing.T) {
+	keep := []string{
+		"CONTAINERS_STORAGE_CONF=/etc/storage-test.conf",
+		"CONTAINERS_CONF=/etc/containers-test.conf",
+		"XDG_CONFIG_HOME=/home/test/.config",
+		"XDG_DATA_HOME=/home/test/.local/share",
+		"XDG_RUNTIME_DIR=/run/user/1000",
+	}
+	for _, kv := range keep {
+		name, value, _ := strings.Cut(kv, "=")
+		t.Setenv(name, value)
+	}
+	// Left over from an outer podman-debug; it must not appear twice.
+	t.Setenv("_PODMAN_DEBUG_UNSHARED", "stale")
+
+	env := unshareEnv()
+	for _, kv := range keep {
+		if !slices.Contains(env, kv) {
+			t.Errorf("unshareEnv() lost %s", kv)
+		}
+	}
+	var markers []string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "_PODMAN_DEBUG_UNSHARED=") {
+			markers = append(markers, kv)
+		}
+	}
+	if !slices.Equal(markers, []string{"_PODMAN_DEBUG_UNSHARED=1"}) {
+		t.Errorf("unshareEnv() markers = %q, want exactly _PODMAN_DEBUG_UNSHARED=1", markers)
+	}
+}
+
+// TestInitPassesSIGTERM runs init as snapshot and image sessions do,
+// as PID 1 of a new PID namespace in a group of its own, with a -c
+// command that doesn't trap SIGTERM and that the shell execs, as bash
+// does a lone command.  podman-debug's SIGTERM to the group must end it.
+func TestInitPassesSIGTERM(t *testing.T) {
+	if os.Getenv("PODMAN_DEBUG_TEST_INIT") == "1" {
+		os.Exit(runInit("/bin/sh", []string{"-c", "exec sleep 30"}))
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInitPassesSIGTERM$")
+	cmd.Env = append(os.Environ(), "PODMAN_DEBUG_TEST_INIT=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWPID, Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot create a PID namespace: %v", err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- cmd.Wait() }()
+
+	// Wait for init to start the command, from whichever of its
+	// threads.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && !hasChildren(cmd.Process.Pid); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := unix.Kill(-cmd.Process.Pid, unix.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-waited:
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 128+int(unix.SIGTERM) {
+			t.Errorf("init exited with %v, want status %d", err, 128+int(unix.SIGTERM))
+		}
+	case <-time.After(5 * time.Second):
+		_ = unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+		t.Fatal("SIGTERM did not end the session command")
+	}
+}
+
+// hasChildren reports whether any thread of pid has started a child.
+func hasChildren(pid int) bool {
+	files, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", pid))
+	for _, f := range files {
+		if data, err := os.ReadFile(f); err == nil && len(data) > 0 {
+			return true
+		}
+	}
+	return false
+}
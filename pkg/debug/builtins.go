@@ -5,59 +5,253 @@ package debug
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/rsturla/podman-debug/pkg/podman"
 )
 
 const builtinsDir = "/.podman-debug/bin"
 const metadataDir = "/.podman-debug"
+const historyFile = "/.podman-debug/history"
+
+// builtin is a helper command written into the session.
+type builtin struct {
+	name   string
+	script string
+	help   string // line in the builtins listing
+}
+
+// builtinCommands are the scripts writeBuiltins can install, in the
+// order the builtins command lists them.
+var builtinCommands = []builtin{
+	{"install", installScript, "install <pkg> [pkg...]   Install nix packages or flake refs (https://search.nixos.org/packages)"},
+	{"uninstall", uninstallScript, "uninstall <pkg> [pkg...] Uninstall nix packages"},
+	{"entrypoint", entrypointScript, "entrypoint               Show, lint, or run the container/image entrypoint"},
+	{"mounts", mountsScript, "mounts [--json]          List the container's volumes, bind mounts, and tmpfs mounts"},
+	{"diff", diffScript, "diff                     List files this session added (A), changed (C), or deleted (D)"},
+	{"netinfo", netinfoScript, "netinfo                  Show the session's interfaces, routes, and listening TCP sockets"},
+	{"procs", procsScript, "procs                    List the container's processes with their host PIDs"},
+	{"diagnose", diagnoseScript, "diagnose [--offline]     Snapshot sockets, open files, processes, and disk usage"},
+	{"coredump", coredumpScript, "coredump <pid>           Write a core dump of a running process with gcore"},
+	{"clear", clearScript, "clear                    Clear the terminal screen"},
+	{"builtins", "", "builtins                 Show this help"},
+}
+
+// initBuiltin names the copied podman-debug binary in --builtins.
+const initBuiltin = "init"
+
+// ParseBuiltins parses a --builtins allowlist: a comma-separated list
+// of builtin names (plus "init"), or "all" or "none".  A nil result
+// means all builtins.
+func ParseBuiltins(spec string) (map[string]bool, error) {
+	switch spec {
+	case "", "all":
+		return nil, nil
+	case "none":
+		return map[string]bool{}, nil
+	}
+
+	known := map[string]bool{initBuiltin: true}
+	for _, b := range builtinCommands {
+		known[b.name] = true
+	}
+
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("unknown builtin %q", name)
+		}
+		enabled[name] = true
+	}
+	return enabled, nil
+}
+
+// builtinEnabled reports whether the named builtin should be written.
+func (o *Options) builtinEnabled(name string) bool {
+	return o.Builtins == nil || o.Builtins[name]
+}
 
 // writeBuiltins injects helper scripts into the merged overlay so
 // they are available on PATH inside the debug shell.
-func writeBuiltins(mergedDir string, ep *podman.EntrypointInfo) {
+func writeBuiltins(mergedDir string, opts *Options, self *selfExe) {
 	binDir := mergedDir + builtinsDir
 	if err := os.MkdirAll(binDir, 0755); err != nil {
 		return
 	}
 
-	writeScript(binDir, "install", installScript)
-	writeScript(binDir, "uninstall", uninstallScript)
-	writeScript(binDir, "clear", clearScript)
-	writeScript(binDir, "builtins", builtinsScript)
-	writeScript(binDir, "entrypoint", entrypointScript)
+	for _, b := range builtinCommands {
+		if !opts.builtinEnabled(b.name) {
+			continue
+		}
+		script := b.script
+		if b.name == "builtins" {
+			script = builtinsListing(opts)
+		}
+		writeScript(binDir, b.name, script)
+	}
+
+	// Put our own binary into the overlay as "init" for --init-proc
+	// PID namespace support in snapshot/image mode.  The PID namespace
+	// wrapper can't run without it, so it is installed whenever that
+	// wrapper is used, whatever --builtins says.
+	if opts.builtinEnabled(initBuiltin) || usesPIDNSWrapper(opts) {
+		self.install(filepath.Join(binDir, "init"))
+	}
+
+	writeMode(mergedDir, opts.Mode)
+	if opts.Target != "" {
+		writeTargetName(mergedDir, opts.Target)
+	}
+	if opts.Script != nil {
+		_ = os.WriteFile(mergedDir+ScriptPath, opts.Script, 0755)
+	}
+	if opts.RCFile != nil {
+		// Readable by a --user session too.
+		_ = os.WriteFile(mergedDir+RCFilePath, opts.RCFile, 0644)
+	}
+	if opts.Mounts != nil {
+		writeMountsMetadata(mergedDir, opts.Mounts, opts.NoVolumes && opts.Mode == ModeSnapshot)
+	}
+	if opts.Entrypoint != nil {
+		writeEntrypointMetadata(mergedDir, opts.Entrypoint)
+	}
+	if opts.NixpkgsRef != "" {
+		writeNixpkgsRef(mergedDir, opts.NixpkgsRef)
+	}
+	if opts.Offline {
+		writeOfflineMarker(mergedDir)
+	}
+	if opts.HistoryHints {
+		writeHistoryHints(mergedDir, opts)
+	}
+}
 
-	// Copy our own binary into the overlay as "init" for --init-proc
-	// PID namespace support in snapshot/image mode.
-	copyBinary(binDir, "init")
+// usesPIDNSWrapper reports whether the session shell is started through
+// the init binary (see wrapWithPIDNS).
+func usesPIDNSWrapper(opts *Options) bool {
+	return opts.Mode != ModeLive && !opts.HostPID
+}
 
-	if ep != nil {
-		writeEntrypointMetadata(mergedDir, ep)
+// builtinsListing renders the builtins command, listing only the
+// builtins this session has.
+func builtinsListing(opts *Options) string {
+	var script strings.Builder
+	script.WriteString("#!/nix/var/nix/profiles/default/bin/sh\n")
+	script.WriteString("echo \"podman-debug builtin commands:\"\n")
+	script.WriteString("echo \"\"\n")
+	for _, b := range builtinCommands {
+		if opts.builtinEnabled(b.name) {
+			fmt.Fprintf(&script, "echo \"  %s\"\n", b.help)
+		}
 	}
+	return script.String()
 }
 
-// copyBinary copies the current executable into the overlay directory.
-func copyBinary(dir, name string) {
-	self, err := os.Executable()
-	if err != nil {
-		return
+// historyHints pre-populates the shell history so new users can
+// discover the builtins with the up-arrow.  The most useful command
+// goes last so it is the first one recalled.
+var historyHints = []string{
+	"builtins",
+	"install strace",
+	"entrypoint",
+}
+
+// writeHistoryHints writes the history file that setupEnvironment
+// points HISTFILE at, leaving out hints for builtins not written.
+func writeHistoryHints(mergedDir string, opts *Options) {
+	var hints []string
+	for _, hint := range historyHints {
+		if opts.builtinEnabled(strings.Fields(hint)[0]) {
+			hints = append(hints, hint)
+		}
 	}
-	src, err := os.Open(self)
-	if err != nil {
+	if len(hints) == 0 {
 		return
 	}
-	defer src.Close()
 
-	dst, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	metaDir := mergedDir + metadataDir
+	_ = os.MkdirAll(metaDir, 0755)
+	_ = os.WriteFile(mergedDir+historyFile, []byte(strings.Join(hints, "\n")+"\n"), 0644)
+}
+
+// writeNixpkgsRef records the flake reference the install builtin
+// should resolve plain package names against.
+func writeNixpkgsRef(mergedDir, ref string) {
+	metaDir := mergedDir + metadataDir
+	_ = os.MkdirAll(metaDir, 0755)
+	_ = os.WriteFile(filepath.Join(metaDir, "nixpkgs_ref"), []byte(ref), 0644)
+}
+
+// writeOfflineMarker records that the session has no network access
+// to nix caches, so install refuses up front instead of hanging.
+func writeOfflineMarker(mergedDir string) {
+	metaDir := mergedDir + metadataDir
+	_ = os.MkdirAll(metaDir, 0755)
+	_ = os.WriteFile(filepath.Join(metaDir, "offline"), nil, 0644)
+}
+
+// writeMode records the session mode so builtins can tell whether the
+// target's processes are running.
+func writeMode(mergedDir string, mode Mode) {
+	metaDir := mergedDir + metadataDir
+	_ = os.MkdirAll(metaDir, 0755)
+	_ = os.WriteFile(filepath.Join(metaDir, "mode"), []byte(mode.String()), 0644)
+}
+
+// writeTargetName records the name of the container or image the
+// session is attached to.
+func writeTargetName(mergedDir, name string) {
+	metaDir := mergedDir + metadataDir
+	_ = os.MkdirAll(metaDir, 0755)
+	_ = os.WriteFile(filepath.Join(metaDir, "target"), []byte(name), 0644)
+}
+
+// writeMountsMetadata records the container's configured mounts as
+// JSON and as a pre-rendered table for the mounts builtin, and whether
+// a snapshot session left them unattached.
+func writeMountsMetadata(mergedDir string, mounts []podman.Mount, detached bool) {
+	metaDir := mergedDir + metadataDir
+	_ = os.MkdirAll(metaDir, 0755)
+	if detached {
+		_ = os.WriteFile(filepath.Join(metaDir, "mounts-detached"), nil, 0644)
+	}
+
+	data, err := json.MarshalIndent(mounts, "", "  ")
 	if err != nil {
 		return
 	}
-	defer dst.Close()
+	_ = os.WriteFile(filepath.Join(metaDir, "mounts.json"), data, 0644)
 
-	_, _ = io.Copy(dst, src)
+	var table strings.Builder
+	if len(mounts) == 0 {
+		table.WriteString("(no volumes, bind mounts, or tmpfs mounts configured)\n")
+	} else {
+		tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "TYPE\tSOURCE\tDESTINATION\tMODE")
+		for _, m := range mounts {
+			source := m.Source
+			if m.Name != "" {
+				source = m.Name
+			}
+			if source == "" {
+				source = "-"
+			}
+			mode := "ro"
+			if m.RW {
+				mode = "rw"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Type, source, m.Destination, mode)
+		}
+		tw.Flush()
+	}
+	_ = os.WriteFile(filepath.Join(metaDir, "mounts.txt"), []byte(table.String()), 0644)
 }
 
 func writeScript(dir, name, content string) {
@@ -136,12 +330,20 @@ func formatArgs(args []string) string {
 const installScript = `#!/nix/var/nix/profiles/default/bin/sh
 set -e
 
+FLAKE_PROFILE="/root/.nix-flake-profile"
+NIXPKGS_REF=""
+[ -f /.podman-debug/nixpkgs_ref ] && NIXPKGS_REF=$(cat /.podman-debug/nixpkgs_ref)
+
 if [ $# -eq 0 ]; then
     echo "Usage: install <package> [package...]"
     echo ""
     echo "Install packages from nixpkgs into the debug session."
     echo "Browse available packages at: https://search.nixos.org/packages"
     echo ""
+    echo "Flake references are installed with 'nix profile install':"
+    echo "  install nixpkgs#curl"
+    echo "  install github:owner/repo#pkg"
+    echo ""
     echo "Examples:"
     echo "  install curl"
     echo "  install nmap strace tcpdump"
@@ -150,9 +352,27 @@ if [ $# -eq 0 ]; then
     exit 1
 fi
 
+if [ -f /.podman-debug/offline ]; then
+    echo "offline mode: package installation disabled" >&2
+    exit 1
+fi
+
 for pkg in "$@"; do
-    echo "Installing $pkg..."
-    nix-env -iA "nixpkgs.$pkg"
+    case "$pkg" in
+        *#*|*:*)
+            echo "Installing $pkg (flake)..."
+            nix profile install --profile "$FLAKE_PROFILE" "$pkg"
+            ;;
+        *)
+            if [ -n "$NIXPKGS_REF" ]; then
+                echo "Installing $NIXPKGS_REF#$pkg (flake)..."
+                nix profile install --profile "$FLAKE_PROFILE" "$NIXPKGS_REF#$pkg"
+            else
+                echo "Installing $pkg..."
+                nix-env -iA "nixpkgs.$pkg"
+            fi
+            ;;
+    esac
 done
 `
 
@@ -170,9 +390,20 @@ if [ $# -eq 0 ]; then
     exit 1
 fi
 
+FLAKE_PROFILE="/root/.nix-flake-profile"
+
 for pkg in "$@"; do
     echo "Uninstalling $pkg..."
-    nix-env -e "$pkg"
+    case "$pkg" in
+        *#*|*:*)
+            nix profile remove --profile "$FLAKE_PROFILE" "${pkg##*#}"
+            ;;
+        *)
+            if ! nix-env -e "$pkg" 2>/dev/null && [ -e "$FLAKE_PROFILE" ]; then
+                nix profile remove --profile "$FLAKE_PROFILE" "$pkg"
+            fi
+            ;;
+    esac
 done
 `
 
@@ -180,16 +411,6 @@ const clearScript = `#!/nix/var/nix/profiles/default/bin/sh
 printf '\033[2J\033[H'
 `
 
-const builtinsScript = `#!/nix/var/nix/profiles/default/bin/sh
-echo "podman-debug builtin commands:"
-echo ""
-echo "  install <pkg> [pkg...]   Install nix packages (https://search.nixos.org/packages)"
-echo "  uninstall <pkg> [pkg...] Uninstall nix packages"
-echo "  entrypoint               Show, lint, or run the container/image entrypoint"
-echo "  clear                    Clear the terminal screen"
-echo "  builtins                 Show this help"
-`
-
 const entrypointScript = `#!/nix/var/nix/profiles/default/bin/sh
 META_DIR="/.podman-debug"
 EP_JSON="$META_DIR/entrypoint.json"
@@ -298,3 +519,300 @@ case "${1:-}" in
         ;;
 esac
 `
+
+const diagnoseScript = `#!/nix/var/nix/profiles/default/bin/sh
+OFFLINE=false
+[ -f /.podman-debug/offline ] && OFFLINE=true
+MODE=""
+[ -f /.podman-debug/mode ] && MODE=$(cat /.podman-debug/mode)
+
+case "${1:-}" in
+    --offline)
+        OFFLINE=true
+        ;;
+    --help|-h)
+        echo "Usage: diagnose [--offline]"
+        echo ""
+        echo "Print a one-shot snapshot of listening sockets, the main process's"
+        echo "open files, the process tree, and disk usage.  Missing tools are"
+        echo "installed on demand; with --offline only tools already present are used."
+        exit 0
+        ;;
+    "")
+        ;;
+    *)
+        echo "Error: unknown option '$1'"
+        echo "Usage: diagnose [--offline]"
+        exit 1
+        ;;
+esac
+
+# need <command> <package>: make sure command is available, installing
+# package if allowed.  Each section is skipped on its own if its tool
+# can't be had, so one failed install doesn't stop the report.
+need() {
+    command -v "$1" >/dev/null 2>&1 && return 0
+    if [ "$OFFLINE" = true ]; then
+        echo "(skipped: $1 is not installed; try 'install $2')"
+        return 1
+    fi
+    echo "(installing $2 for $1...)"
+    if install "$2" >/dev/null 2>&1 && command -v "$1" >/dev/null 2>&1; then
+        return 0
+    fi
+    echo "(skipped: could not install $2)"
+    return 1
+}
+
+section() {
+    echo ""
+    echo "== $1 =="
+}
+
+section "Listening sockets"
+need ss iproute2 && ss -tulpn
+
+section "Open files of the main process (PID 1)"
+if [ "$MODE" = live ]; then
+    need lsof lsof && lsof -p 1
+else
+    echo "(the target is not running; no main process to inspect)"
+fi
+
+section "Process tree"
+need ps procps && ps -ef --forest
+
+section "Disk usage"
+need df coreutils && df -h
+`
+
+const netinfoScript = `#!/nix/var/nix/profiles/default/bin/sh
+case "${1:-}" in
+    --help|-h)
+        echo "Usage: netinfo"
+        echo ""
+        echo "Show the interfaces, routes, and listening TCP sockets of the session's"
+        echo "network namespace: the container's in a live session.  Uses ip and ss"
+        echo "from iproute2, skipping what isn't installed."
+        exit 0
+        ;;
+    "")
+        ;;
+    *)
+        echo "Error: unknown option '$1'"
+        echo "Usage: netinfo"
+        exit 1
+        ;;
+esac
+
+section() {
+    echo ""
+    echo "== $1 =="
+}
+
+# run <command> [args...]: run a tool if it is installed, otherwise say
+# how to get it.
+run() {
+    if ! command -v "$1" >/dev/null 2>&1; then
+        echo "(skipped: $1 is not installed; try 'install iproute2')"
+        return 1
+    fi
+    "$@"
+}
+
+section "Interfaces"
+run ip addr
+
+section "Routes"
+run ip route
+
+section "Listening TCP sockets"
+run ss -tlnp
+`
+
+const procsScript = `#!/nix/var/nix/profiles/default/bin/sh
+META_DIR="/.podman-debug"
+MODE=""
+[ -f "$META_DIR/mode" ] && MODE=$(cat "$META_DIR/mode")
+
+case "${1:-}" in
+    --help|-h)
+        echo "Usage: procs"
+        echo ""
+        echo "List the container's processes with their PIDs in the container and on the"
+        echo "host, for host tools such as perf or nsenter.  Host PIDs are recorded when"
+        echo "the session starts; processes started since show '-'."
+        exit 0
+        ;;
+    "")
+        ;;
+    *)
+        echo "Error: unknown option '$1'"
+        echo "Usage: procs"
+        exit 1
+        ;;
+esac
+
+if [ "$MODE" != live ]; then
+    echo "Error: the target is not running; its processes have no host PIDs."
+    exit 1
+fi
+if [ ! -f "$META_DIR/procs" ]; then
+    echo "Error: no process metadata found."
+    exit 1
+fi
+
+printf '%-8s %-8s %s\n' PID HOST_PID COMMAND
+for dir in /proc/[0-9]*; do
+    pid=${dir#/proc/}
+    [ -r "$dir/status" ] || continue
+    host=-
+    while read -r cpid hpid; do
+        if [ "$cpid" = "$pid" ]; then
+            host=$hpid
+            break
+        fi
+    done < "$META_DIR/procs"
+    cmd=$(tr '\0' ' ' < "$dir/cmdline" 2>/dev/null)
+    cmd=${cmd% }
+    [ -n "$cmd" ] || cmd="[$(cat "$dir/comm" 2>/dev/null)]"
+    printf '%-8s %-8s %s\n' "$pid" "$host" "$cmd"
+done | sort -n
+`
+
+const coredumpScript = `#!/nix/var/nix/profiles/default/bin/sh
+META_DIR="/.podman-debug"
+OUT_DIR="$META_DIR/out"
+MODE=""
+[ -f "$META_DIR/mode" ] && MODE=$(cat "$META_DIR/mode")
+
+case "${1:-}" in
+    ""|--help|-h)
+        echo "Usage: coredump <pid>"
+        echo ""
+        echo "Write a core dump of a running process with gcore, without stopping it"
+        echo "for longer than the dump takes.  gdb is installed on demand.  With"
+        echo "--copy-out the dump is written to that host directory; otherwise it stays"
+        echo "in /tmp and is lost when the session ends."
+        [ -n "${1:-}" ] && exit 0
+        exit 1
+        ;;
+esac
+PID="$1"
+
+if [ "$MODE" != live ]; then
+    echo "Error: the target is not running; there are no processes to dump."
+    exit 1
+fi
+if [ ! -d "/proc/$PID" ]; then
+    echo "Error: no process with PID $PID (see 'ps -ef')."
+    exit 1
+fi
+
+if [ -f "$META_DIR/copy-out" ]; then
+    DEST="$OUT_DIR"
+    HOST_DEST=$(cat "$META_DIR/copy-out")
+else
+    DEST="/tmp"
+    HOST_DEST=""
+    echo "Warning: no --copy-out directory; the dump is lost when the session ends."
+fi
+
+if ! command -v gcore >/dev/null 2>&1; then
+    echo "Installing gdb for gcore..."
+    install gdb >/dev/null || exit 1
+fi
+
+# A core is about as big as the process's resident memory.  Refuse
+# rather than fill the disk the dump goes to.
+RSS_KB=""
+while read -r key value _; do
+    [ "$key" = "VmRSS:" ] && RSS_KB="$value"
+done < "/proc/$PID/status"
+AVAIL_KB=$(df -Pk "$DEST" | tail -n 1 | { read -r _ _ _ avail _; echo "$avail"; })
+if [ -n "$RSS_KB" ] && [ -n "$AVAIL_KB" ] && [ "$RSS_KB" -gt "$AVAIL_KB" ]; then
+    echo "Error: process $PID uses about $((RSS_KB / 1024)) MiB but only $((AVAIL_KB / 1024)) MiB is free in $DEST."
+    exit 1
+fi
+
+gcore -o "$DEST/core" "$PID" >/dev/null || exit 1
+echo "Wrote $DEST/core.$PID"
+[ -n "$HOST_DEST" ] && echo "On the host: $HOST_DEST/core.$PID"
+exit 0
+`
+
+const mountsScript = `#!/nix/var/nix/profiles/default/bin/sh
+META_DIR="/.podman-debug"
+MODE=""
+[ -f "$META_DIR/mode" ] && MODE=$(cat "$META_DIR/mode")
+
+if [ "$MODE" = image ]; then
+    echo "This session is debugging an image, which has no runtime mounts."
+    echo "Volumes and bind mounts are only attached when a container runs."
+    exit 0
+fi
+
+if [ ! -f "$META_DIR/mounts.txt" ]; then
+    echo "Error: no mount metadata found."
+    exit 1
+fi
+
+case "${1:-}" in
+    --json)
+        cat "$META_DIR/mounts.json"
+        ;;
+    "")
+        cat "$META_DIR/mounts.txt"
+        if [ "$MODE" = snapshot ] && [ -f "$META_DIR/mounts-detached" ]; then
+            echo ""
+            echo "Note: the container is not running, and --mount-volumes=false left these"
+            echo "mounts unattached; their destinations show the image's own files."
+        elif [ "$MODE" = snapshot ]; then
+            echo ""
+            echo "Note: the container is not running.  Volumes and bind mounts are attached"
+            echo "from their host source (read-only unless --writable); tmpfs mounts start empty."
+        fi
+        ;;
+    *)
+        echo "Error: unknown option '$1'"
+        echo "Usage: mounts [--json]"
+        exit 1
+        ;;
+esac
+`
+
+const diffScript = `#!/nix/var/nix/profiles/default/bin/sh
+# Lists the session overlay's upper directory against the target's own
+# root, like podman diff.  A deletion is an overlayfs whiteout: a 0:0
+# character device.
+UPPER="/.podman-debug/upper"
+LOWER="/.podman-debug/lower"
+
+if [ $# -gt 0 ]; then
+    echo "Usage: diff"
+    exit 1
+fi
+
+if [ ! -d "$UPPER" ] || [ ! -d "$LOWER" ]; then
+    echo "Error: the session's overlay is not visible; see the warning printed when the session started."
+    echo "(A --writable session has no overlay: its changes go straight to the container.)"
+    exit 1
+fi
+
+cd "$UPPER" || exit 1
+find . -mindepth 1 \( -path ./.podman-debug -o -path ./nix -o -path ./etc/nix/nix.conf \) -prune -o -print |
+while IFS= read -r entry; do
+    path="${entry#.}"
+    # podman-debug's own nix.conf may have needed a new /etc/nix.
+    if [ "$path" = /etc/nix ] && [ ! -e "$LOWER/etc/nix" ] && [ "$(ls -A "$entry")" = nix.conf ]; then
+        continue
+    fi
+    if [ -c "$entry" ] && [ "$(stat -c %t:%T "$entry")" = 0:0 ]; then
+        echo "D $path"
+    elif [ -e "$LOWER$path" ] || [ -L "$LOWER$path" ]; then
+        echo "C $path"
+    else
+        echo "A $path"
+    fi
+done
+`
@@ -0,0 +1,114 @@
+//go:build linux
+
+package debug
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseBuiltins(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[string]bool // nil for all
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "all", want: nil},
+		{spec: "none", want: map[string]bool{}},
+		{spec: "install", want: map[string]bool{"install": true}},
+		{spec: " install , entrypoint ,", want: map[string]bool{"install": true, "entrypoint": true}},
+		{spec: "init", want: map[string]bool{"init": true}},
+		{spec: "install,no-such-builtin", wantErr: true},
+		{spec: "ALL", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseBuiltins(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseBuiltins(%q) = %v, want an error", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseBuiltins(%q): %v", tt.spec, err)
+			}
+			if (got == nil) != (tt.want == nil) || len(got) != len(tt.want) {
+				t.Fatalf("ParseBuiltins(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+			for name := range tt.want {
+				if !got[name] {
+					t.Errorf("ParseBuiltins(%q) = %v, missing %s", tt.spec, got, name)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteBuiltins(t *testing.T) {
+	var all []string
+	for _, b := range builtinCommands {
+		all = append(all, b.name)
+	}
+
+	tests := []struct {
+		name     string
+		spec     string
+		mode     Mode
+		hostPID  bool
+		want     []string // written to builtinsDir; anything else must be absent
+		wantInit bool
+	}{
+		{name: "all", spec: "all", mode: ModeLive, want: all, wantInit: true},
+		{name: "none live", spec: "none", mode: ModeLive, want: nil, wantInit: false},
+		{name: "some", spec: "install,entrypoint", mode: ModeLive, want: []string{"install", "entrypoint"}},
+		{name: "init only", spec: "init", mode: ModeLive, want: nil, wantInit: true},
+		// The PID namespace wrapper runs init, whatever --builtins says.
+		{name: "none snapshot", spec: "none", mode: ModeSnapshot, want: nil, wantInit: true},
+		{name: "no init snapshot", spec: "install", mode: ModeImage, want: []string{"install"}, wantInit: true},
+		{name: "no init host pid", spec: "install", mode: ModeSnapshot, hostPID: true, want: []string{"install"}, wantInit: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builtins, err := ParseBuiltins(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mergedDir := t.TempDir()
+			opts := &Options{Mode: tt.mode, HostPID: tt.hostPID, Builtins: builtins}
+			writeBuiltins(mergedDir, opts, testSelfExe(t))
+
+			want := map[string]bool{}
+			for _, name := range tt.want {
+				want[name] = true
+			}
+			binDir := mergedDir + builtinsDir
+			for _, name := range all {
+				_, err := os.Stat(filepath.Join(binDir, name))
+				if present := err == nil; present != want[name] {
+					t.Errorf("--builtins %s: %s present = %v, want %v", tt.spec, name, present, want[name])
+				}
+			}
+			if _, err := os.Stat(filepath.Join(binDir, initBuiltin)); (err == nil) != tt.wantInit {
+				t.Errorf("--builtins %s: init present = %v, want %v", tt.spec, err == nil, tt.wantInit)
+			}
+		})
+	}
+}
+
+// testSelfExe returns a selfExe that installs a small stand-in file by
+// copying, so tests need no mount privileges.
+func testSelfExe(t *testing.T) *selfExe {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := f.WriteString("#!/bin/sh\n"); err != nil {
+		t.Fatal(err)
+	}
+	return &selfExe{treeFD: -1, file: f}
+}
@@ -0,0 +1,305 @@
+//go:build linux
+
+package debug
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupLimitKeys maps --cgroup-limit keys to cgroup v2 files.
+var cgroupLimitKeys = map[string]string{
+	"memory": "memory.max",
+	"pids":   "pids.max",
+	"cpu":    "cpu.max",
+}
+
+// cpuPeriod is the cpu.max period used for fractional CPU limits.
+const cpuPeriod = 100000
+
+// ParseCgroupLimits parses a --cgroup-limit spec such as
+// "memory=512M,pids=256,cpu=1.5".  memory takes a byte count with an
+// optional K/M/G/T suffix, pids a process count, and cpu a number of
+// CPUs.
+func ParseCgroupLimits(spec string) (CgroupLimits, error) {
+	limits := CgroupLimits{}
+	for _, item := range strings.Split(spec, ",") {
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		file, known := cgroupLimitKeys[key]
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid cgroup limit %q: expected memory=SIZE, pids=N, or cpu=CPUS", item)
+		}
+
+		switch key {
+		case "memory":
+			if !validSize(value) {
+				return nil, fmt.Errorf("invalid memory limit %q: expected bytes with optional K/M/G/T suffix", value)
+			}
+		case "pids":
+			if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid pids limit %q: expected a positive integer", value)
+			}
+		case "cpu":
+			cpus, err := strconv.ParseFloat(value, 64)
+			if err != nil || cpus <= 0 {
+				return nil, fmt.Errorf("invalid cpu limit %q: expected a positive number of CPUs", value)
+			}
+			value = fmt.Sprintf("%d %d", int(cpus*cpuPeriod), cpuPeriod)
+		}
+		limits[file] = value
+	}
+	return limits, nil
+}
+
+// validSize reports whether s is a byte count with an optional
+// single-letter binary suffix, as accepted by memory.max.
+func validSize(s string) bool {
+	s = strings.ToUpper(s)
+	for _, unit := range []string{"K", "M", "G", "T"} {
+		if n, ok := strings.CutSuffix(s, unit); ok {
+			s = n
+			break
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	return err == nil && n > 0
+}
+
+// sessionCgroup is a transient cgroup the debug shell is started in.
+type sessionCgroup struct {
+	fd       int // the cgroup directory, for CLONE_INTO_CGROUP
+	parentFD int // its parent, so it can be removed after chroot
+	name     string
+	enabled  []string // controllers we enabled for the parent's children
+}
+
+// sessionCgroupPrefix starts the name of every session cgroup.
+const sessionCgroupPrefix = "podman-debug-"
+
+// createSessionCgroup creates a cgroup v2 child with the given limits
+// for the debug shell.  It walks up from podman-debug's own cgroup to
+// the first ancestor where we are allowed to create a child with the
+// needed controllers and move processes into it — normally a
+// systemd-delegated subtree, or anywhere when running as real root.
+// It must run before any namespace or chroot change so /sys/fs/cgroup
+// is the host's.
+func createSessionCgroup(limits CgroupLimits) (*sessionCgroup, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &st); err != nil || st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+
+	own, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+
+	var controllers []string
+	for file := range limits {
+		controllers = append(controllers, strings.SplitN(file, ".", 2)[0])
+	}
+
+	name := fmt.Sprintf("%s%d", sessionCgroupPrefix, os.Getpid())
+	for dir := own; ; dir = filepath.Dir(dir) {
+		parent := filepath.Join(cgroupRoot, dir)
+		if cg, err := createCgroupIn(parent, name, controllers, limits); err == nil {
+			return cg, nil
+		}
+		if dir == "/" {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no delegated cgroup with the %s controller(s) is available", strings.Join(controllers, ", "))
+}
+
+// createCgroupIn tries to create the session cgroup as parent/name.
+func createCgroupIn(parent, name string, controllers []string, limits CgroupLimits) (*sessionCgroup, error) {
+	// Moving the shell in needs write access to cgroup.procs of the
+	// common ancestor of our cgroup and the new one, i.e. parent.
+	if err := unix.Access(filepath.Join(parent, "cgroup.procs"), unix.W_OK); err != nil {
+		return nil, err
+	}
+	parentFD, err := unix.Open(parent, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := enableControllers(parentFD, controllers)
+	if err != nil {
+		unix.Close(parentFD)
+		return nil, err
+	}
+
+	dir := filepath.Join(parent, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		restoreControllers(parentFD, enabled)
+		unix.Close(parentFD)
+		return nil, err
+	}
+	cg := &sessionCgroup{fd: -1, parentFD: parentFD, name: name, enabled: enabled}
+	for file, value := range limits {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+			cg.Close()
+			return nil, fmt.Errorf("setting %s: %w", file, err)
+		}
+	}
+
+	if cg.fd, err = unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0); err != nil {
+		cg.Close()
+		return nil, err
+	}
+	return cg, nil
+}
+
+// enableControllers makes sure every controller is enabled for the
+// children of the cgroup dirFD refers to, enabling missing ones where
+// permitted, and returns the ones it enabled.  If it can't enable them
+// all, it disables those it did again.
+func enableControllers(dirFD int, controllers []string) ([]string, error) {
+	var enabled []string
+	for _, c := range controllers {
+		if hasController(dirFD, "cgroup.subtree_control", c) {
+			continue
+		}
+		if err := writeCgroupFile(dirFD, "cgroup.subtree_control", "+"+c); err != nil {
+			restoreControllers(dirFD, enabled)
+			return nil, err
+		}
+		enabled = append(enabled, c)
+	}
+	return enabled, nil
+}
+
+// restoreControllers disables again the controllers enableControllers
+// enabled for the children of dirFD, unless another session's cgroup,
+// which may be using them, is still there.
+func restoreControllers(dirFD int, enabled []string) {
+	if len(enabled) == 0 || hasSessionCgroup(dirFD) {
+		return
+	}
+	for _, c := range slices.Backward(enabled) {
+		_ = writeCgroupFile(dirFD, "cgroup.subtree_control", "-"+c)
+	}
+}
+
+// hasSessionCgroup reports whether the cgroup dirFD refers to has a
+// session cgroup among its children.
+func hasSessionCgroup(dirFD int) bool {
+	fd, err := unix.Openat(dirFD, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	dir := os.NewFile(uintptr(fd), "cgroup")
+	defer dir.Close()
+	names, _ := dir.Readdirnames(-1)
+	return slices.ContainsFunc(names, func(name string) bool {
+		return strings.HasPrefix(name, sessionCgroupPrefix)
+	})
+}
+
+// writeCgroupFile writes value to the file name in the cgroup dirFD
+// refers to.  Working from the descriptor, it still works after the
+// session has chrooted.
+func writeCgroupFile(dirFD int, name, value string) error {
+	fd, err := unix.Openat(dirFD, name, unix.O_WRONLY|unix.O_TRUNC|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	_, err = unix.Write(fd, []byte(value))
+	return err
+}
+
+// hasController reports whether the controllers file name in the
+// cgroup dirFD refers to lists c.
+func hasController(dirFD int, name, c string) bool {
+	fd, err := unix.Openat(dirFD, name, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return false
+	}
+	for _, f := range strings.Fields(string(data)) {
+		if f == c {
+			return true
+		}
+	}
+	return false
+}
+
+// ownCgroup returns podman-debug's cgroup v2 path from /proc/self/cgroup.
+func ownCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 entry in /proc/self/cgroup")
+}
+
+// apply starts cmd directly inside the cgroup.
+func (c *sessionCgroup) apply(cmd *exec.Cmd) {
+	if c == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = c.fd
+}
+
+// Close removes the cgroup and disables the controllers enabled for
+// it.  Removal fails harmlessly if the shell left background processes
+// behind, and the controllers then stay enabled.
+func (c *sessionCgroup) Close() {
+	if c == nil {
+		return
+	}
+	if c.fd >= 0 {
+		unix.Close(c.fd)
+	}
+	if err := unix.Unlinkat(c.parentFD, c.name, unix.AT_REMOVEDIR); err == nil {
+		restoreControllers(c.parentFD, c.enabled)
+	}
+	unix.Close(c.parentFD)
+}
+
+// newSessionCgroup creates the session cgroup if limits were requested,
+// warning and carrying on without limits if that is not possible.
+func newSessionCgroup(limits CgroupLimits) *sessionCgroup {
+	if len(limits) == 0 {
+		return nil
+	}
+	cg, err := createSessionCgroup(limits)
+	if err != nil {
+		Log.Warn("--cgroup-limit: %v; continuing without resource limits.", err)
+		return nil
+	}
+	return cg
+}
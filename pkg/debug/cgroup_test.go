@@ -0,0 +1,91 @@
+//go:build linux
+
+package debug
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestValidSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want bool
+	}{
+		{"536870912", true},
+		{"512M", true},
+		{"512m", true},
+		{"1G", true},
+		{"2T", true},
+		{"512MM", false},
+		{"1GK", false},
+		{"M", false},
+		{"0", false},
+		{"0K", false},
+		{"1.5G", false},
+		{"-1", false},
+		{"1P", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validSize(tt.size); got != tt.want {
+			t.Errorf("validSize(%q) = %v, want %v", tt.size, got, tt.want)
+		}
+	}
+}
+
+// TestRestoreControllers checks the bookkeeping of enableControllers
+// and restoreControllers on a directory standing in for a cgroup,
+// where writing cgroup.subtree_control just replaces its contents.
+func TestRestoreControllers(t *testing.T) {
+	dir := t.TempDir()
+	control := filepath.Join(dir, "cgroup.subtree_control")
+	if err := os.WriteFile(control, []byte("cpu pids\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	read := func() string {
+		data, err := os.ReadFile(control)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	enabled, err := enableControllers(fd, []string{"cpu", "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(enabled, []string{"memory"}) {
+		t.Errorf("enableControllers enabled %q, want only memory", enabled)
+	}
+	if got := read(); got != "+memory" {
+		t.Errorf("cgroup.subtree_control = %q, want +memory", got)
+	}
+
+	// Another session's cgroup may be using the controller.
+	other := filepath.Join(dir, sessionCgroupPrefix+"1")
+	if err := os.Mkdir(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+	restoreControllers(fd, enabled)
+	if got := read(); got != "+memory" {
+		t.Errorf("with another session's cgroup, cgroup.subtree_control = %q, want +memory left alone", got)
+	}
+
+	if err := os.Remove(other); err != nil {
+		t.Fatal(err)
+	}
+	restoreControllers(fd, enabled)
+	if got := read(); got != "-memory" {
+		t.Errorf("cgroup.subtree_control = %q, want -memory", got)
+	}
+}
@@ -0,0 +1,331 @@
+//go:build linux
+
+package debug
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// OCI layer whiteout markers.  Overlayfs represents deletions as 0:0
+// character devices and opaque directories as an xattr; in a tar layer
+// they become these specially named empty files.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// changesExcluded are upper-dir paths podman-debug itself creates, which
+// must not end up in exported changes.
+var changesExcluded = map[string]bool{
+	".podman-debug":    true,
+	"nix":              true,
+	"etc/nix/nix.conf": true,
+}
+
+// exportChanges writes the overlay upper directory referenced by
+// upperFD to w.  The session thread is chrooted into the merged view
+// by the time the shell exits, so the upper dir is only reachable
+// through the fd; changing into it escapes the chroot for this thread,
+// which is about to exit anyway.
+func exportChanges(upperFD int, w io.Writer) error {
+	if err := unix.Fchdir(upperFD); err != nil {
+		return fmt.Errorf("entering overlay upper dir: %w", err)
+	}
+	return writeChanges(w)
+}
+
+// writeChanges writes the overlay upper directory, which must be the
+// current working directory, to w as an OCI-style layer tarball.
+func writeChanges(w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+		if changesExcluded[path] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if isWhiteout(info) {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(filepath.Dir(path), whiteoutPrefix+filepath.Base(path)),
+				Mode:     0644,
+			})
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if isOpaque(path) {
+				return tw.WriteHeader(&tar.Header{
+					Typeflag: tar.TypeReg,
+					Name:     filepath.Join(path, whiteoutOpaque),
+					Mode:     0644,
+				})
+			}
+			return nil
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// preserveChanges copies the overlay upper directory referenced by
+// upperFD into root, laid out like an exported layer: deletions and
+// opaque directories become .wh. marker files.  Like exportChanges it
+// changes into the upper dir.  It returns the number of entries
+// copied and an error for every entry that could not be.
+func preserveChanges(upperFD int, root *os.Root) (int, []error) {
+	if err := unix.Fchdir(upperFD); err != nil {
+		return 0, []error{fmt.Errorf("entering overlay upper dir: %w", err)}
+	}
+
+	files, errs := 0, []error(nil)
+	err := filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		if path == "." {
+			return nil
+		}
+		if changesExcluded[path] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		switch {
+		case isWhiteout(info):
+			err = writeMarker(root, filepath.Join(filepath.Dir(path), whiteoutPrefix+filepath.Base(path)))
+		case info.IsDir():
+			err = root.Mkdir(path, info.Mode().Perm()|0700)
+			if err == nil && isOpaque(path) {
+				err = writeMarker(root, filepath.Join(path, whiteoutOpaque))
+			}
+			if err != nil {
+				// Nothing beneath it can be copied either.
+				errs = append(errs, err)
+				return filepath.SkipDir
+			}
+			return nil
+		default:
+			n, copyErrs := copyTree(root, path, path)
+			files += n
+			errs = append(errs, copyErrs...)
+			return nil
+		}
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			files++
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return files, errs
+}
+
+// preserveOverlay copies the session's changes into root with
+// preserveChanges and reports where they went.  Failures are
+// warnings: the session itself has already finished.
+func preserveOverlay(upperFD int, root *os.Root) {
+	files, errs := preserveChanges(upperFD, root)
+	for _, err := range errs {
+		Log.Warn("preserving overlay changes: %v", err)
+	}
+	noun := "entries"
+	if files == 1 {
+		noun = "entry"
+	}
+	Log.Print("Preserved overlay changes: %s (%d %s)", root.Name(), files, noun)
+}
+
+func writeMarker(root *os.Root, name string) error {
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// isWhiteout reports whether info is an overlayfs whiteout (a 0:0
+// character device).
+func isWhiteout(info fs.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// isOpaque reports whether dir is an overlayfs opaque directory.
+// Rootless overlays use the user.* xattr namespace.
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		if n, err := unix.Lgetxattr(dir, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyChanges extracts a changes tarball written by a debug session
+// onto the root filesystem at root, honouring whiteouts.  Paths are
+// resolved inside root so symlinks in the target cannot redirect
+// writes onto the host.
+func ApplyChanges(r io.Reader, root string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading changes: %w", err)
+		}
+
+		name := filepath.Clean("/" + hdr.Name)
+		// Directories always precede their contents in the tarball,
+		// so the parent must already exist.
+		parent, err := resolveInRoot(root, filepath.Dir(name))
+		if err != nil {
+			return fmt.Errorf("applying %s: %w", name, err)
+		}
+		base := filepath.Base(name)
+		target := filepath.Join(parent, base)
+
+		if base == whiteoutOpaque {
+			entries, err := os.ReadDir(parent)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if err := os.RemoveAll(filepath.Join(parent, e.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			if err := os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := applyEntry(tr, hdr, target); err != nil {
+			return fmt.Errorf("applying %s: %w", name, err)
+		}
+	}
+}
+
+// applyEntry creates a single tar entry at target, replacing whatever
+// was there unless both are directories.
+func applyEntry(tr *tar.Reader, hdr *tar.Header, target string) error {
+	mode := hdr.FileInfo().Mode()
+
+	if existing, err := os.Lstat(target); err == nil {
+		if !(existing.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, mode.Perm()); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(target, uint32(mode.Perm())); err != nil {
+			return err
+		}
+	default:
+		// Device nodes cannot be created without privileges we may
+		// not have; skip them rather than failing the whole commit.
+		return nil
+	}
+
+	_ = os.Lchown(target, hdr.Uid, hdr.Gid)
+	if hdr.Typeflag != tar.TypeSymlink {
+		_ = os.Chmod(target, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package debug
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions lists the formats accepted by NewCompressor.
+var Compressions = []string{"gzip", "zstd", "none"}
+
+// CompressionExt returns the file extension for a tarball compressed
+// with format.
+func CompressionExt(format string) string {
+	switch format {
+	case "gzip":
+		return ".tar.gz"
+	case "zstd":
+		return ".tar.zst"
+	default:
+		return ".tar"
+	}
+}
+
+// NewCompressor wraps w so that data written to it is compressed with
+// format as it streams through; nothing is buffered beyond the
+// compressor's window.  Close flushes the compressor but does not
+// close w.
+func NewCompressor(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "none":
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q: expected %s", format, strings.Join(Compressions, ", "))
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
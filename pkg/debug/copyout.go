@@ -0,0 +1,172 @@
+//go:build linux
+
+package debug
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyOutDir is where the --copy-out host directory appears inside the
+// session.  Files written there land on the host directly.
+const copyOutDir = "/.podman-debug/out"
+
+// openCopyOut clones a bind mount of the host directory dir, to be
+// attached inside the session once the host path is out of reach.
+// Returns -1 when no directory is configured.
+func openCopyOut(dir string) (int, error) {
+	if dir == "" {
+		return -1, nil
+	}
+	fd, err := unix.OpenTree(unix.AT_FDCWD, dir, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC)
+	if err != nil {
+		return -1, fmt.Errorf("open_tree(%s): %w", dir, err)
+	}
+	return fd, nil
+}
+
+// mountCopyOut attaches the cloned copy-out directory at copyOutDir in
+// the merged filesystem and records its host path for builtins that
+// write there.  A treeFD of -1 removes any stale record instead.
+func mountCopyOut(treeFD int, mergedDir, hostDir string) error {
+	record := filepath.Join(mergedDir+metadataDir, "copy-out")
+	if treeFD < 0 {
+		_ = os.Remove(record)
+		return nil
+	}
+
+	target := mergedDir + copyOutDir
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("creating %s: %w", copyOutDir, err)
+	}
+	if err := unix.MoveMount(treeFD, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("attaching copy-out directory %s: %w", hostDir, err)
+	}
+	_ = os.WriteFile(record, []byte(hostDir), 0644)
+	return nil
+}
+
+// copyOutTarget is the host side of a CopyOutPath, opened while host
+// paths are still reachable.
+type copyOutTarget struct {
+	CopyOutPath
+	root *os.Root // the destination's parent, or the destination directory itself
+	name string   // the name the copy gets under root
+}
+
+// openCopyOutPaths opens the host destination of each path.  Callers
+// close the returned targets with closeCopyOutPaths.
+func openCopyOutPaths(paths []CopyOutPath) ([]copyOutTarget, error) {
+	var targets []copyOutTarget
+	for _, p := range paths {
+		t := copyOutTarget{CopyOutPath: p}
+		dir, name := filepath.Dir(p.Dest), filepath.Base(p.Dest)
+		if fi, err := os.Stat(p.Dest); err == nil && fi.IsDir() {
+			dir, name = p.Dest, filepath.Base(p.Src)
+		}
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			closeCopyOutPaths(targets)
+			return nil, fmt.Errorf("--copy-out destination: %w", err)
+		}
+		t.root, t.name = root, name
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+func closeCopyOutPaths(targets []copyOutTarget) {
+	for _, t := range targets {
+		t.root.Close()
+	}
+}
+
+// copyOutPaths copies each target's source, as seen from inside the
+// session, to the host, reporting what was copied and what failed.
+// Failures never fail the session.
+func copyOutPaths(targets []copyOutTarget) {
+	for _, t := range targets {
+		dest := filepath.Join(t.root.Name(), t.name)
+		files, errs := copyTree(t.root, t.name, t.Src)
+		for _, err := range errs {
+			Log.Warn("copying out %s: %v", t.Src, err)
+		}
+		if files > 0 || len(errs) == 0 {
+			noun := "files"
+			if files == 1 {
+				noun = "file"
+			}
+			Log.Print("Copied out: %s to %s (%d %s)", t.Src, dest, files, noun)
+		}
+	}
+}
+
+// copyTree copies src to name under root: regular files with their
+// contents and permissions, directories recursively, and symlinks as
+// symlinks.  It returns the number of files copied and an error for
+// every entry that could not be.
+func copyTree(root *os.Root, name, src string) (int, []error) {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return 0, []error{err}
+	}
+
+	switch {
+	case fi.Mode().IsRegular():
+		if err := copyOutFile(root, name, src, fi.Mode().Perm()); err != nil {
+			return 0, []error{err}
+		}
+		return 1, nil
+	case fi.IsDir():
+		if err := root.Mkdir(name, fi.Mode().Perm()|0700); err != nil && !errors.Is(err, fs.ErrExist) {
+			return 0, []error{err}
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return 0, []error{err}
+		}
+		files, errs := 0, []error(nil)
+		for _, e := range entries {
+			n, errs2 := copyTree(root, filepath.Join(name, e.Name()), filepath.Join(src, e.Name()))
+			files += n
+			errs = append(errs, errs2...)
+		}
+		return files, errs
+	case fi.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err == nil {
+			_ = root.Remove(name)
+			err = root.Symlink(target, name)
+		}
+		if err != nil {
+			return 0, []error{err}
+		}
+		return 1, nil
+	default:
+		return 0, []error{fmt.Errorf("%s: not a regular file, directory, or symlink; skipped", src)}
+	}
+}
+
+func copyOutFile(root *os.Root, name, src string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	return out.Close()
+}
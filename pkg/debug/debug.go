@@ -3,7 +3,12 @@
 package debug
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"os/exec"
+	"time"
 
 	"github.com/rsturla/podman-debug/pkg/podman"
 )
@@ -17,14 +22,126 @@ const (
 	ModeImage                // bare images
 )
 
+// String returns the mode name recorded in the session metadata.
+func (m Mode) String() string {
+	switch m {
+	case ModeLive:
+		return "live"
+	case ModeSnapshot:
+		return "snapshot"
+	case ModeImage:
+		return "image"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
 // Options configures a debug session.
 type Options struct {
-	Mode           Mode
-	HostMountpoint string // for snapshot/image modes
-	Writable       bool
-	Entrypoint     *podman.EntrypointInfo // image/container entrypoint metadata
+	Mode             Mode
+	HostMountpoint   string // for snapshot/image modes
+	Writable         bool
+	Entrypoint       *podman.EntrypointInfo // image/container entrypoint metadata
+	NixpkgsRef       string                 // flake ref used by install for plain package names
+	HistoryHints     bool                   // pre-populate shell history with builtin examples
+	NoCleanupOnError bool                   // keep mounts for inspection when setup fails
+	KeepSession      bool                   // keep mounts for inspection after the session command exits, until Enter
+	MinimalDev       bool                   // build a minimal /dev instead of binding the host's
+	AllowNewPrivs    bool                   // skip PR_SET_NO_NEW_PRIVS so setuid/file caps work
+	ChangesOut       *os.File               // receives the overlay changes as a tarball after a clean exit
+	PreserveOverlay  string                 // absolute host directory the overlay changes are copied into after the session, if set
+	CgroupLimits     CgroupLimits           // resource limits for the shell's cgroup, if any
+	TZ               string                 // timezone for the session, "" to leave TZ alone
+	HostPID          bool                   // snapshot/image: share the host PID namespace instead of a new one
+	NoJoinIPC        bool                   // live: keep the host IPC namespace instead of joining the container's
+	NoJoinUTS        bool                   // live: keep the host UTS namespace (hostname) instead of joining the container's
+	Mounts           []podman.Mount         // the container's configured runtime mounts, nil if unknown
+	UpperDir         string                 // snapshot/image: persistent overlay upper dir, "" for tmpfs
+	WorkDir          string                 // overlay work dir, set together with UpperDir
+	Timings          *Timings               // records setup phase durations, nil when off
+	Argv             []string               // command to exec verbatim instead of the shell, if set
+	Builtins         map[string]bool        // builtins to write, nil for all
+	Env              []string               // KEY=VALUE pairs added to the session environment
+	EnvOverride      []string               // KEY=VALUE pairs applied after the session's own variables
+	WritableVolumes  bool                   // snapshot: attach Mounts read-write instead of read-only
+	NoVolumes        bool                   // snapshot: leave Mounts unattached
+	PostInstall      string                 // shell command run in the session before the shell or command starts
+	Script           []byte                 // script written to ScriptPath for the shell to run, if set
+	RCFile           []byte                 // startup file written to RCFilePath for an interactive bash or sh, if set
+	CopyOut          string                 // absolute host directory attached at /.podman-debug/out, if set
+	CopyOutPaths     []CopyOutPath          // paths copied to the host after the session command exits
+	HostMounts       []HostMount            // host paths bound read-only into the session
+	ExtraHosts       []string               // "IP NAME" lines appended to the session's /etc/hosts
+	Nameservers      []string               // IP addresses replacing the nameservers in the session's /etc/resolv.conf
+	NoNetwork        bool                   // run the session in a new network namespace with only loopback
+	RestrictSys      bool                   // snapshot/image: read-only /sys without submounts, /proc with processes only
+	LayerDebugImage  bool                   // snapshot/image: show the debug image's files beneath the target's
+	User             string                 // run the session command as this user[:group], "" for root
+	OverlaySize      string                 // tmpfs size for the session's changes, "" for DefaultOverlaySize
+	Cwd              string                 // directory the session command starts in, "" for /
+	Target           string                 // name of the container or image, shown in the prompt
+	Offline          bool                   // no network: nix gets no substituters and install refuses
+	Timeout          time.Duration          // end the session command after this long, 0 for no limit
 }
 
+// Exit statuses for a session command that never ran, following the
+// shell's convention.  podman-debug's own failures are reported
+// separately (see --tool-error-exit-code), so these never mean that
+// the session could not be set up.
+const (
+	ExitCannotExec = 126 // the command was found but could not be executed
+	ExitNotFound   = 127 // the command was not found
+)
+
+// ExitSetupFailed is returned, together with a non-nil error, when the
+// session could not be set up and no command ran.
+const ExitSetupFailed = 125
+
+// ExitTargetExited is returned when the target container exited during
+// a live session, taking the session down with it.
+const ExitTargetExited = 122
+
+// ExitTimedOut is returned when the session command ran past
+// Options.Timeout and was killed, as timeout(1) does.
+const ExitTimedOut = 124
+
+// ExecFailureCode maps an error starting a command to ExitNotFound or
+// ExitCannotExec.
+func ExecFailureCode(err error) int {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return ExitNotFound
+	}
+	return ExitCannotExec
+}
+
+// HostMount is a host file or directory bound read-only into the
+// session (--mount-ro SRC:DEST).
+type HostMount struct {
+	Source string // absolute host path
+	Dest   string // absolute path inside the session
+}
+
+// CopyOutPath is a file or directory copied from the session to the
+// host once the session command has exited, before the overlay is torn
+// down (--copy-out SRC:DEST).
+type CopyOutPath struct {
+	Src  string // absolute path inside the session
+	Dest string // absolute host path, or an existing host directory to copy into
+}
+
+// ScriptPath is where a --script is written inside the session.  The
+// shell is started with this path as its only argument.
+const ScriptPath = "/.podman-debug/script"
+
+// RCFilePath is where a --shell-rcfile is written inside the session.
+// An interactive bash is started with --rcfile pointing at it, other
+// shells get it as $ENV, which POSIX shells read when interactive.
+const RCFilePath = "/.podman-debug/rcfile"
+
+// CgroupLimits maps cgroup v2 interface files (memory.max, pids.max,
+// cpu.max) to the values written into the session's cgroup.
+type CgroupLimits map[string]string
+
 // result holds the outcome of a debug session goroutine.
 type result struct {
 	exitCode int
@@ -36,4 +153,5 @@ type Streams struct {
 	Stdin  *os.File
 	Stdout *os.File
 	Stderr *os.File
+	Hangup <-chan struct{} // closed when the user has gone; the session command gets SIGHUP
 }
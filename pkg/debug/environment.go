@@ -3,51 +3,200 @@
 package debug
 
 import (
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 // writeNixConfig writes a single-user nix.conf into the merged
-// filesystem so nix commands work without a daemon.
-func writeNixConfig(mergedDir string) {
+// filesystem so nix commands work without a daemon.  Offline, nix is
+// given no binary caches to reach and gives up on connections at once.
+func writeNixConfig(mergedDir string, offline bool) {
 	nixConfigDir := mergedDir + "/etc/nix"
 	if err := os.MkdirAll(nixConfigDir, 0755); err == nil {
-		nixConfig := []byte(`# Podman debug single-user mode config
+		nixConfig := `# Podman debug single-user mode config
 build-users-group =
 sandbox = false
 trusted-public-keys = cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY=
 experimental-features = nix-command flakes
-`)
-		_ = os.WriteFile(nixConfigDir+"/nix.conf", nixConfig, 0644)
+`
+		if offline {
+			nixConfig += `substituters =
+connect-timeout = 1
+`
+		}
+		_ = os.WriteFile(nixConfigDir+"/nix.conf", []byte(nixConfig), 0644)
 	}
 }
 
-// setupEnvironment configures PATH, HOME, TERM, SSL certs, and other
-// environment variables for the debug shell.
-func setupEnvironment(shell string) {
-	os.Setenv("HOME", "/root")
+// setupEnvironment returns the environment for the debug shell: the
+// one podman-debug was started with, plus PATH, HOME, TERM, SSL certs,
+// and the other variables the session needs.  opts.Env is applied
+// first, so the variables the session depends on (PATH, HOME, SHELL,
+// PS1) always take the session's values, though a PATH there is kept
+// after the toolbox's directories; opts.EnvOverride is applied last
+// and may replace any of them.  podman-debug's own environment is left
+// alone, so nothing carries over to the next session of a batch or to
+// the podman commands run after it.
+func setupEnvironment(shell string, opts *Options) []string {
+	env := os.Environ()
+	for _, kv := range opts.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok && k != "" {
+			env = setEnv(env, k, v)
+		}
+	}
+
+	env = setEnv(env, "HOME", "/root")
 
 	nixProfilePath := filepath.Join("/nix", "var", "nix", "profiles", "default")
 	nixBinPath := filepath.Join(nixProfilePath, "bin")
 	userProfileBin := "/root/.nix-profile/bin"
+	flakeProfileBin := "/root/.nix-flake-profile/bin"
+	// A PATH from opts.Env (the target's own, say) replaces the
+	// standard directories but still comes after the toolbox's.
 	containerPath := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
-	os.Setenv("PATH", builtinsDir+":"+userProfileBin+":"+nixBinPath+":"+containerPath)
+	for _, kv := range opts.Env {
+		if v, ok := strings.CutPrefix(kv, "PATH="); ok && v != "" {
+			containerPath = v
+		}
+	}
+	env = setEnv(env, "PATH", builtinsDir+":"+flakeProfileBin+":"+userProfileBin+":"+nixBinPath+":"+containerPath)
 
-	if os.Getenv("TERM") == "" {
-		os.Setenv("TERM", "xterm-256color")
+	if getEnv(env, "TERM") == "" {
+		env = setEnv(env, "TERM", "xterm-256color")
 	}
 
 	// Set NIX_SSL_CERT_FILE so nix-built tools (curl, wget, git, etc.)
 	// can verify TLS connections.  We use the nix-specific variable
 	// rather than SSL_CERT_FILE to avoid influencing the container's
 	// own tools which may have their own CA cert configuration.
-	if os.Getenv("NIX_SSL_CERT_FILE") == "" {
+	if getEnv(env, "NIX_SSL_CERT_FILE") == "" {
 		nixCACert := filepath.Join(nixProfilePath, "etc", "ssl", "certs", "ca-bundle.crt")
 		if _, err := os.Stat(nixCACert); err == nil {
-			os.Setenv("NIX_SSL_CERT_FILE", nixCACert)
+			env = setEnv(env, "NIX_SSL_CERT_FILE", nixCACert)
+		}
+	}
+
+	// Point HISTFILE at the pre-populated hints, unless the user has
+	// their own history configured.  An rcfile that sets HISTFILE runs
+	// after this and still wins.
+	if opts.HistoryHints && getEnv(env, "HISTFILE") == "" {
+		env = setEnv(env, "HISTFILE", historyFile)
+	}
+
+	if opts.TZ != "" {
+		env = setupTimezone(env, opts.TZ)
+	}
+
+	env = setEnv(env, "SHELL", shell)
+	// A --shell-rcfile runs after this and can set its own prompt.
+	// fish has no PS1 and keeps its own.
+	if filepath.Base(shell) != "fish" {
+		env = setEnv(env, "PS1", sessionPrompt(opts))
+	}
+	if opts.RCFile != nil && filepath.Base(shell) != "bash" {
+		env = setEnv(env, "ENV", RCFilePath)
+	}
+
+	for _, kv := range opts.EnvOverride {
+		k, v, _ := strings.Cut(kv, "=")
+		env = setEnv(env, k, v)
+	}
+	return env
+}
+
+// ValidateEnv checks that each --env entry is a KEY=VALUE pair the
+// session's command can be given: a non-empty key and no NUL bytes.
+func ValidateEnv(env []string) error {
+	for _, kv := range env {
+		if k, _, ok := strings.Cut(kv, "="); !ok || k == "" || strings.ContainsRune(kv, 0) {
+			return fmt.Errorf("invalid --env %q: expected KEY=VALUE", kv)
 		}
 	}
+	return nil
+}
 
-	os.Setenv("SHELL", shell)
-	os.Setenv("PS1", "debug> ")
+// getEnv returns the value of key in env, or "" if it is not set.
+func getEnv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if v, ok := strings.CutPrefix(env[i], key+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// setEnv returns a copy of env with key set to value, replacing any
+// earlier setting.
+func setEnv(env []string, key, value string) []string {
+	out := make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			out = append(out, kv)
+		}
+	}
+	return append(out, key+"="+value)
+}
+
+// lookPath finds name on the PATH in env, as exec.LookPath does on
+// podman-debug's own.
+func lookPath(name string, env []string) (string, error) {
+	if strings.Contains(name, "/") {
+		return exec.LookPath(name)
+	}
+	for _, dir := range filepath.SplitList(getEnv(env, "PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, name)
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", exec.ErrNotFound
+}
+
+// sessionPrompt returns the session's PS1, naming the mode and target
+// so that a terminal shows what it is attached to: debug(live:web)> .
+func sessionPrompt(opts *Options) string {
+	label := opts.Mode.String()
+	if opts.Target != "" {
+		// Keep the name from being read as a prompt escape or
+		// expansion.
+		name := strings.Map(func(r rune) rune {
+			if strings.ContainsRune("\\$`!%", r) {
+				return '_'
+			}
+			return r
+		}, opts.Target)
+		label += ":" + name
+	}
+	return "debug(" + label + ")> "
+}
+
+// setUserHome points HOME in env at the session user's home
+// directory, unless opts.EnvOverride sets HOME itself.
+func setUserHome(env []string, home string, opts *Options) []string {
+	for _, kv := range opts.EnvOverride {
+		if strings.HasPrefix(kv, "HOME=") {
+			return env
+		}
+	}
+	return setEnv(env, "HOME", home)
+}
+
+// sessionDir returns the directory the session command starts in:
+// opts.Cwd if it is a directory in the session's filesystem, else "/"
+// with a note.
+func sessionDir(opts *Options) string {
+	if opts.Cwd == "" || opts.Cwd == "/" {
+		return "/"
+	}
+	if fi, err := os.Stat(opts.Cwd); err != nil || !fi.IsDir() {
+		Log.Note("Working directory %s not found in the session; starting in /.", opts.Cwd)
+		return "/"
+	}
+	return opts.Cwd
 }
@@ -0,0 +1,102 @@
+//go:build linux
+
+package debug
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSetupEnvironment(t *testing.T) {
+	t.Setenv("TERM", "screen")
+	t.Setenv("TZ", "")
+	os.Unsetenv("TZ")
+
+	first := &Options{
+		Mode:        ModeSnapshot,
+		Target:      "web",
+		Env:         []string{"SECRET=hunter2", "PATH=/app/bin"},
+		EnvOverride: []string{"TERM=dumb", "DEBUG=1"},
+		TZ:          "UTC0",
+	}
+	env := setupEnvironment("/bin/bash", first)
+	for key, want := range map[string]string{
+		"SECRET": "hunter2",
+		"TERM":   "dumb",
+		"DEBUG":  "1",
+		"TZ":     "UTC0",
+		"HOME":   "/root",
+		"SHELL":  "/bin/bash",
+		"PS1":    "debug(snapshot:web)> ",
+	} {
+		if got := getEnv(env, key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if path := getEnv(env, "PATH"); !strings.HasPrefix(path, builtinsDir+":") || !strings.HasSuffix(path, ":/app/bin") {
+		t.Errorf("PATH = %q, want the toolbox's directories before /app/bin", path)
+	}
+	for _, key := range []string{"TERM", "PATH"} {
+		n := 0
+		for _, kv := range env {
+			if strings.HasPrefix(kv, key+"=") {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("%s is set %d times, want once", key, n)
+		}
+	}
+
+	// Nothing leaks into podman-debug's own environment, or from one
+	// session into the next.
+	for _, key := range []string{"SECRET", "DEBUG", "TZ", "PS1"} {
+		if v, ok := os.LookupEnv(key); ok {
+			t.Errorf("podman-debug's own %s = %q after setupEnvironment", key, v)
+		}
+	}
+	if got := os.Getenv("TERM"); got != "screen" {
+		t.Errorf("podman-debug's own TERM = %q, want screen", got)
+	}
+	next := setupEnvironment("/bin/sh", &Options{Mode: ModeImage})
+	if slices.ContainsFunc(next, func(kv string) bool { return strings.HasPrefix(kv, "SECRET=") || strings.HasPrefix(kv, "TZ=") }) {
+		t.Errorf("the previous session's variables leaked into the next: %q", next)
+	}
+	if got := getEnv(next, "TERM"); got != "screen" {
+		t.Errorf("next session's TERM = %q, want the user's screen", got)
+	}
+}
+
+func TestSetUserHome(t *testing.T) {
+	env := []string{"HOME=/root", "PATH=/bin"}
+	if got := getEnv(setUserHome(env, "/home/app", &Options{}), "HOME"); got != "/home/app" {
+		t.Errorf("HOME = %q, want /home/app", got)
+	}
+	opts := &Options{EnvOverride: []string{"HOME=/srv"}}
+	if got := getEnv(setUserHome(env, "/home/app", opts), "HOME"); got != "/root" {
+		t.Errorf("HOME with --env HOME = %q, want it left alone", got)
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	tests := []struct {
+		kv      string
+		wantErr bool
+	}{
+		{kv: "DEBUG=1"},
+		{kv: "EMPTY="},
+		{kv: "URL=http://proxy:3128/?a=b"},
+		{kv: "NOVALUE", wantErr: true},
+		{kv: "=value", wantErr: true},
+		{kv: "BAD\x00KEY=1", wantErr: true},
+		{kv: "KEY=bad\x00value", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := ValidateEnv([]string{tt.kv})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateEnv(%q) = %v, want error %v", tt.kv, err, tt.wantErr)
+		}
+	}
+}
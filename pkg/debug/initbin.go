@@ -0,0 +1,82 @@
+//go:build linux
+
+package debug
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// selfExe gives access to the podman-debug binary after the session has
+// left the host mount namespace, where its path is no longer
+// reachable.  Both handles are opened before any namespace change.
+type selfExe struct {
+	treeFD int      // detached read-only bind mount of the binary, or -1
+	file   *os.File // the binary itself, for the copy fallback
+}
+
+// openSelfExe opens the running binary for installing it as the
+// session's init.  Failures leave the corresponding handle unset; the
+// init binary is then simply missing, as it would be if copying failed.
+func openSelfExe() *selfExe {
+	s := &selfExe{treeFD: -1}
+	if f, err := os.Open("/proc/self/exe"); err == nil {
+		s.file = f
+	}
+
+	fd, err := unix.OpenTree(unix.AT_FDCWD, "/proc/self/exe", unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC)
+	if err != nil {
+		return s
+	}
+	// The bind must be read-only: a writable one would let the session
+	// modify the host's podman-debug binary.
+	attr := unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY | unix.MOUNT_ATTR_NOSUID | unix.MOUNT_ATTR_NODEV}
+	if err := unix.MountSetattr(fd, "", unix.AT_EMPTY_PATH, &attr); err != nil {
+		unix.Close(fd)
+		return s
+	}
+	s.treeFD = fd
+	return s
+}
+
+// Close releases the handles.
+func (s *selfExe) Close() {
+	if s.treeFD >= 0 {
+		unix.Close(s.treeFD)
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+}
+
+// install places the binary at path: bind-mounted when possible, which
+// costs nothing however big the binary is, otherwise copied.
+func (s *selfExe) install(path string) {
+	if s.treeFD >= 0 {
+		if f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0755); err == nil {
+			f.Close()
+			if err := unix.MoveMount(s.treeFD, "", unix.AT_FDCWD, path, unix.MOVE_MOUNT_F_EMPTY_PATH); err == nil {
+				return
+			}
+		}
+	}
+	if s.file != nil {
+		s.copyTo(path)
+	}
+}
+
+// copyTo copies the binary to path.
+func (s *selfExe) copyTo(path string) {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+
+	_, _ = io.Copy(dst, s.file)
+}
@@ -3,10 +3,14 @@
 package debug
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
 	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/rsturla/podman-debug/pkg/podman"
 	"golang.org/x/sys/unix"
@@ -15,54 +19,219 @@ import (
 // ExecLive joins a running/paused container's namespaces and executes
 // a debug shell.  The container PID is used to locate namespace files.
 func ExecLive(pid int, nixPath, shell string, shellArgs []string, streams Streams, opts *Options) (int, error) {
+	if err := ValidateEnv(opts.EnvOverride); err != nil {
+		return ExitSetupFailed, err
+	}
+
 	resChan := make(chan result, 1)
 	ptyChan := make(chan *os.File, 1)
 	doneChan := make(chan struct{})
 
+	// Hang the session up if the container exits under it.
+	exited, stopWatch := watchTarget(pid)
+	defer stopWatch()
+	hangup, stopHangup := mergeHangup(streams.Hangup, exited)
+	defer stopHangup()
+	streams.Hangup = hangup
+
+	// The base is created in the container's mount namespace, on its
+	// filesystem.
+	base := newOverlayBase()
+	defer removeOverlayBase(fmt.Sprintf("/proc/%d/root", pid), base)
+
 	go func() {
 		runtime.LockOSThread()
 
 		_ = unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(unix.SIGKILL), 0, 0, 0)
-		_ = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		if !opts.AllowNewPrivs {
+			_ = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		}
 
 		// No user namespace setup needed here: when running rootless
 		// the binary has already been re-exec'd via "podman unshare",
 		// which puts us in podman's user namespace (same one the
 		// container uses) with CAP_SYS_ADMIN.
 
+		// Create the session cgroup while /sys/fs/cgroup is still
+		// the host's.
+		cgroup := newSessionCgroup(opts.CgroupLimits)
+		defer cgroup.Close()
+
 		nixTreeFD, err := unix.OpenTree(unix.AT_FDCWD, nixPath,
 			unix.OPEN_TREE_CLONE|unix.AT_RECURSIVE)
 		if err != nil {
-			resChan <- result{125, fmt.Errorf("open_tree(%s): %w (requires Linux 5.2+)", nixPath, err)}
+			resChan <- result{ExitSetupFailed, fmt.Errorf("open_tree(%s): %w (requires Linux 5.2+)", nixPath, err)}
 			return
 		}
 		defer unix.Close(nixTreeFD)
 
-		mergedDir, err := setupLiveMode(pid, nixTreeFD, opts.Writable)
+		// Open our own binary while its host path is still reachable.
+		self := openSelfExe()
+		defer self.Close()
+
+		copyOutFD, err := openCopyOut(opts.CopyOut)
 		if err != nil {
-			resChan <- result{125, err}
+			resChan <- result{ExitSetupFailed, err}
 			return
 		}
+		if copyOutFD >= 0 {
+			defer unix.Close(copyOutFD)
+		}
+
+		copyOutTargets, err := openCopyOutPaths(opts.CopyOutPaths)
+		if err != nil {
+			resChan <- result{ExitSetupFailed, err}
+			return
+		}
+		defer closeCopyOutPaths(copyOutTargets)
 
-		writeNixConfig(mergedDir)
-		writeBuiltins(mergedDir, opts.Entrypoint)
+		hostMounts, err := openHostMounts(opts.HostMounts)
+		if err != nil {
+			resChan <- result{ExitSetupFailed, err}
+			return
+		}
+		defer closeHostMounts(hostMounts)
+
+		// Host PIDs are only visible while /proc is the host's.
+		var procs []pidPair
+		if opts.builtinEnabled("procs") {
+			procs = containerPIDs(pid)
+		}
+
+		var preserveRoot *os.Root
+		if opts.PreserveOverlay != "" {
+			if preserveRoot, err = os.OpenRoot(opts.PreserveOverlay); err != nil {
+				resChan <- result{ExitSetupFailed, fmt.Errorf("--preserve-overlay: %w", err)}
+				return
+			}
+			defer preserveRoot.Close()
+		}
+
+		// setupFailed reports a setup error, first holding the
+		// session's mounts open for inspection when requested.
+		setupFailed := func(err error) {
+			if opts.NoCleanupOnError {
+				holdForInspection(base, err, streams.Stdin)
+			}
+			resChan <- result{ExitSetupFailed, err}
+		}
+
+		mergedDir, err := setupLiveMode(base, pid, nixTreeFD, hostMounts, opts)
+		if err != nil {
+			setupFailed(err)
+			return
+		}
+
+		writeNixConfig(mergedDir, opts.Offline)
+		writeBuiltins(mergedDir, opts, self)
+		if opts.builtinEnabled("procs") {
+			writeProcsMetadata(mergedDir, procs)
+		}
+		if opts.builtinEnabled("diff") && !opts.Writable {
+			// Before chroot, / is still the container's own root.
+			mountDiffViews(mergedDir, overlayUpperDir(base, opts), "/")
+		}
+		if err := mountCopyOut(copyOutFD, mergedDir, opts.CopyOut); err != nil {
+			setupFailed(err)
+			return
+		}
+
+		// Keep a handle on the upper dir: it is outside the chroot.
+		upperFD := -1
+		if (opts.ChangesOut != nil || opts.PreserveOverlay != "") && !opts.Writable {
+			upperFD, err = unix.Open(overlayUpperDir(base, opts), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+			if err != nil {
+				setupFailed(fmt.Errorf("opening overlay upper dir: %w", err))
+				return
+			}
+			defer unix.Close(upperFD)
+		}
+
+		var keptMounts []string
+		if opts.KeepSession {
+			keptMounts = sessionMounts(base)
+		}
 
 		if err := unix.Chroot(mergedDir); err != nil {
-			resChan <- result{125, fmt.Errorf("chroot to overlay: %w", err)}
+			setupFailed(fmt.Errorf("chroot to overlay: %w", err))
 			return
 		}
 		if err := unix.Chdir("/"); err != nil {
-			resChan <- result{125, fmt.Errorf("chdir to /: %w", err)}
+			setupFailed(fmt.Errorf("chdir to /: %w", err))
 			return
 		}
 
-		setupEnvironment(shell)
+		env := setupEnvironment(shell, opts)
+
+		var cred *syscall.Credential
+		var home string
+		if opts.User != "" {
+			if cred, home, err = resolveUser(opts.User); err != nil {
+				setupFailed(fmt.Errorf("session user: %w", err))
+				return
+			}
+		}
+
+		if opts.NoNetwork {
+			if err := isolateNetwork(); err != nil {
+				setupFailed(err)
+				return
+			}
+		}
 
-		cmd := exec.Command(shell, shellArgs...)
-		cmd.Dir = "/"
-		cmd.Env = os.Environ()
+		if opts.PostInstall != "" {
+			postInstalled := opts.Timings.Track("post-install")
+			runPostInstall(shell, opts, env, false, cgroup, streams)
+			postInstalled()
+		}
 
-		exitCode, err := runShell(cmd, streams, len(shellArgs) == 0, ptyChan, doneChan)
+		cmd, interactive, err := sessionCommand(shell, shellArgs, opts, env, false)
+		if err != nil {
+			// Reported like a shell would, as the command's own
+			// status rather than a podman-debug failure.
+			fmt.Fprintf(streams.Stderr, "podman-debug: %v\n", err)
+			resChan <- result{ExitNotFound, nil}
+			return
+		}
+		cmd.Dir = sessionDir(opts)
+		if cred != nil {
+			// After --post-install, which still runs as root.
+			env = setUserHome(env, home, opts)
+		}
+		cmd.Env = env
+		cgroup.apply(cmd)
+		if cred != nil {
+			applyUser(cmd, cred, false)
+		}
+
+		opts.Timings.Mark("time to shell")
+		shellStreams, release := streams, func() {}
+		if opts.KeepSession && interactive && streams.Stdin != nil {
+			shellStreams.Stdin, release = releasableStdin(streams.Stdin)
+		}
+		exitCode, err := runShell(cmd, shellStreams, interactive, opts.Timeout, ptyChan, doneChan)
+		release()
+		if opts.Script != nil {
+			// With --writable the script would be left in the container.
+			_ = os.Remove(ScriptPath)
+		}
+		if opts.RCFile != nil {
+			_ = os.Remove(RCFilePath)
+		}
+		if opts.KeepSession {
+			keepSession(mergedDir, opts.HostMountpoint, nixPath, keptMounts, streams.Stdin, streams.Hangup)
+		}
+		copyOutPaths(copyOutTargets)
+		if preserveRoot != nil && upperFD >= 0 {
+			preserveOverlay(upperFD, preserveRoot)
+		}
+
+		if err == nil && exitCode == 0 && opts.ChangesOut != nil && upperFD >= 0 {
+			if err := exportChanges(upperFD, opts.ChangesOut); err != nil {
+				resChan <- result{ExitSetupFailed, fmt.Errorf("exporting session changes: %w", err)}
+				return
+			}
+		}
 
 		if opts.Writable {
 			_ = unix.Unmount("/nix", unix.MNT_DETACH)
@@ -72,10 +241,80 @@ func ExecLive(pid int, nixPath, shell string, shellArgs []string, streams Stream
 		resChan <- result{exitCode, err}
 	}()
 
-	return waitForResult(resChan, ptyChan, doneChan, streams.Stdin)
+	waited := make(chan result, 1)
+	go func() {
+		code, err := waitForResult(resChan, ptyChan, doneChan, streams.Stdin)
+		waited <- result{code, err}
+	}()
+
+	var res result
+	select {
+	case res = <-waited:
+		// The session ended on its own, even if the target has
+		// gone by now: its status is the one to report.
+		return res.exitCode, res.err
+	case <-exited:
+	}
+	// Setup may be stuck on the container's vanished mounts; don't
+	// wait on it forever.
+	select {
+	case res = <-waited:
+	case <-time.After(targetExitGrace):
+	}
+	if res.err != nil {
+		fmt.Fprintf(streams.Stderr, "Target container exited; debug session terminating (%v).\r\n", res.err)
+	} else {
+		fmt.Fprintf(streams.Stderr, "Target container exited; debug session terminating.\r\n")
+	}
+	return ExitTargetExited, nil
+}
+
+// targetExitGrace is how long a live session gets to wind down once
+// its target container has exited.
+const targetExitGrace = 5 * time.Second
+
+// watchTarget polls for the exit of the container process pid.  The
+// returned channel is closed once it has exited; the func stops
+// watching.
+func watchTarget(pid int) (<-chan struct{}, func()) {
+	exited := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if processGone(pid) {
+					close(exited)
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return exited, func() { close(done) }
+}
+
+// processGone reports whether pid has exited: it is gone from /proc,
+// or a zombie its parent has yet to reap.
+func processGone(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return errors.Is(err, fs.ErrNotExist) || errors.Is(err, unix.ESRCH)
+	}
+	// The state follows the command name, which is parenthesised
+	// and may itself contain spaces and parentheses.
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 || i+2 >= len(data) {
+		return false
+	}
+	state := data[i+2]
+	return state == 'Z' || state == 'X'
 }
 
-func setupLiveMode(pid int, nixTreeFD int, writable bool) (string, error) {
+func setupLiveMode(base string, pid int, nixTreeFD int, hostMounts []hostMountTree, opts *Options) (string, error) {
 	nsPaths := map[string]int{
 		podman.NamespacePath(pid, "mnt"): unix.CLONE_NEWNS,
 		podman.NamespacePath(pid, "pid"): unix.CLONE_NEWPID,
@@ -83,11 +322,18 @@ func setupLiveMode(pid int, nixTreeFD int, writable bool) (string, error) {
 		podman.NamespacePath(pid, "ipc"): unix.CLONE_NEWIPC,
 		podman.NamespacePath(pid, "uts"): unix.CLONE_NEWUTS,
 	}
+	// mnt and pid are always joined: the session is the container's
+	// filesystem and processes.  The others may stay the host's.
+	if opts.NoJoinIPC {
+		delete(nsPaths, podman.NamespacePath(pid, "ipc"))
+	}
+	if opts.NoJoinUTS {
+		delete(nsPaths, podman.NamespacePath(pid, "uts"))
+	}
 
-	mountNSPath := podman.NamespacePath(pid, "mnt")
-	mountFD, err := os.Open(mountNSPath)
+	mountFD, err := os.Open(podman.NamespacePath(pid, "mnt"))
 	if err != nil {
-		return "", fmt.Errorf("opening mount namespace %s: %w", mountNSPath, err)
+		return "", &NamespaceError{Namespace: "mnt", PID: pid, Op: "opening", Err: err}
 	}
 	defer mountFD.Close()
 
@@ -113,20 +359,30 @@ func setupLiveMode(pid int, nixTreeFD int, writable bool) (string, error) {
 		}
 	}()
 
+	joined := opts.Timings.Track("namespace join")
 	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
 		return "", fmt.Errorf("unshare mount namespace: %w", err)
 	}
 
-	// Join PID namespace first (affects children).
-	for _, ns := range optionalNS {
-		if ns.clone == unix.CLONE_NEWPID {
-			_ = unix.Setns(int(ns.fd.Fd()), ns.clone)
-			break
+	// Join PID namespace first (affects children).  A container run
+	// with --pid=host is already in ours, so there is nothing to join.
+	if same, _ := sameNamespace(podman.NamespacePath(pid, "pid"), "/proc/self/ns/pid"); same {
+		Log.Note("Container shares the host PID namespace; the session sees all host processes.")
+	} else {
+		// Without it the session would silently see the host's
+		// processes instead of the container's.
+		for _, ns := range optionalNS {
+			if ns.clone == unix.CLONE_NEWPID {
+				if err := unix.Setns(int(ns.fd.Fd()), ns.clone); err != nil {
+					return "", &NamespaceError{Namespace: "pid", PID: pid, Op: "joining", Err: err}
+				}
+				break
+			}
 		}
 	}
 
 	if err := unix.Setns(int(mountFD.Fd()), unix.CLONE_NEWNS); err != nil {
-		return "", fmt.Errorf("joining mount namespace: %w", err)
+		return "", &NamespaceError{Namespace: "mnt", PID: pid, Op: "joining", Err: err}
 	}
 
 	// Unshare again for a private copy.
@@ -146,29 +402,92 @@ func setupLiveMode(pid int, nixTreeFD int, writable bool) (string, error) {
 		_ = unix.Setns(int(ns.fd.Fd()), ns.clone)
 	}
 
-	mergedDir, err := createOverlay("/", writable)
+	joined()
+
+	defer opts.Timings.Track("overlay setup")()
+	mergedDir, err := createOverlay(base, []string{"/"}, opts.Writable, "", "", opts.OverlaySize)
 	if err != nil {
 		return "", err
 	}
 
-	if writable {
-		nixMountPoint := mergedDir + "/nix"
+	if opts.Writable {
+		nixMountPoint, err := resolveForCreate(mergedDir, "/nix")
+		if err != nil {
+			return "", fmt.Errorf("resolving /nix in overlay: %w", err)
+		}
 		if err := os.MkdirAll(nixMountPoint, 0755); err != nil {
 			return "", fmt.Errorf("creating /nix: %w", err)
 		}
-		if err := mountNixStore(nixTreeFD, nixMountPoint, overlayBasePath); err != nil {
+		if err := mountNixStore(nixTreeFD, nixMountPoint, base); err != nil {
 			return "", err
 		}
+		bindNetworkOverrides(mergedDir, opts)
 	} else {
-		nixMountPoint := mergedDir + "/nix"
+		nixMountPoint, err := resolveForCreate(mergedDir, "/nix")
+		if err != nil {
+			return "", fmt.Errorf("resolving /nix in overlay: %w", err)
+		}
 		if err := os.MkdirAll(nixMountPoint, 0755); err != nil {
 			return "", fmt.Errorf("creating /nix in overlay: %w", err)
 		}
-		if err := mountNixStore(nixTreeFD, nixMountPoint, overlayBasePath); err != nil {
+		if err := mountNixStore(nixTreeFD, nixMountPoint, base); err != nil {
 			return "", err
 		}
-		bindHostMounts(mergedDir)
+		bindHostMounts(mergedDir, opts.MinimalDev)
+		bindNetworkConfig(mergedDir, opts)
 	}
 
+	if err := attachHostMounts(mergedDir, hostMounts); err != nil {
+		return "", err
+	}
 	return mergedDir, nil
 }
+
+// NamespaceError is returned when a live session cannot open or join
+// one of the target container's namespaces.
+type NamespaceError struct {
+	Namespace string // "mnt" or "pid"
+	PID       int    // the container process the namespace was taken from
+	Op        string // "opening" or "joining"
+	Err       error
+}
+
+func (e *NamespaceError) Error() string {
+	msg := fmt.Sprintf("%s %s namespace of container process %d: %v", e.Op, e.Namespace, e.PID, e.Err)
+	var errno syscall.Errno
+	if errors.As(e.Err, &errno) {
+		msg += fmt.Sprintf(" (%s)", unix.ErrnoName(errno))
+	}
+	return msg
+}
+
+func (e *NamespaceError) Unwrap() error { return e.Err }
+
+// Hint suggests what to do about the failure, or returns "".
+func (e *NamespaceError) Hint() string {
+	switch {
+	case errors.Is(e.Err, fs.ErrNotExist), errors.Is(e.Err, unix.ESRCH):
+		return "The container may have exited since it was inspected; check podman ps and try again."
+	case errors.Is(e.Err, unix.EPERM), errors.Is(e.Err, unix.EACCES):
+		if e.Namespace == "pid" {
+			return "Joining a PID namespace needs privileges over its owning user namespace; debug a rootless container as the user that runs it."
+		}
+		return "Debug a rootless container as the user that runs it, and a rootful one as root."
+	case errors.Is(e.Err, unix.ENOSYS):
+		return "The kernel is too old to join namespaces this way; podman-debug needs Linux 5.2 or later."
+	}
+	return ""
+}
+
+// sameNamespace reports whether two /proc/<pid>/ns/* files refer to the
+// same namespace, by comparing their device and inode numbers.
+func sameNamespace(a, b string) (bool, error) {
+	var sa, sb unix.Stat_t
+	if err := unix.Stat(a, &sa); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(b, &sb); err != nil {
+		return false, err
+	}
+	return sa.Dev == sb.Dev && sa.Ino == sb.Ino, nil
+}
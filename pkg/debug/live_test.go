@@ -0,0 +1,53 @@
+//go:build linux
+
+package debug
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSameNamespace(t *testing.T) {
+	self := fmt.Sprintf("/proc/%d/ns", os.Getpid())
+	type test struct {
+		name    string
+		a, b    string
+		want    bool
+		wantErr bool
+	}
+	tests := []test{
+		{name: "self and /proc/self", a: self + "/mnt", b: "/proc/self/ns/mnt", want: true},
+		{name: "self and thread-self", a: "/proc/self/ns/net", b: "/proc/thread-self/ns/net", want: true},
+		{name: "different types", a: "/proc/self/ns/mnt", b: "/proc/self/ns/net", want: false},
+		{name: "missing", a: "/proc/self/ns/mnt", b: "/proc/self/ns/no-such-namespace", wantErr: true},
+	}
+	// Whether we share pid 1's namespaces depends on where the test
+	// runs; the kernel's own "type:[inode]" link text says which.
+	for _, ns := range []string{"mnt", "pid", "net"} {
+		linkA, errA := os.Readlink("/proc/self/ns/" + ns)
+		linkB, errB := os.Readlink("/proc/1/ns/" + ns)
+		if errA != nil || errB != nil {
+			continue
+		}
+		tests = append(tests, test{name: "self and pid 1 " + ns, a: "/proc/self/ns/" + ns, b: "/proc/1/ns/" + ns, want: linkA == linkB})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sameNamespace(tt.a, tt.b)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("sameNamespace(%s, %s) = %v, want an error", tt.a, tt.b, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sameNamespace(%s, %s): %v", tt.a, tt.b, err)
+			}
+			if got != tt.want {
+				t.Errorf("sameNamespace(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
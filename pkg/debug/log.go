@@ -0,0 +1,129 @@
+package debug
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Logger writes podman-debug's notes, warnings, and lifecycle events.
+// In text format notes and warnings are the familiar "Note: ..." lines
+// and events print nothing.  In JSON format each is one record with a
+// timestamp, level, message, and the target, and events carry their
+// attributes (image, mount point, mode, exit code, ...).  While the
+// terminal is raw, lines end in CRLF.
+type Logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	json   *slog.Logger // nil in text format
+	target string
+	raw    atomic.Bool
+}
+
+// Log is where podman-debug reports what it does; main sets it up
+// from --log-format.
+var Log = NewLogger(os.Stderr, "text")
+
+// NewLogger returns a logger writing format ("text" or "json") to w.
+func NewLogger(w io.Writer, format string) *Logger {
+	l := &Logger{w: w}
+	if format == "json" {
+		l.json = slog.New(slog.NewJSONHandler(eolWriter{l}, nil))
+	}
+	return l
+}
+
+// SetTarget names the container or image later records are about.
+func (l *Logger) SetTarget(target string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.target = target
+}
+
+// SetRaw records whether the terminal is in raw mode, where a bare LF
+// doesn't return the cursor to the start of the line.
+func (l *Logger) SetRaw(raw bool) {
+	l.raw.Store(raw)
+}
+
+// Note reports something the user should know but need not act on.
+func (l *Logger) Note(format string, args ...any) {
+	l.log(slog.LevelInfo, "Note: ", format, args)
+}
+
+// Warn reports something that may not work as the user expects.
+func (l *Logger) Warn(format string, args ...any) {
+	l.log(slog.LevelWarn, "Warning: ", format, args)
+}
+
+// Error reports the failure podman-debug exits with.
+func (l *Logger) Error(format string, args ...any) {
+	l.log(slog.LevelError, "Error: ", format, args)
+}
+
+// Hint suggests what to do about a preceding error or warning.
+func (l *Logger) Hint(format string, args ...any) {
+	l.log(slog.LevelInfo, "Hint: ", format, args)
+}
+
+// Print reports a result, such as where a file was written, that has
+// no prefix in text format.
+func (l *Logger) Print(format string, args ...any) {
+	l.log(slog.LevelInfo, "", format, args)
+}
+
+// Event records a lifecycle event with key/value attributes.  Only the
+// JSON format shows events.
+func (l *Logger) Event(msg string, attrs ...any) {
+	if l.json == nil {
+		return
+	}
+	l.json.Info(msg, append(l.targetAttr(), attrs...)...)
+}
+
+func (l *Logger) log(level slog.Level, prefix, format string, args []any) {
+	msg := fmt.Sprintf(format, args...)
+	if l.json != nil {
+		l.json.Log(context.Background(), level, msg, l.targetAttr()...)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "%s%s%s", prefix, msg, l.eol())
+}
+
+// targetAttr returns the "target" attribute, if a target is set yet.
+func (l *Logger) targetAttr() []any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.target == "" {
+		return nil
+	}
+	return []any{"target", l.target}
+}
+
+func (l *Logger) eol() string {
+	if l.raw.Load() {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// eolWriter passes the JSON handler's records through to the logger's
+// writer with the line ending the terminal needs.
+type eolWriter struct{ l *Logger }
+
+func (e eolWriter) Write(p []byte) (int, error) {
+	e.l.mu.Lock()
+	defer e.l.mu.Unlock()
+	line := append(bytes.Clone(bytes.TrimSuffix(p, []byte("\n"))), e.l.eol()...)
+	if _, err := e.l.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,176 @@
+//go:build linux
+
+package debug
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountinfoEntry is the part of a /proc/self/mountinfo line we use.
+type mountinfoEntry struct {
+	mountPoint string
+	fsType     string
+	superOpts  string
+}
+
+// readMountinfo parses /proc/self/mountinfo, in mount order.
+func readMountinfo() ([]mountinfoEntry, error) {
+	return readMountinfoFile("/proc/self/mountinfo")
+}
+
+// readMountinfoFile parses a mountinfo file such as
+// /proc/thread-self/mountinfo, in mount order.
+func readMountinfoFile(path string) ([]mountinfoEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []mountinfoEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The optional fields before "-" vary in number.
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+4 {
+			continue
+		}
+		mounts = append(mounts, mountinfoEntry{
+			mountPoint: unescapeMountinfo(fields[4]),
+			fsType:     fields[sep+1],
+			superOpts:  fields[sep+3],
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// LeftoverMounts returns the mount points in our mount namespace that
+// belong to a debug session (its overlay, or anything beneath a
+// /.podman-debug directory) whose podman-debug process is gone, or is
+// this one.  Sessions mount in a private namespace, so after a session
+// has ended there should be none; those of another running
+// podman-debug are left alone.
+func LeftoverMounts() ([]string, error) {
+	mounts, err := readMountinfo()
+	if err != nil {
+		return nil, err
+	}
+	return sessionMountPoints(mounts, ownerGone), nil
+}
+
+// ownerGone reports whether the podman-debug process with the given
+// PID can no longer be using its sessions' mounts.
+func ownerGone(pid int) bool {
+	return pid == os.Getpid() || processGone(pid)
+}
+
+// sessionMountPoints returns the mount points among mounts that belong
+// to a debug session whose owner, by gone, has exited, for
+// LeftoverMounts.
+func sessionMountPoints(mounts []mountinfoEntry, gone func(pid int) bool) []string {
+	var leftover []string
+	for _, m := range mounts {
+		owner, inBase := overlayBaseOwner(m.mountPoint)
+		if inBase && !gone(owner) {
+			continue
+		}
+		if inBase || strings.Contains(m.mountPoint, metadataDir+"/") {
+			leftover = append(leftover, m.mountPoint)
+		}
+	}
+	return leftover
+}
+
+// UnmountLeftovers unmounts the session mounts LeftoverMounts finds,
+// which a crashed run can leave behind, innermost first, and returns
+// the mount points it unmounted.
+func UnmountLeftovers() ([]string, error) {
+	mounts, err := LeftoverMounts()
+	if err != nil {
+		return nil, err
+	}
+	var unmounted []string
+	var errs []error
+	for _, mp := range slices.Backward(mounts) {
+		if err := unix.Unmount(mp, unix.MNT_DETACH); err != nil {
+			if !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+				errs = append(errs, fmt.Errorf("unmounting %s: %w", mp, err))
+			}
+			continue
+		}
+		unmounted = append(unmounted, mp)
+	}
+	return unmounted, errors.Join(errs...)
+}
+
+// clearStaleMounts detaches whatever the calling thread's mount
+// namespace has mounted at path, a new session's overlay base, so a
+// new mount there doesn't stack on mounts a crashed run with the same
+// PID left behind.
+func clearStaleMounts(path string) error {
+	for {
+		mounts, err := readMountinfoFile("/proc/thread-self/mountinfo")
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(mounts, func(m mountinfoEntry) bool { return m.mountPoint == path }) {
+			return nil
+		}
+		if err := unix.Unmount(path, unix.MNT_DETACH); err != nil {
+			return fmt.Errorf("unmounting stale %s: %w", path, err)
+		}
+	}
+}
+
+// sessionMounts returns the mount points of the calling thread's mount
+// namespace at or beneath the session's overlay base, in mount order.
+// Called on the session thread, whose namespace /proc/self doesn't
+// show, before it chroots.
+func sessionMounts(base string) []string {
+	mounts, err := readMountinfoFile("/proc/thread-self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, m := range mounts {
+		if m.mountPoint == base || isWithin(base, m.mountPoint) {
+			paths = append(paths, m.mountPoint)
+		}
+	}
+	return paths
+}
+
+// unescapeMountinfo undoes the octal escaping (\040 for a space, etc.)
+// the kernel applies to paths in /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
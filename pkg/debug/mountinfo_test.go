@@ -0,0 +1,112 @@
+//go:build linux
+
+package debug
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testMountinfo has the host's own mounts, a session overlay a crashed
+// run (PID 1234) left behind with mounts beneath it, the overlay of a
+// running one (PID 5678), a volume with a space in its path, optional
+// fields of varying number, and a truncated line.
+const testMountinfo = `22 1 0:21 / / rw,relatime shared:1 - overlay overlay rw,lowerdir=/l,upperdir=/u,workdir=/w
+23 22 0:22 / /proc rw,nosuid,nodev,noexec,relatime shared:2 - proc proc rw
+24 22 0:23 / /tmp rw,nosuid,nodev shared:3 master:1 - tmpfs tmpfs rw,size=1024k
+40 24 0:40 / /tmp/.podman-debug-overlay-1234-1 rw,relatime - tmpfs tmpfs rw,size=1048576k
+41 40 0:41 / /tmp/.podman-debug-overlay-1234-1/merged rw,relatime - overlay overlay rw,lowerdir=/var/lib/containers/storage/overlay/abc/merged,upperdir=/tmp/.podman-debug-overlay-1234-1/upper,workdir=/tmp/.podman-debug-overlay-1234-1/work
+42 41 0:42 / /tmp/.podman-debug-overlay-1234-1/merged/my\040data rw,relatime - ext4 /dev/sda1 rw
+43 41 0:43 / /tmp/.podman-debug-overlay-1234-1/merged/.podman-debug/out rw,relatime - ext4 /dev/sda1 rw
+50 22 0:50 / /srv/my\040volume\011tab rw,relatime shared:9 - ext4 /dev/sdb1 rw
+51 22 0:51 / /tmp/.podman-debug-overlay-other rw - tmpfs tmpfs rw
+52 24 0:52 / /tmp/.podman-debug-overlay-5678-2 rw,relatime - tmpfs tmpfs rw
+53 52 0:53 / /tmp/.podman-debug-overlay-5678-2/merged/.podman-debug/out rw,relatime - ext4 /dev/sda1 rw
+60 22 0:60 / /truncated rw
+`
+
+func TestReadMountinfoFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	if err := os.WriteFile(path, []byte(testMountinfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := readMountinfoFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []mountinfoEntry{
+		{"/", "overlay", "rw,lowerdir=/l,upperdir=/u,workdir=/w"},
+		{"/proc", "proc", "rw"},
+		{"/tmp", "tmpfs", "rw,size=1024k"},
+		{"/tmp/.podman-debug-overlay-1234-1", "tmpfs", "rw,size=1048576k"},
+		{"/tmp/.podman-debug-overlay-1234-1/merged", "overlay", "rw,lowerdir=/var/lib/containers/storage/overlay/abc/merged,upperdir=/tmp/.podman-debug-overlay-1234-1/upper,workdir=/tmp/.podman-debug-overlay-1234-1/work"},
+		{"/tmp/.podman-debug-overlay-1234-1/merged/my data", "ext4", "rw"},
+		{"/tmp/.podman-debug-overlay-1234-1/merged/.podman-debug/out", "ext4", "rw"},
+		{"/srv/my volume\ttab", "ext4", "rw"},
+		{"/tmp/.podman-debug-overlay-other", "tmpfs", "rw"},
+		{"/tmp/.podman-debug-overlay-5678-2", "tmpfs", "rw"},
+		{"/tmp/.podman-debug-overlay-5678-2/merged/.podman-debug/out", "ext4", "rw"},
+	}
+	if !slices.Equal(mounts, want) {
+		t.Errorf("readMountinfoFile:\n got %q\nwant %q", mounts, want)
+	}
+
+	got := sessionMountPoints(mounts, func(pid int) bool { return pid == 1234 })
+	wantLeftover := []string{
+		"/tmp/.podman-debug-overlay-1234-1",
+		"/tmp/.podman-debug-overlay-1234-1/merged",
+		"/tmp/.podman-debug-overlay-1234-1/merged/my data",
+		"/tmp/.podman-debug-overlay-1234-1/merged/.podman-debug/out",
+	}
+	if !slices.Equal(got, wantLeftover) {
+		t.Errorf("sessionMountPoints:\n got %q\nwant %q", got, wantLeftover)
+	}
+}
+
+func TestOverlayBaseOwner(t *testing.T) {
+	tests := []struct {
+		path string
+		pid  int
+		ok   bool
+	}{
+		{"/tmp/.podman-debug-overlay-1234-1", 1234, true},
+		{"/tmp/.podman-debug-overlay-1234-12/merged/nix", 1234, true},
+		{"/tmp/.podman-debug-overlay-other", 0, false},
+		{"/tmp/.podman-debug-overlay-1234", 0, false},
+		{"/tmp/.podman-debug-overlay-0-1", 0, false},
+		{"/tmp/.podman-debug-overlay", 0, false},
+		{"/srv/data", 0, false},
+	}
+	for _, tt := range tests {
+		pid, ok := overlayBaseOwner(tt.path)
+		if pid != tt.pid || ok != tt.ok {
+			t.Errorf("overlayBaseOwner(%q) = %d, %v, want %d, %v", tt.path, pid, ok, tt.pid, tt.ok)
+		}
+	}
+
+	if pid, ok := overlayBaseOwner(newOverlayBase()); pid != os.Getpid() || !ok {
+		t.Errorf("overlayBaseOwner(newOverlayBase()) = %d, %v, want %d, true", pid, ok, os.Getpid())
+	}
+	if newOverlayBase() == newOverlayBase() {
+		t.Error("newOverlayBase returned the same path twice")
+	}
+}
+
+func TestUnescapeMountinfo(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{`/plain`, "/plain"},
+		{`/a\040b`, "/a b"},
+		{`/a\011b\012c`, "/a\tb\nc"},
+		{`/back\134slash`, `/back\slash`},
+		{`/short\04`, `/short\04`},
+		{`/not\999octal`, `/not\999octal`},
+	}
+	for _, tt := range tests {
+		if got := unescapeMountinfo(tt.in); got != tt.want {
+			t.Errorf("unescapeMountinfo(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
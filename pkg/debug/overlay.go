@@ -3,38 +3,159 @@
 package debug
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"golang.org/x/sys/unix"
 )
 
-const overlayBasePath = "/tmp/.podman-debug-overlay"
+// overlayBasePrefix starts the path of the directory a session mounts
+// the tmpfs holding its overlay on.  newOverlayBase completes it with
+// the podman-debug PID and a count, so concurrent sessions never share
+// one, and LeftoverMounts can tell a running session's from a dead
+// one's.
+const overlayBasePrefix = "/tmp/.podman-debug-overlay-"
 
-// createOverlay sets up a tmpfs-backed overlay on top of lowerDir.
-// If writable is true, the overlay is replaced with a recursive bind
-// mount of lowerDir (write-through).  Returns the merged directory path.
-func createOverlay(lowerDir string, writable bool) (string, error) {
-	if err := os.MkdirAll(overlayBasePath, 0755); err != nil {
+// overlayBases counts the overlay bases this process has handed out.
+var overlayBases atomic.Int64
+
+// newOverlayBase returns the overlay base path for a new session.
+func newOverlayBase() string {
+	return fmt.Sprintf("%s%d-%d", overlayBasePrefix, os.Getpid(), overlayBases.Add(1))
+}
+
+// overlayBaseOwner returns the PID of the podman-debug process whose
+// session's overlay base path is, or is beneath.  It reports false for
+// paths outside any overlay base.
+func overlayBaseOwner(path string) (int, bool) {
+	rest, ok := strings.CutPrefix(path, overlayBasePrefix)
+	if !ok {
+		return 0, false
+	}
+	base, _, _ := strings.Cut(rest, "/")
+	owner, count, ok := strings.Cut(base, "-")
+	if !ok {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(owner)
+	if _, cerr := strconv.Atoi(count); err != nil || cerr != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, true
+}
+
+// removeOverlayBase removes the overlay base directory of a session
+// that has ended, as seen from root: "" for the host, /proc/PID/root
+// for a live container.  The tmpfs on it went away with the session's
+// mount namespace.
+func removeOverlayBase(root, base string) {
+	_ = os.Remove(root + base)
+}
+
+// overlayDirs validates directories passed in overlayfs mount options.
+// The option string is comma-separated and lowerdir uses ':' to stack
+// layers, so paths containing either would be misparsed by the kernel.
+func overlayDirs(dirs ...string) error {
+	for _, d := range dirs {
+		if !filepath.IsAbs(d) {
+			return fmt.Errorf("overlay directory %q is not absolute", d)
+		}
+		if strings.ContainsAny(d, ",:\\\n") {
+			return fmt.Errorf("overlay directory %q contains characters overlayfs cannot parse", d)
+		}
+	}
+	return nil
+}
+
+// DefaultOverlaySize is the capacity of the tmpfs holding the session's
+// changes (and the nix store's writable layer) unless --overlay-size
+// says otherwise.
+const DefaultOverlaySize = "1G"
+
+// ValidateOverlaySize checks an --overlay-size value against what the
+// tmpfs size= option accepts: a byte count with an optional k/m/g/t
+// suffix, or a percentage of RAM.
+func ValidateOverlaySize(size string) error {
+	n := size
+	if strings.HasSuffix(n, "%") {
+		n = strings.TrimSuffix(n, "%")
+	} else if n != "" && strings.ContainsRune("kKmMgGtT", rune(n[len(n)-1])) {
+		n = n[:len(n)-1]
+	}
+	if v, err := strconv.ParseUint(n, 10, 64); err != nil || v == 0 {
+		return fmt.Errorf("invalid overlay size %q: expected a size such as 512M, 4G, or 50%%", size)
+	}
+	return nil
+}
+
+// createOverlay sets up a tmpfs-backed overlay at base on top of lowerDirs,
+// the first of which is the target's root and wins conflicts with the
+// rest.  If writable is true, the overlay is replaced with a recursive
+// bind mount of lowerDirs[0] (write-through).  upperDir and workDir
+// name host directories to use instead of the tmpfs ones, so changes
+// outlive the session; both or neither must be set.  size is the
+// tmpfs capacity, "" for DefaultOverlaySize.  Returns the merged
+// directory path.
+func createOverlay(base string, lowerDirs []string, writable bool, upperDir, workDir, size string) (string, error) {
+	if size == "" {
+		size = DefaultOverlaySize
+	}
+	if err := ValidateOverlaySize(size); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(base, 0755); err != nil {
 		return "", fmt.Errorf("creating overlay base: %w", err)
 	}
-	if err := unix.Mount("tmpfs", overlayBasePath, "tmpfs", 0, "size=1G"); err != nil {
-		return "", fmt.Errorf("mounting tmpfs: %w", err)
+	// Only a dead run whose PID this one now has can have left
+	// anything there.
+	if err := clearStaleMounts(base); err != nil {
+		return "", err
+	}
+	if err := unix.Mount("tmpfs", base, "tmpfs", 0, "size="+size); err != nil {
+		return "", fmt.Errorf("mounting tmpfs (size=%s): %w", size, err)
 	}
 
-	upperDir := overlayBasePath + "/upper"
-	workDir := overlayBasePath + "/work"
-	mergedDir := overlayBasePath + "/merged"
+	lowers := make([]string, len(lowerDirs))
+	for i, d := range lowerDirs {
+		lowers[i] = filepath.Clean(d)
+	}
+	lowerDir := lowers[0]
+	if upperDir == "" {
+		upperDir = filepath.Join(base, "upper")
+		workDir = filepath.Join(base, "work")
+	} else {
+		for _, d := range lowers {
+			if err := checkPersistentDirs(d, upperDir, workDir); err != nil {
+				return "", err
+			}
+		}
+	}
+	mergedDir := filepath.Join(base, "merged")
+	if err := overlayDirs(append(lowers, upperDir, workDir)...); err != nil {
+		return "", err
+	}
 	for _, d := range []string{upperDir, workDir, mergedDir} {
 		if err := os.MkdirAll(d, 0755); err != nil {
 			return "", fmt.Errorf("creating %s: %w", d, err)
 		}
 	}
 
-	overlayOpts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDir, upperDir, workDir)
+	overlayOpts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"), upperDir, workDir)
 	if err := unix.Mount("overlay", mergedDir, "overlay", 0, overlayOpts); err != nil {
-		return "", fmt.Errorf("mounting overlay: %w", err)
+		if !isOverlay(lowerDir) {
+			return "", fmt.Errorf("mounting overlay: %w", err)
+		}
+		// The target's root is itself an overlay and this kernel
+		// won't stack on it; use its layers directly instead.
+		if ferr := mountFlattenedOverlay(lowerDir, lowers[1:], upperDir, workDir, mergedDir); ferr != nil {
+			return "", fmt.Errorf("mounting overlay: %s is itself an overlay and the kernel refused to stack on it (%v); mounting its layers directly also failed: %w", lowerDir, err, ferr)
+		}
 	}
 
 	if writable {
@@ -46,11 +167,216 @@ func createOverlay(lowerDir string, writable bool) (string, error) {
 	return mergedDir, nil
 }
 
+// overlayUpperDir returns the overlay upper directory of the session
+// with the given overlay base.
+func overlayUpperDir(base string, opts *Options) string {
+	if opts.UpperDir != "" {
+		return opts.UpperDir
+	}
+	return filepath.Join(base, "upper")
+}
+
+// CheckHostMountDest rejects a --mount-ro destination that would
+// shadow the whole root or the session's own /nix or /.podman-debug.
+func CheckHostMountDest(dest string) error {
+	if !filepath.IsAbs(dest) {
+		return fmt.Errorf("%s is not an absolute path", dest)
+	}
+	dest = filepath.Clean(dest)
+	if dest == "/" {
+		return fmt.Errorf("cannot mount over /")
+	}
+	for _, reserved := range []string{"/nix", metadataDir} {
+		if dest == reserved || strings.HasPrefix(dest, reserved+"/") {
+			return fmt.Errorf("%s would shadow the session's %s", dest, reserved)
+		}
+	}
+	return nil
+}
+
+// hostMountTree is a HostMount cloned while its host path is still
+// reachable, to be attached once the session is set up.
+type hostMountTree struct {
+	HostMount
+	fd       int
+	dir      bool
+	readOnly bool // already made read-only with mount_setattr
+}
+
+// openHostMounts clones each host path recursively and makes the clone
+// read-only where the kernel supports it (Linux 5.12+).  Callers close
+// the trees with closeHostMounts.
+func openHostMounts(mounts []HostMount) ([]hostMountTree, error) {
+	var trees []hostMountTree
+	for _, m := range mounts {
+		info, err := os.Stat(m.Source)
+		if err != nil {
+			closeHostMounts(trees)
+			return nil, fmt.Errorf("--mount-ro: %w", err)
+		}
+		fd, err := unix.OpenTree(unix.AT_FDCWD, m.Source, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+		if err != nil {
+			closeHostMounts(trees)
+			return nil, fmt.Errorf("--mount-ro: open_tree(%s): %w", m.Source, err)
+		}
+		attr := &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}
+		readOnly := unix.MountSetattr(fd, "", unix.AT_EMPTY_PATH|unix.AT_RECURSIVE, attr) == nil
+		trees = append(trees, hostMountTree{HostMount: m, fd: fd, dir: info.IsDir(), readOnly: readOnly})
+	}
+	return trees, nil
+}
+
+func closeHostMounts(trees []hostMountTree) {
+	for _, t := range trees {
+		unix.Close(t.fd)
+	}
+}
+
+// attachHostMounts attaches the cloned trees at their destinations in
+// mergedDir, creating missing mount points.  Destinations are resolved
+// inside mergedDir so a symlink in the target cannot redirect a mount
+// onto the host.  Without mount_setattr only the top of each tree can
+// be made read-only, after attaching it.
+func attachHostMounts(mergedDir string, trees []hostMountTree) error {
+	for _, t := range trees {
+		target, err := resolveForCreate(mergedDir, t.Dest)
+		if err != nil {
+			return fmt.Errorf("--mount-ro %s: %w", t.Dest, err)
+		}
+		if t.dir {
+			err = os.MkdirAll(target, 0755)
+		} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			err = createMountFile(target)
+		}
+		if err != nil {
+			return fmt.Errorf("--mount-ro %s: creating mount point: %w", t.Dest, err)
+		}
+		if err := unix.MoveMount(t.fd, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+			return fmt.Errorf("--mount-ro: attaching %s at %s: %w", t.Source, t.Dest, err)
+		}
+		if !t.readOnly {
+			if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+				_ = unix.Unmount(target, unix.MNT_DETACH)
+				return fmt.Errorf("--mount-ro %s: making read-only: %w", t.Dest, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Where the diff builtin finds the session overlay's upper directory
+// and the target's own root, without the session's changes.
+const (
+	diffUpperDir = "/.podman-debug/upper"
+	diffLowerDir = "/.podman-debug/lower"
+)
+
+// mountDiffViews binds the overlay's upper directory and the target's
+// root lowerDir read-only into the session for the diff builtin.  The
+// lower bind is not recursive: only the target's own files matter.
+// Like the other session mounts this is best-effort; the diff builtin
+// reports when the views are missing.
+func mountDiffViews(mergedDir, upperDir, lowerDir string) {
+	for _, view := range []struct{ source, dest string }{
+		{lowerDir, diffLowerDir},
+		{upperDir, diffUpperDir},
+	} {
+		target := mergedDir + view.dest
+		if err := os.MkdirAll(target, 0755); err != nil {
+			Log.Warn("diff builtin unavailable: %v.", err)
+			return
+		}
+		if err := unix.Mount(view.source, target, "", unix.MS_BIND, ""); err != nil {
+			Log.Warn("diff builtin unavailable: binding %s: %v.", view.source, err)
+			_ = os.Remove(target)
+			return
+		}
+		if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+			_ = unix.Unmount(target, unix.MNT_DETACH)
+			_ = os.Remove(target)
+			Log.Warn("diff builtin unavailable: making %s read-only: %v.", view.dest, err)
+			return
+		}
+	}
+}
+
+// checkPersistentDirs validates --upperdir and --workdir: they must be
+// distinct absolute paths on one filesystem that overlayfs accepts as
+// an upper layer, and neither may sit inside the lower layer (or the
+// overlay would be stacked on its own changes).  Missing directories
+// are created.
+func checkPersistentDirs(lowerDir, upperDir, workDir string) error {
+	if upperDir == "" || workDir == "" {
+		return fmt.Errorf("--upperdir and --workdir must be given together")
+	}
+	for _, d := range []string{upperDir, workDir} {
+		if !filepath.IsAbs(d) {
+			return fmt.Errorf("overlay directory %q is not absolute", d)
+		}
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return fmt.Errorf("creating %s: %w", d, err)
+		}
+	}
+
+	upper, err := filepath.EvalSymlinks(upperDir)
+	if err != nil {
+		return err
+	}
+	work, err := filepath.EvalSymlinks(workDir)
+	if err != nil {
+		return err
+	}
+	lower, err := filepath.EvalSymlinks(lowerDir)
+	if err != nil {
+		return err
+	}
+	if upper == work || isWithin(upper, work) || isWithin(work, upper) {
+		return fmt.Errorf("--upperdir %s and --workdir %s must not overlap", upperDir, workDir)
+	}
+	for _, d := range []string{upper, work} {
+		if d == lower || isWithin(lower, d) {
+			return fmt.Errorf("overlay directory %s is inside the target filesystem %s", d, lowerDir)
+		}
+	}
+
+	var su, sw unix.Stat_t
+	if err := unix.Stat(upper, &su); err != nil {
+		return err
+	}
+	if err := unix.Stat(work, &sw); err != nil {
+		return err
+	}
+	if su.Dev != sw.Dev {
+		return fmt.Errorf("--upperdir %s and --workdir %s must be on the same filesystem", upperDir, workDir)
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(upper, &st); err != nil {
+		return err
+	}
+	switch st.Type {
+	case unix.OVERLAYFS_SUPER_MAGIC, unix.NFS_SUPER_MAGIC, unix.FUSE_SUPER_MAGIC:
+		return fmt.Errorf("--upperdir %s is on a filesystem overlayfs cannot use as an upper layer", upperDir)
+	}
+	return nil
+}
+
+// isWithin reports whether path lies strictly beneath dir.
+func isWithin(dir, path string) bool {
+	return dir == "/" && path != "/" || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
 // mountNixStore moves the cloned nix tree FD into a temporary mount
 // point, then sets up a writable overlay on top so nix operations
 // (profile installs, etc.) work inside the debug session.
 func mountNixStore(nixTreeFD int, nixMountPoint, base string) error {
-	nixTmpMount := base + "/nix-lower"
+	nixTmpMount := filepath.Join(base, "nix-lower")
+	nixUpperDir := filepath.Join(base, "nix-upper")
+	nixWorkDir := filepath.Join(base, "nix-work")
+	if err := overlayDirs(nixTmpMount, nixUpperDir, nixWorkDir); err != nil {
+		return err
+	}
+
 	if err := os.MkdirAll(nixTmpMount, 0755); err != nil {
 		return fmt.Errorf("creating nix temp mount: %w", err)
 	}
@@ -59,8 +385,6 @@ func mountNixStore(nixTreeFD int, nixMountPoint, base string) error {
 		return fmt.Errorf("move_mount nix to temp: %w", err)
 	}
 
-	nixUpperDir := base + "/nix-upper"
-	nixWorkDir := base + "/nix-work"
 	for _, d := range []string{nixUpperDir, nixWorkDir} {
 		if err := os.MkdirAll(d, 0755); err != nil {
 			return fmt.Errorf("creating %s: %w", d, err)
@@ -74,70 +398,276 @@ func mountNixStore(nixTreeFD int, nixMountPoint, base string) error {
 	return nil
 }
 
-// bindHostMounts bind-mounts /proc, /sys, /dev and network config
-// files from the host (or container, depending on which mount namespace
-// we are in) into the merged overlay directory.
+// bindHostMounts bind-mounts /proc, /sys, and /dev from the host (or
+// container, depending on which mount namespace we are in) into the
+// merged overlay directory.  Mount points are resolved inside
+// mergedDir, so a symlink the target planted at /proc, /sys, or /dev
+// cannot redirect a mount onto the host.
 //
 // In live mode we are inside the container's mount namespace, so the
 // bind-mounted /proc already reflects the container's PID namespace.
-func bindHostMounts(mergedDir string) {
-	for _, mp := range []string{"/proc", "/sys", "/dev"} {
-		target := mergedDir + mp
+//
+// With minimalDev, /dev is populated by mountMinimalDev instead of a
+// recursive bind.
+func bindHostMounts(mergedDir string, minimalDev bool) {
+	mounts := []string{"/proc", "/sys", "/dev"}
+	if minimalDev {
+		mounts = mounts[:2]
+		mountMinimalDev(mergedDir)
+	}
+	bindHostPaths(mergedDir, mounts)
+}
+
+// bindHostPaths recursively binds each of the host directories paths
+// at the same path in mergedDir, resolved inside it.  A path that is
+// missing on the host or can't be bound is skipped.
+func bindHostPaths(mergedDir string, paths []string) {
+	for _, mp := range paths {
 		if _, err := os.Stat(mp); err != nil {
 			continue
 		}
+		target, err := resolveForCreate(mergedDir, mp)
+		if err != nil {
+			continue
+		}
 		if err := os.MkdirAll(target, 0755); err != nil {
 			continue
 		}
 		_ = unix.Mount(mp, target, "", unix.MS_BIND|unix.MS_REC, "")
 	}
-
-	bindNetworkConfig(mergedDir)
 }
 
-// bindSnapshotMounts sets up /sys, /dev, and network config in the
+// bindSnapshotMounts sets up /sys and /dev in the
 // overlay for snapshot/image mode.  /proc is NOT mounted here because
 // snapshot mode uses CLONE_NEWPID on the shell process and mounts a
 // fresh /proc from within the new PID namespace so that only the
-// debug session's own processes are visible.
-func bindSnapshotMounts(mergedDir string) {
+// debug session's own processes are visible.  With hostPID the shell
+// stays in the host PID namespace, so the host /proc is bound instead.
+func bindSnapshotMounts(mergedDir string, minimalDev, hostPID, restrictSys bool) {
 	// Create an empty /proc mountpoint — the shell wrapper will mount
 	// a fresh procfs from within the new PID namespace.
-	_ = os.MkdirAll(mergedDir+"/proc", 0755)
+	if proc, err := resolveForCreate(mergedDir, "/proc"); err == nil {
+		_ = os.MkdirAll(proc, 0755)
+	}
 
-	for _, mp := range []string{"/sys", "/dev"} {
-		target := mergedDir + mp
-		if _, err := os.Stat(mp); err != nil {
+	mounts := []string{"/sys", "/dev"}
+	if restrictSys {
+		mounts = mounts[1:]
+		mountRestrictedSys(mergedDir)
+	}
+	if minimalDev {
+		mounts = slices.DeleteFunc(mounts, func(mp string) bool { return mp == "/dev" })
+		mountMinimalDev(mergedDir)
+	}
+	if hostPID {
+		mounts = append(mounts, "/proc")
+	}
+	bindHostPaths(mergedDir, mounts)
+}
+
+// mountRestrictedSys gives the session a read-only /sys without the
+// host's submounts (cgroupfs, debugfs, securityfs, ...): a fresh sysfs
+// where we may mount one, otherwise a non-recursive read-only bind of
+// the host's.  If neither works /sys is left empty rather than falling
+// back to the full host bind.
+func mountRestrictedSys(mergedDir string) {
+	target, err := resolveForCreate(mergedDir, "/sys")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return
+	}
+	flags := uintptr(unix.MS_RDONLY | unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC)
+	if err := unix.Mount("sysfs", target, "sysfs", flags, ""); err == nil {
+		return
+	}
+	// sysfs can only be mounted by the owner of the network namespace,
+	// which a rootless session is not.
+	if err := unix.Mount("/sys", target, "", unix.MS_BIND, ""); err != nil {
+		return
+	}
+	if err := unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|flags, ""); err != nil {
+		_ = unix.Unmount(target, unix.MNT_DETACH)
+	}
+}
+
+// minimalDevices are the host device nodes bound into a --minimal-dev
+// /dev.  Everything else (block devices, GPUs, ...) stays hidden.
+var minimalDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// mountMinimalDev builds a small /dev in the overlay instead of
+// exposing the whole host /dev: a tmpfs holding bind mounts of the
+// devices in minimalDevices, a private devpts instance (so the session
+// pty is not allocated from the host's), a /dev/shm, and the usual
+// /proc/self/fd symlinks.  Failures are best-effort like the other bind
+// mounts; an incomplete /dev never exposes more than the minimal set.
+func mountMinimalDev(mergedDir string) {
+	// Everything else is created on the fresh tmpfs, with nothing of
+	// the target's in it to follow.
+	devDir, err := resolveForCreate(mergedDir, "/dev")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(devDir, 0755); err != nil {
+		return
+	}
+	if err := unix.Mount("tmpfs", devDir, "tmpfs", unix.MS_NOSUID|unix.MS_NOEXEC, "mode=755,size=65536k"); err != nil {
+		return
+	}
+
+	for _, name := range minimalDevices {
+		src := filepath.Join("/dev", name)
+		if _, err := os.Stat(src); err != nil {
 			continue
 		}
-		if err := os.MkdirAll(target, 0755); err != nil {
+		target := filepath.Join(devDir, name)
+		f, err := os.Create(target)
+		if err != nil {
 			continue
 		}
-		_ = unix.Mount(mp, target, "", unix.MS_BIND|unix.MS_REC, "")
+		f.Close()
+		_ = unix.Mount(src, target, "", unix.MS_BIND, "")
+	}
+
+	ptsDir := filepath.Join(devDir, "pts")
+	if err := os.MkdirAll(ptsDir, 0755); err == nil {
+		if err := unix.Mount("devpts", ptsDir, "devpts", unix.MS_NOSUID|unix.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"); err == nil {
+			_ = os.Symlink("pts/ptmx", filepath.Join(devDir, "ptmx"))
+		}
+	}
+
+	shmDir := filepath.Join(devDir, "shm")
+	if err := os.MkdirAll(shmDir, 01777); err == nil {
+		_ = unix.Mount("shm", shmDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777,size=65536k")
 	}
 
-	bindNetworkConfig(mergedDir)
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		_ = os.Symlink(target, filepath.Join(devDir, name))
+	}
 }
 
 // bindNetworkConfig bind-mounts /etc/resolv.conf, /etc/hosts, and
-// /etc/hostname into the overlay so DNS resolution works.
-func bindNetworkConfig(mergedDir string) {
+// /etc/hostname from the current mount namespace into the merged
+// overlay so DNS resolution works, or the session's own version of a
+// file where opts asks for one (see networkOverrides).  Without a
+// network it binds nothing.
+func bindNetworkConfig(mergedDir string, opts *Options) {
+	if opts.NoNetwork {
+		// Nothing to resolve names with; the target's own files stay.
+		return
+	}
+	overrides := networkOverrides(opts)
 	for _, configFile := range []string{"/etc/resolv.conf", "/etc/hosts", "/etc/hostname"} {
+		if content, ok := overrides[configFile]; ok {
+			bindGenerated(mergedDir, configFile, content)
+			continue
+		}
 		info, err := os.Stat(configFile)
 		if err != nil || info.Size() == 0 {
 			continue
 		}
-		target := mergedDir + configFile
-		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		target, err := bindTarget(mergedDir, configFile)
+		if err != nil {
 			continue
 		}
-		if _, err := os.Stat(target); os.IsNotExist(err) {
-			f, err := os.Create(target)
-			if err != nil {
-				continue
-			}
-			f.Close()
-		}
 		_ = unix.Mount(configFile, target, "", unix.MS_BIND, "")
 	}
 }
+
+// bindNetworkOverrides binds just the session's own network config
+// files, for --writable, where the target's are already in place.
+func bindNetworkOverrides(mergedDir string, opts *Options) {
+	for configFile, content := range networkOverrides(opts) {
+		bindGenerated(mergedDir, configFile, content)
+	}
+}
+
+// networkOverrides returns the network config files opts gives the
+// session its own version of, by path: /etc/hosts with ExtraHosts
+// appended to the current entries, and /etc/resolv.conf with
+// Nameservers in place of the current ones.
+func networkOverrides(opts *Options) map[string][]byte {
+	overrides := map[string][]byte{}
+	if len(opts.Nameservers) > 0 {
+		overrides["/etc/resolv.conf"] = resolvConf(opts.Nameservers)
+	}
+	if len(opts.ExtraHosts) > 0 {
+		hosts, _ := os.ReadFile("/etc/hosts")
+		if len(hosts) > 0 && !bytes.HasSuffix(hosts, []byte("\n")) {
+			hosts = append(hosts, '\n')
+		}
+		hosts = append(hosts, "# added by podman-debug --add-host\n"...)
+		for _, entry := range opts.ExtraHosts {
+			hosts = append(hosts, entry+"\n"...)
+		}
+		overrides["/etc/hosts"] = hosts
+	}
+	return overrides
+}
+
+// resolvConf returns the current /etc/resolv.conf with its nameserver
+// lines replaced by nameservers.  Search domains and options are kept.
+func resolvConf(nameservers []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("# generated by podman-debug --dns\n")
+	for _, ns := range nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	current, _ := os.ReadFile("/etc/resolv.conf")
+	for line := range strings.Lines(string(current)) {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] != "nameserver" && !strings.HasPrefix(fields[0], "#") && !strings.HasPrefix(fields[0], ";") {
+			b.WriteString(strings.TrimRight(line, "\n") + "\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// bindGenerated writes content to a file on the session's tmpfs,
+// beside the merged root, and binds it over configFile in the overlay.  Writing through the
+// overlay instead could reach the target's own file: in live mode its
+// /etc/hosts and the like are bind mounts.
+func bindGenerated(mergedDir, configFile string, content []byte) {
+	generated := filepath.Join(filepath.Dir(mergedDir), "etc", filepath.Base(configFile))
+	if err := os.MkdirAll(filepath.Dir(generated), 0755); err != nil {
+		Log.Warn("cannot set up the session's %s: %v", configFile, err)
+		return
+	}
+	if err := os.WriteFile(generated, content, 0644); err != nil {
+		Log.Warn("cannot set up the session's %s: %v", configFile, err)
+		return
+	}
+	target, err := bindTarget(mergedDir, configFile)
+	if err == nil {
+		err = unix.Mount(generated, target, "", unix.MS_BIND, "")
+	}
+	if err != nil {
+		Log.Warn("cannot set up the session's %s: %v", configFile, err)
+	}
+}
+
+// bindTarget returns configFile's path in the overlay, resolved inside
+// it so that a symlink in the target's /etc cannot point the bind at a
+// host file, creating an empty file there to bind over if it has none.
+func bindTarget(mergedDir, configFile string) (string, error) {
+	target, err := resolveForCreate(mergedDir, configFile)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		f, err := os.Create(target)
+		if err != nil {
+			return "", err
+		}
+		f.Close()
+	}
+	return target, nil
+}
@@ -0,0 +1,99 @@
+//go:build linux
+
+package debug
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// isOverlay reports whether path is on an overlayfs mount, as the root
+// of a podman container usually is.
+func isOverlay(path string) bool {
+	var st unix.Statfs_t
+	return unix.Statfs(path, &st) == nil && st.Type == unix.OVERLAYFS_SUPER_MAGIC
+}
+
+// mountFlattenedOverlay mounts the session overlay at mergedDir using
+// the layers of lowerDir's own overlay as its lower layers, followed by
+// below, instead of stacking on the overlay itself.  Some kernels refuse
+// overlay-on-overlay; the flattened stack shows the same files without
+// nesting.
+func mountFlattenedOverlay(lowerDir string, below []string, upperDir, workDir, mergedDir string) error {
+	mounts, err := readMountinfo()
+	if err != nil {
+		return err
+	}
+	layers, err := flattenedLayers(mounts, lowerDir, below)
+	if err != nil {
+		return err
+	}
+	if err := overlayDirs(layers...); err != nil {
+		return err
+	}
+	overlayOpts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(layers, ":"), upperDir, workDir)
+	return unix.Mount("overlay", mergedDir, "overlay", 0, overlayOpts)
+}
+
+// flattenedLayers returns the lower layers mountFlattenedOverlay
+// mounts in place of lowerDir: the layers of the overlay mounts shows
+// at lowerDir, followed by below.
+func flattenedLayers(mounts []mountinfoEntry, lowerDir string, below []string) ([]string, error) {
+	layers, err := overlayLayers(mounts, lowerDir)
+	if err != nil {
+		return nil, err
+	}
+	return append(layers, below...), nil
+}
+
+// overlayLayers returns the layers of the overlay mounts shows at dir,
+// top first: its upper directory, if any, followed by its lower ones.
+// The layers come from the mount's options in mountinfo.
+func overlayLayers(mounts []mountinfoEntry, dir string) ([]string, error) {
+	// Later entries are mounted over earlier ones, so the last match
+	// is the overlay that is visible at dir.
+	var superOpts string
+	found := false
+	for _, m := range mounts {
+		if m.mountPoint == dir {
+			found = m.fsType == "overlay"
+			superOpts = m.superOpts
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no overlay mount found at %s", dir)
+	}
+
+	var upper string
+	var lower []string
+	for _, opt := range strings.Split(superOpts, ",") {
+		k, v, _ := strings.Cut(opt, "=")
+		switch k {
+		case "upperdir":
+			upper = unescapeMountinfo(v)
+		case "lowerdir":
+			for _, l := range strings.Split(v, ":") {
+				lower = append(lower, unescapeMountinfo(l))
+			}
+		}
+	}
+	layers := lower
+	if upper != "" {
+		layers = append([]string{upper}, lower...)
+	}
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("overlay at %s does not list its layers", dir)
+	}
+	for _, l := range layers {
+		// containers/storage uses layer paths relative to its own
+		// working directory when the absolute ones would not fit.
+		if !filepath.IsAbs(l) {
+			return nil, fmt.Errorf("overlay at %s uses relative layer path %q", dir, l)
+		}
+	}
+	return layers, nil
+}
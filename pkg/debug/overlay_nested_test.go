@@ -0,0 +1,96 @@
+//go:build linux
+
+package debug
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// nestedMountinfo has a stopped container's root mounted by podman as
+// an overlay with a space in a layer path, an image mounted read-only
+// (lower layers only), an overlay later covered by a bind mount, and
+// one whose layers are relative to containers/storage's directory.
+const nestedMountinfo = `22 1 0:21 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+30 22 0:30 / /var/lib/containers/storage/overlay/abc/merged rw,relatime - overlay overlay rw,lowerdir=/var/lib/containers/storage/overlay/l/A:/var/lib/containers/storage/overlay/l/my\040B,upperdir=/var/lib/containers/storage/overlay/abc/diff,workdir=/var/lib/containers/storage/overlay/abc/work
+31 22 0:31 / /var/lib/containers/storage/overlay/img/merged ro,relatime - overlay overlay ro,lowerdir=/var/lib/containers/storage/overlay/l/C:/var/lib/containers/storage/overlay/l/D
+32 22 0:32 / /covered rw,relatime - overlay overlay rw,lowerdir=/l/E,upperdir=/u,workdir=/w
+33 22 8:1 /srv /covered rw,relatime - ext4 /dev/sda1 rw
+34 22 0:34 / /relative rw,relatime - overlay overlay rw,lowerdir=l/F:l/G,upperdir=/u,workdir=/w
+`
+
+func TestFlattenedLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	if err := os.WriteFile(path, []byte(nestedMountinfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := readMountinfoFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const storage = "/var/lib/containers/storage/overlay"
+	debugRoot := "/tmp/fs/dbg"
+	tests := []struct {
+		lowerDir string
+		below    []string
+		want     []string
+		err      string // a substring of the error, "" for none
+	}{
+		{
+			lowerDir: storage + "/abc/merged",
+			want:     []string{storage + "/abc/diff", storage + "/l/A", storage + "/l/my B"},
+		},
+		{
+			// --layer-debug-image puts the debug image below the target.
+			lowerDir: storage + "/abc/merged",
+			below:    []string{debugRoot},
+			want:     []string{storage + "/abc/diff", storage + "/l/A", storage + "/l/my B", debugRoot},
+		},
+		{
+			lowerDir: storage + "/img/merged",
+			want:     []string{storage + "/l/C", storage + "/l/D"},
+		},
+		{lowerDir: "/covered", err: "no overlay mount found at /covered"},
+		{lowerDir: "/relative", err: `relative layer path "l/F"`},
+		{lowerDir: "/", err: "no overlay mount found at /"},
+	}
+	for _, tt := range tests {
+		got, err := flattenedLayers(mounts, tt.lowerDir, tt.below)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("flattenedLayers(%s): %v", tt.lowerDir, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("flattenedLayers(%s) error = %v, want one containing %q", tt.lowerDir, err, tt.err)
+		case !slices.Equal(got, tt.want):
+			t.Errorf("flattenedLayers(%s) =\n %q\nwant\n %q", tt.lowerDir, got, tt.want)
+		}
+	}
+}
+
+func TestIsOverlay(t *testing.T) {
+	if isOverlay("/proc") {
+		t.Error("isOverlay(/proc) = true")
+	}
+	// Whatever overlays this host shows must be detected as such;
+	// later mounts cover earlier ones at the same point.
+	mounts, err := readMountinfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	visible := map[string]string{}
+	for _, m := range mounts {
+		visible[m.mountPoint] = m.fsType
+	}
+	for mp, fsType := range visible {
+		if _, err := os.Stat(mp); err != nil || fsType != "overlay" {
+			continue
+		}
+		if !isOverlay(mp) {
+			t.Errorf("isOverlay(%s) = false for an overlay mount", mp)
+		}
+	}
+}
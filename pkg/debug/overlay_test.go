@@ -0,0 +1,57 @@
+//go:build linux
+
+package debug
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBindTargetStaysInRoot(t *testing.T) {
+	root := testRoot(t)
+	tests := []struct {
+		configFile string
+		want       string // relative to root
+	}{
+		{"/etc/hosts", "etc/hosts"},
+		{"/etc/resolv.conf", "etc/hosts"},
+		{"/etc/hostname", "etc/hosts"},
+		{"/etc/localtime", "etc/localtime"},
+	}
+	for _, tt := range tests {
+		got, err := bindTarget(root, tt.configFile)
+		if err != nil {
+			t.Fatalf("bindTarget(%q): %v", tt.configFile, err)
+		}
+		if want := filepath.Join(root, tt.want); got != want {
+			t.Errorf("bindTarget(%q) = %q, want %q", tt.configFile, got, want)
+		}
+		if _, err := os.Stat(got); err != nil {
+			t.Errorf("bindTarget(%q) did not create %s: %v", tt.configFile, got, err)
+		}
+	}
+}
+
+func TestOverlayDirs(t *testing.T) {
+	tests := []struct {
+		dir     string
+		wantErr bool
+	}{
+		{"/tmp/.podman-debug-overlay-1234-1/upper", false},
+		{"/var/lib/containers/storage/overlay/abc/merged", false},
+		{"/with space", false},
+		{"relative/upper", true},
+		{"", true},
+		{"/a,lowerdir=/etc", true},
+		{"/a:/b", true},
+		{"/a\\b", true},
+		{"/a\nb", true},
+	}
+	for _, tt := range tests {
+		err := overlayDirs(tt.dir)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("overlayDirs(%q) error = %v, want error %v", tt.dir, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+//go:build linux
+
+package debug
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rsturla/podman-debug/pkg/podman"
+)
+
+// Plan describes, one step per entry, the namespace and mount
+// operations a session with opts would perform and the command it
+// would start, without performing any of them, for --dry-run.  pid is
+// the container process in live mode; rootfs is where the target's
+// filesystem is mounted otherwise, which need not exist yet.  shell
+// may be a placeholder when it is only chosen at session start.  It
+// follows the decisions ExecLive and ExecSnapshot make, so a change to
+// either needs one here too.
+func Plan(pid int, rootfs, shell string, shellArgs []string, opts *Options) []string {
+	var steps []string
+	step := func(format string, args ...any) {
+		steps = append(steps, fmt.Sprintf(format, args...))
+	}
+
+	size := opts.OverlaySize
+	if size == "" {
+		size = DefaultOverlaySize
+	}
+	// N counts the sessions this run has started.
+	base := fmt.Sprintf("%s%d-N", overlayBasePrefix, os.Getpid())
+	mergedDir := filepath.Join(base, "merged")
+	upperDir, workDir := filepath.Join(base, "upper"), filepath.Join(base, "work")
+	if opts.UpperDir != "" {
+		upperDir, workDir = opts.UpperDir, opts.WorkDir
+	}
+
+	if len(opts.CgroupLimits) > 0 {
+		step("create a session cgroup with the resource limits")
+	}
+	step("unshare a private mount namespace")
+
+	if opts.Mode == ModeLive {
+		pidNS := podman.NamespacePath(pid, "pid")
+		if same, _ := sameNamespace(pidNS, "/proc/self/ns/pid"); same {
+			step("skip the PID namespace: the container shares the host's")
+		} else {
+			step("setns %s (pid)", pidNS)
+		}
+		step("setns %s (mnt)", podman.NamespacePath(pid, "mnt"))
+		step("unshare a private copy of the container's mount namespace; make / private")
+		joined := []string{"net"}
+		if !opts.NoJoinIPC {
+			joined = append(joined, "ipc")
+		}
+		if !opts.NoJoinUTS {
+			joined = append(joined, "uts")
+		}
+		for _, ns := range joined {
+			step("setns %s (%s)", podman.NamespacePath(pid, ns), ns)
+		}
+		rootfs = "/"
+	} else {
+		step("make / private")
+	}
+
+	step("mount tmpfs at %s (size=%s)", base, size)
+	if opts.Mode == ModeLive && opts.Writable {
+		step("bind %s (the container's root) at %s, writing through to the container", rootfs, mergedDir)
+	} else {
+		lowers := []string{rootfs}
+		if opts.LayerDebugImage && opts.Mode != ModeLive {
+			lowers = append(lowers, "(the debug image's root)")
+		}
+		step("mount overlay at %s (lowerdir=%s, upperdir=%s, workdir=%s)", mergedDir, strings.Join(lowers, ":"), upperDir, workDir)
+	}
+	step("mount an overlay of the debug image's /nix at %s/nix", mergedDir)
+
+	if opts.Mode == ModeLive {
+		if !opts.Writable {
+			dev := "/dev"
+			if opts.MinimalDev {
+				dev = "a minimal /dev tmpfs"
+			}
+			step("bind /proc, /sys, and %s into %s", dev, mergedDir)
+		}
+	} else {
+		mounts := []string{"/sys", "/dev"}
+		if opts.RestrictSys {
+			mounts[0] = "a read-only sysfs"
+		}
+		if opts.MinimalDev {
+			mounts[1] = "a minimal /dev tmpfs"
+		}
+		if opts.HostPID {
+			mounts = append(mounts, "/proc")
+		}
+		step("bind %s into %s", strings.Join(mounts, " and "), mergedDir)
+	}
+
+	if !opts.NoNetwork {
+		if opts.Mode == ModeLive && opts.Writable {
+			for _, configFile := range slices.Sorted(maps.Keys(networkOverrides(opts))) {
+				step("bind a generated %s into %s", configFile, mergedDir)
+			}
+		} else {
+			step("bind /etc/resolv.conf, /etc/hosts, and /etc/hostname into %s", mergedDir)
+		}
+	}
+
+	if opts.Mode == ModeSnapshot && !opts.NoVolumes {
+		for _, m := range opts.Mounts {
+			switch {
+			case m.Type == "tmpfs":
+				step("mount tmpfs at %s%s", mergedDir, m.Destination)
+			case opts.WritableVolumes && m.RW:
+				step("bind %s %s at %s%s", m.Type, m.Source, mergedDir, m.Destination)
+			default:
+				step("bind %s %s read-only at %s%s", m.Type, m.Source, mergedDir, m.Destination)
+			}
+		}
+	}
+	for _, m := range opts.HostMounts {
+		step("bind %s read-only at %s%s", m.Source, mergedDir, m.Dest)
+	}
+
+	step("write the builtins to %s%s", mergedDir, builtinsDir)
+	if opts.CopyOut != "" {
+		step("bind %s at %s%s/out", opts.CopyOut, mergedDir, metadataDir)
+	}
+	step("chroot %s", mergedDir)
+	if opts.NoNetwork {
+		step("unshare a network namespace with only loopback")
+	}
+	if opts.PostInstall != "" {
+		step("run %s -c %q", shell, opts.PostInstall)
+	}
+
+	command := append([]string{shell}, shellArgs...)
+	if len(opts.Argv) > 0 {
+		command = slices.Clone(opts.Argv)
+	}
+	for i, a := range command {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"$\\") {
+			command[i] = fmt.Sprintf("%q", a)
+		}
+	}
+	pidns := ""
+	if usesPIDNSWrapper(opts) {
+		pidns = " (in a new PID namespace, with a fresh /proc)"
+	}
+	dir := opts.Cwd
+	if dir == "" {
+		dir = "/"
+	}
+	user := opts.User
+	if user == "" {
+		user = "root"
+	}
+	step("exec %s as %s in %s%s", strings.Join(command, " "), user, dir, pidns)
+	if opts.Timeout > 0 {
+		step("end it with SIGTERM, then SIGKILL, if it is still running after %s", opts.Timeout)
+	}
+	return steps
+}
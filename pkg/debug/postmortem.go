@@ -0,0 +1,106 @@
+//go:build linux
+
+package debug
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// holdForInspection is called on the session thread when setup fails
+// and --no-cleanup-on-error is set.  The session's mounts only live in
+// this thread's private mount namespace, so instead of returning (which
+// tears everything down) it prints where to look, beneath the
+// session's overlay base, and blocks until the user presses Enter.
+func holdForInspection(base string, err error, stdin *os.File) {
+	fmt.Fprintf(os.Stderr, "\r\nSetup failed: %v\r\n", err)
+	fmt.Fprintf(os.Stderr, "Leaving session mounts in place for inspection:\r\n")
+	fmt.Fprintf(os.Stderr, "  overlay base:    %s\r\n", base)
+	fmt.Fprintf(os.Stderr, "  merged root:     %s/merged\r\n", base)
+	printNsenter()
+
+	if stdin == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Press Enter to tear down the session mounts...\r\n")
+	waitForRelease(stdin, nil)
+}
+
+// keepSession is called on the session thread after the session
+// command exits when --keep-session is set.  Like holdForInspection it
+// prints where the session's mounts are, here the ones listed in
+// mounts, and blocks until the user presses Enter or Ctrl-C, or the
+// session is hung up.
+func keepSession(mergedDir, hostMountpoint, nixPath string, mounts []string, stdin *os.File, hangup <-chan struct{}) {
+	fmt.Fprintf(os.Stderr, "\r\nSession ended; keeping its mounts for inspection:\r\n")
+	fmt.Fprintf(os.Stderr, "  merged root:     %s\r\n", mergedDir)
+	if hostMountpoint != "" {
+		fmt.Fprintf(os.Stderr, "  target mount:    %s\r\n", hostMountpoint)
+	}
+	fmt.Fprintf(os.Stderr, "  debug image nix: %s\r\n", nixPath)
+	if len(mounts) > 0 {
+		fmt.Fprintf(os.Stderr, "  mount points:\r\n")
+		for _, m := range mounts {
+			fmt.Fprintf(os.Stderr, "    %s\r\n", m)
+		}
+	}
+	printNsenter()
+
+	if stdin != nil {
+		fmt.Fprintf(os.Stderr, "Press Enter or Ctrl-C to tear down the session...\r\n")
+	} else {
+		fmt.Fprintf(os.Stderr, "Press Ctrl-C to tear down the session...\r\n")
+	}
+	waitForRelease(stdin, hangup)
+}
+
+// printNsenter prints how to enter the calling thread's mount
+// namespace from another terminal.
+func printNsenter() {
+	nsPath := fmt.Sprintf("/proc/%d/task/%d/ns/mnt", os.Getpid(), unix.Gettid())
+	fmt.Fprintf(os.Stderr, "  mount namespace: %s\r\n", nsPath)
+	fmt.Fprintf(os.Stderr, "Inspect from another terminal with:\r\n")
+	if os.Getenv("_PODMAN_DEBUG_UNSHARED") != "" {
+		fmt.Fprintf(os.Stderr, "  podman unshare nsenter --mount=%s\r\n", nsPath)
+	} else {
+		fmt.Fprintf(os.Stderr, "  nsenter --mount=%s\r\n", nsPath)
+	}
+}
+
+// waitForRelease blocks until Enter or Ctrl-C is read from stdin (if
+// not nil), SIGINT or SIGTERM arrives, or hangup is closed.  While it
+// waits the signals don't kill the process, so the caller's teardown
+// still runs.
+func waitForRelease(stdin *os.File, hangup <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM)
+	defer signal.Stop(sigs)
+
+	keys := make(chan struct{})
+	if stdin != nil {
+		go func() {
+			defer close(keys)
+			// The terminal may be in raw mode, so accept CR and
+			// Ctrl-C as well as LF.
+			buf := make([]byte, 1)
+			for {
+				n, err := stdin.Read(buf)
+				if err != nil {
+					return
+				}
+				if n == 1 && (buf[0] == '\n' || buf[0] == '\r' || buf[0] == 3) {
+					return
+				}
+			}
+		}()
+	}
+
+	select {
+	case <-keys:
+	case <-sigs:
+	case <-hangup:
+	}
+}
@@ -0,0 +1,83 @@
+//go:build linux
+
+package debug
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// pidPair is a process of the target container, by its PID there and
+// on the host.
+type pidPair struct {
+	container, host int
+}
+
+// containerPIDs maps the PIDs of the processes sharing pid's PID
+// namespace to their host PIDs, for the procs builtin.  It must run
+// while /proc is still the host's: inside the container only the
+// container's own PIDs can be seen.  Processes it cannot inspect, such
+// as another user's when rootless, are left out.
+func containerPIDs(pid int) []pidPair {
+	target := fmt.Sprintf("/proc/%d/ns/pid", pid)
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var pairs []pidPair
+	for _, e := range entries {
+		hostPID, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if same, _ := sameNamespace(fmt.Sprintf("/proc/%d/ns/pid", hostPID), target); !same {
+			continue
+		}
+		if nsPID := innermostTgid(hostPID); nsPID > 0 {
+			pairs = append(pairs, pidPair{container: nsPID, host: hostPID})
+		}
+	}
+	return pairs
+}
+
+// innermostTgid returns hostPID's process ID in its own PID namespace:
+// the last NStgid entry in its status, which lists it from /proc's
+// namespace inwards.  It returns 0 if the status can't be read.
+func innermostTgid(hostPID int) int {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", hostPID))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ids, ok := strings.CutPrefix(scanner.Text(), "NStgid:")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(ids)
+		if len(fields) == 0 {
+			return 0
+		}
+		n, _ := strconv.Atoi(fields[len(fields)-1])
+		return n
+	}
+	return 0
+}
+
+// writeProcsMetadata records pairs as "PID HOST_PID" lines for the
+// procs builtin.
+func writeProcsMetadata(mergedDir string, pairs []pidPair) {
+	metaDir := mergedDir + metadataDir
+	_ = os.MkdirAll(metaDir, 0755)
+
+	var table strings.Builder
+	for _, p := range pairs {
+		fmt.Fprintf(&table, "%d %d\n", p.container, p.host)
+	}
+	_ = os.WriteFile(filepath.Join(metaDir, "procs"), []byte(table.String()), 0644)
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package debug
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// Restrictions reports anything in the current environment that will
+// stop ptrace-based tools (strace, gdb) from working in the session.
+//
+// The session never inherits the target container's seccomp profile:
+// joining namespaces with setns does not apply the container's filter,
+// and our shell is a child of podman-debug, not of the container
+// runtime.  What can get in the way is a filter podman-debug itself
+// inherited (e.g. when run from inside another container) and the
+// Yama LSM.
+func Restrictions() []string {
+	var notes []string
+
+	if mode := procStatusField("Seccomp"); mode != "" && mode != "0" {
+		notes = append(notes, "podman-debug is running under a seccomp filter inherited from its parent; "+
+			"the debug shell inherits it and ptrace-based tools may fail")
+	}
+
+	if data, err := os.ReadFile("/proc/sys/kernel/yama/ptrace_scope"); err == nil {
+		if strings.TrimSpace(string(data)) == "3" {
+			notes = append(notes, "kernel.yama.ptrace_scope is 3, ptrace is disabled system-wide; strace/gdb will not work")
+		}
+	}
+
+	return notes
+}
+
+// procStatusField returns the value of a field in /proc/self/status,
+// or "" if it cannot be read.
+func procStatusField(name string) string {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok && key == name {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package debug
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks bounds symlink resolution, matching the kernel's limit.
+const maxSymlinks = 40
+
+// resolveInRoot resolves path as if root were "/", following symlinks
+// (including absolute ones) without ever leaving root.  It returns the
+// host-side path of the final component.  This lets us look inside a
+// mounted image or the nix store before any chroot has happened.
+func resolveInRoot(root, path string) (string, error) {
+	rest := strings.Split(strings.TrimPrefix(filepath.Clean("/"+path), "/"), "/")
+	resolved := "/"
+	links := 0
+
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("resolving %s: too many levels of symbolic links", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
+
+// resolveForCreate is resolveInRoot for paths that may not exist yet:
+// the deepest existing ancestor is resolved and the missing components
+// are appended, so creating them cannot leave root either.
+func resolveForCreate(root, path string) (string, error) {
+	resolved, err := resolveInRoot(root, path)
+	if err == nil || !os.IsNotExist(err) {
+		return resolved, err
+	}
+	path = filepath.Clean("/" + path)
+	if path == "/" {
+		return "", err
+	}
+	parent, err := resolveForCreate(root, filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	resolved = filepath.Join(parent, filepath.Base(path))
+	// A dangling symlink would be followed by whatever creates it.
+	if info, err := os.Lstat(resolved); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("resolving %s: dangling symbolic link", path)
+	}
+	return resolved, nil
+}
+
+// existsInRoot reports whether path names an existing non-directory
+// inside root, following symlinks within root.
+func existsInRoot(root, path string) bool {
+	hostPath, err := resolveInRoot(root, path)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(hostPath)
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,102 @@
+//go:build linux
+
+package debug
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testRoot builds a small root filesystem with symlinks that try to
+// leave it, as a crafted image would.
+func testRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, d := range []string{"etc", "usr/lib", "var"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc/hosts"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"lib":             "usr/lib",
+		"etc/resolv.conf": "/etc/hosts",
+		"etc/hostname":    "../../../../etc/hosts",
+		"dev":             "/",
+		"sys":             "../../..",
+		"proc":            "/var/../../usr",
+		"etc/self":        "../../etc/self",
+		"var/run":         "/run",
+		"loop":            "loop",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestResolveForCreate(t *testing.T) {
+	root := testRoot(t)
+	tests := []struct {
+		path    string
+		want    string // relative to root
+		wantErr bool
+	}{
+		{path: "/etc/hosts", want: "etc/hosts"},
+		{path: "etc/hosts", want: "etc/hosts"},
+		{path: "//etc//hosts/", want: "etc/hosts"},
+		{path: "/etc/./hosts", want: "etc/hosts"},
+		{path: "/../../etc/hosts", want: "etc/hosts"},
+		{path: "/etc/../../../etc/hosts", want: "etc/hosts"},
+		{path: "/", want: ""},
+		{path: "/lib/modules", want: "usr/lib/modules"},
+		{path: "/etc/resolv.conf", want: "etc/hosts"},
+		{path: "/etc/hostname", want: "etc/hosts"},
+		{path: "/dev", want: ""},
+		{path: "/dev/null", want: "null"},
+		{path: "/sys", want: ""},
+		{path: "/sys/kernel", want: "kernel"},
+		{path: "/proc", want: "usr"},
+		{path: "/var/run/lock", wantErr: true},
+		{path: "/etc/self", wantErr: true},
+		{path: "/new/dir/file", want: "new/dir/file"},
+		{path: "/loop", wantErr: true},
+		{path: "/loop/x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := resolveForCreate(root, tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveForCreate(%q) = %q, want an error", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveForCreate(%q): %v", tt.path, err)
+			}
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Errorf("resolveForCreate(%q) = %q, want %q", tt.path, got, want)
+			}
+		})
+	}
+}
+
+func TestResolveForCreateDanglingLink(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The last component is a link to a file that doesn't exist: creating
+	// the mount point would create the link's target instead.
+	if err := os.Symlink("/nonexistent-podman-debug-test", filepath.Join(root, "etc/hosts")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := resolveForCreate(root, "/etc/hosts"); err == nil {
+		t.Errorf("resolveForCreate(/etc/hosts) = %q, want an error", got)
+	}
+}
@@ -0,0 +1,418 @@
+//go:build linux
+
+package debug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rsturla/podman-debug/pkg/podman"
+)
+
+// Session runs debug sessions: the command is built on it, and other
+// programs can embed it.  The zero value is not usable: NixPath must
+// point at a mounted debug image's /nix, as returned by
+// podman.ValidateDebugImage.  Like the command, the caller runs inside
+// "podman unshare" when rootless.
+type Session struct {
+	NixPath     string   // host path of the debug image's /nix
+	Shell       string   // shell preference as for --shell; "" means auto
+	ShellArgs   []string // arguments for the shell; none starts it interactively
+	Streams     Streams
+	PullPolicy  string        // podman pull policy for image targets; "" means "missing"
+	Platform    string        // OS/ARCH[/VARIANT] to pull image targets for; "" means the host's
+	PodMember   string        // member to debug, by name or ID prefix; when set the target must be a pod
+	WaitHealthy bool          // wait for a container target's healthcheck to pass first
+	WaitTimeout time.Duration // how long WaitHealthy waits
+
+	// Prepare, if set, is called once the target is resolved and, for
+	// a snapshot or image, mounted, just before the session starts.  It
+	// can adjust opts for the target, or return an error to abandon it.
+	Prepare func(t *Target, opts *Options) error
+
+	// Finish, if set, is called with the result of every session that
+	// Prepare let start, before the target is unmounted, and returns
+	// the result Run passes on.
+	Finish func(t *Target, opts *Options, code int, err error) (int, error)
+
+	// Hold, if set, takes charge of each podman mount Run makes as soon
+	// as it is made: it is given the func that releases the mount, the
+	// podman command that does the same by hand, and the mount's name,
+	// and returns the func Run calls once done with it.  Without it,
+	// Run releases its mounts itself.
+	Hold func(release func(string) error, command, name string) func()
+}
+
+// Target is what Session.Run resolved its target to.
+type Target struct {
+	Name      string // the container's name, or the image as given
+	ID        string // the container's full ID
+	Ref       string // what podman knows it by; a loaded archive's image ID
+	Container bool   // a container rather than an image
+	State     string // the container's podman state
+	PID       int    // the main process of a running container
+	Rootfs    string // host path of its root filesystem
+}
+
+// ModeForState returns the mode a container in the given podman state
+// is debugged in: live while it has processes, a snapshot of its
+// filesystem otherwise.  It reports false for states that can't be
+// debugged.
+func ModeForState(state string) (Mode, bool) {
+	switch state {
+	case "running", "paused":
+		return ModeLive, true
+	case "stopped", "exited", "created", "configured":
+		return ModeSnapshot, true
+	default:
+		return 0, false
+	}
+}
+
+// Run debugs target and returns the session's exit status.  target is
+// tried as a container, then as a pod, and then as an image; failing
+// all three, as the name of a running container's main process.  An
+// image archive such as oci-archive:img.tar can only be an image.
+// opts carries everything but the mode, which Run picks; a nil
+// Entrypoint or nil Mounts are filled in from the target.  Cancelling
+// ctx before the session starts abandons it; cancelling it afterwards
+// hangs it up, as if the user had gone.
+func (s *Session) Run(ctx context.Context, target string, opts *Options) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if s.NixPath == "" {
+		return 0, errors.New("session has no debug image nix path")
+	}
+
+	Log.SetTarget(target)
+	if podman.IsArchiveReference(target) {
+		if s.PodMember != "" {
+			return 0, fmt.Errorf("--container needs a pod, and %s is an image archive", target)
+		}
+		return s.runImage(ctx, target, opts)
+	}
+	if s.PodMember != "" {
+		pod, err := podman.InspectPod(target)
+		if err != nil {
+			return 0, fmt.Errorf("--container needs a pod: %w", err)
+		}
+		return s.runPod(ctx, pod, opts)
+	}
+
+	code, err := s.runContainer(ctx, target, opts)
+	if err == nil {
+		return code, nil
+	}
+	if !errors.Is(err, podman.ErrContainerNotFound) {
+		return 0, err
+	}
+
+	if pod, perr := podman.InspectPod(target); perr == nil {
+		return s.runPod(ctx, pod, opts)
+	}
+
+	code, err = s.runImage(ctx, target, opts)
+	if !errors.Is(err, podman.ErrImageNotFound) {
+		return code, err
+	}
+	if match, merr := matchProcess(target); merr != nil {
+		return 0, merr
+	} else if match != nil {
+		Log.Note("No container or image %q; debugging container %s, whose main process is %s.", target, match.Name, match.Command)
+		return s.runContainer(ctx, match.ID, opts)
+	}
+	return 0, fmt.Errorf("no container or image found for %q: %w", target, err)
+}
+
+// runPod debugs the member of pod chosen by PodMember.
+func (s *Session) runPod(ctx context.Context, pod *podman.PodInfo, opts *Options) (int, error) {
+	member, err := PodMember(pod, s.PodMember)
+	if err != nil {
+		return 0, err
+	}
+	Log.Note("Debugging container %s of pod %s.", member.Name, pod.Name)
+	return s.runContainer(ctx, member.ID, opts)
+}
+
+func (s *Session) runContainer(ctx context.Context, ref string, opts *Options) (int, error) {
+	opts = opts.clone()
+	inspected := opts.Timings.Track("target inspect")
+	ctr, err := podman.InspectContainer(ref)
+	inspected()
+	if err != nil {
+		return 0, err
+	}
+
+	if s.WaitHealthy {
+		if err := waitHealthy(ref, s.WaitTimeout, opts.Timings); err != nil {
+			return 0, err
+		}
+		// Refreshed by the wait.
+		if ctr, err = podman.InspectContainer(ref); err != nil {
+			return 0, err
+		}
+	}
+	t := &Target{Name: ctr.Name, ID: ctr.ID, Ref: ref, Container: true, State: ctr.State, PID: ctr.PID}
+
+	// Entrypoint metadata is best-effort.
+	if opts.Entrypoint == nil {
+		opts.Entrypoint, _ = podman.InspectContainerEntrypoint(ref)
+	}
+	if opts.Mounts == nil {
+		opts.Mounts, _ = podman.InspectContainerMounts(ref)
+	}
+
+	mode, ok := ModeForState(ctr.State)
+	if !ok {
+		return 0, fmt.Errorf("container %s is in unsupported state: %s", ref, ctr.State)
+	}
+	Log.Event("target resolved", "kind", "container", "state", ctr.State, "mode", mode.String())
+	opts.Mode = mode
+	if mode == ModeLive {
+		if ctr.State == "paused" {
+			Log.Note("Container is paused. Processes are frozen but filesystem is accessible.")
+		}
+		t.Rootfs = fmt.Sprintf("/proc/%d/root", ctr.PID)
+		return s.start(ctx, t, opts, func(shell string, streams Streams) (int, error) {
+			return ExecLive(ctr.PID, s.NixPath, shell, s.ShellArgs, streams, opts)
+		})
+	}
+
+	Log.Note("Container is not running. Changes will be discarded on exit.")
+	mounted := opts.Timings.Track("target mount")
+	mountPoint, err := podman.MountContainer(ref)
+	mounted()
+	if err != nil {
+		return 0, err
+	}
+	defer s.hold(podman.UnmountContainer, "podman unmount", ref)()
+	Log.Event("target mounted", "mountpoint", mountPoint)
+
+	t.Rootfs = mountPoint
+	opts.HostMountpoint = mountPoint
+	return s.start(ctx, t, opts, func(shell string, streams Streams) (int, error) {
+		ResolveVolumeSources(opts.Mounts)
+		return ExecSnapshot(s.NixPath, mountPoint, shell, s.ShellArgs, streams, opts)
+	})
+}
+
+func (s *Session) runImage(ctx context.Context, target string, opts *Options) (int, error) {
+	opts = opts.clone()
+	if s.WaitHealthy {
+		return 0, fmt.Errorf("--wait-healthy needs a container, and %s is an image", target)
+	}
+
+	Log.Note("Debugging an image. Changes will be discarded on exit.")
+	t := &Target{Name: target, Ref: target}
+
+	pulled := opts.Timings.Track("target pull")
+	if podman.IsArchiveReference(target) {
+		// Loaded into storage, the image is known by its ID from
+		// here on.
+		id, err := podman.LoadImageArchive(target)
+		pulled()
+		if err != nil {
+			return 0, fmt.Errorf("loading image %s: %w", target, err)
+		}
+		Log.Note("Loaded %s as image %.12s.", target, id)
+		t.Ref = id
+	} else {
+		policy := s.PullPolicy
+		if policy == "" {
+			policy = "missing"
+		}
+		err := podman.PullImage(target, policy, s.Platform)
+		pulled()
+		if err != nil {
+			return 0, fmt.Errorf("pulling image %s: %w", target, err)
+		}
+	}
+	Log.Event("target resolved", "kind", "image", "mode", ModeImage.String())
+
+	// Entrypoint metadata is best-effort.
+	if opts.Entrypoint == nil {
+		opts.Entrypoint, _ = podman.InspectImageEntrypoint(t.Ref)
+	}
+
+	mounted := opts.Timings.Track("target mount")
+	mountPoint, err := podman.MountImage(t.Ref)
+	mounted()
+	if err != nil {
+		return 0, fmt.Errorf("mounting image %s: %w", t.Ref, err)
+	}
+	defer s.hold(podman.UnmountImage, "podman image unmount", t.Ref)()
+	Log.Event("target mounted", "mountpoint", mountPoint)
+
+	t.Rootfs = mountPoint
+	opts.Mode = ModeImage
+	opts.HostMountpoint = mountPoint
+	return s.start(ctx, t, opts, func(shell string, streams Streams) (int, error) {
+		return ExecSnapshot(s.NixPath, mountPoint, shell, s.ShellArgs, streams, opts)
+	})
+}
+
+// start runs the session for t through exec, between the Prepare and
+// Finish hooks.
+func (s *Session) start(ctx context.Context, t *Target, opts *Options, exec func(shell string, streams Streams) (int, error)) (int, error) {
+	if opts.Target == "" {
+		opts.Target = t.Name
+	}
+	if s.Prepare != nil {
+		if err := s.Prepare(t, opts); err != nil {
+			return 0, err
+		}
+	}
+	code, err := s.exec(ctx, t, opts, exec)
+	if s.Finish != nil {
+		return s.Finish(t, opts, code, err)
+	}
+	return code, err
+}
+
+func (s *Session) exec(ctx context.Context, t *Target, opts *Options, exec func(shell string, streams Streams) (int, error)) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var imageShell []string
+	if opts.Entrypoint != nil {
+		imageShell = opts.Entrypoint.Shell
+	}
+	shell, err := ResolveShell(s.Shell, imageShell, s.NixPath, t.Rootfs)
+	if err != nil {
+		return 0, err
+	}
+	streams, stop := s.streams(ctx)
+	defer stop()
+	return exec(shell, streams)
+}
+
+// hold hands a podman mount to the Hold hook, and returns the func
+// that releases it.
+func (s *Session) hold(release func(string) error, command, name string) func() {
+	if s.Hold != nil {
+		return s.Hold(release, command, name)
+	}
+	return func() { _ = release(name) }
+}
+
+// streams returns s.Streams with a Hangup that also fires when ctx is
+// done.  The returned func releases the watcher.
+func (s *Session) streams(ctx context.Context) (Streams, func()) {
+	streams := s.Streams
+	if ctx.Done() == nil {
+		return streams, func() {}
+	}
+	hangup, stop := mergeHangup(s.Streams.Hangup, ctx.Done())
+	streams.Hangup = hangup
+	return streams, stop
+}
+
+// clone returns a copy of opts that a session attempt can fill in
+// without the next attempt seeing it.
+func (opts *Options) clone() *Options {
+	c := *opts
+	c.Mounts = slices.Clone(opts.Mounts)
+	return &c
+}
+
+// PodMember picks the container of pod to debug: the one name names
+// (by name or ID prefix), or else the infra container, which holds the
+// pod's shared namespaces.  A pod with several containers besides the
+// infra container needs a name to choose.
+func PodMember(pod *podman.PodInfo, name string) (podman.PodContainer, error) {
+	var members, matches []podman.PodContainer
+	for _, c := range pod.Containers {
+		if name != "" && (c.Name == name || strings.HasPrefix(c.ID, name)) {
+			matches = append(matches, c)
+		}
+		if c.ID != pod.InfraContainerID {
+			members = append(members, c)
+		}
+	}
+
+	switch {
+	case len(matches) == 1:
+		return matches[0], nil
+	case len(matches) > 1:
+		return podman.PodContainer{}, fmt.Errorf("--container %q matches several containers of pod %s: %s", name, pod.Name, podContainerList(matches))
+	case name != "":
+		return podman.PodContainer{}, fmt.Errorf("pod %s has no member %q; its containers are: %s", pod.Name, name, podContainerList(pod.Containers))
+	case len(members) > 1:
+		return podman.PodContainer{}, fmt.Errorf("pod %s has several containers: %s; choose one with --container", pod.Name, podContainerList(members))
+	}
+	for _, c := range pod.Containers {
+		if c.ID == pod.InfraContainerID {
+			return c, nil
+		}
+	}
+	if len(members) == 1 {
+		return members[0], nil
+	}
+	return podman.PodContainer{}, fmt.Errorf("pod %s has no containers", pod.Name)
+}
+
+// podContainerList formats pod members as "name (state), ...".
+func podContainerList(containers []podman.PodContainer) string {
+	names := make([]string, len(containers))
+	for i, c := range containers {
+		names[i] = fmt.Sprintf("%s (%s)", c.Name, c.State)
+	}
+	return strings.Join(names, ", ")
+}
+
+// waitHealthy polls the container ref until it is running and its
+// healthcheck reports healthy, giving up after timeout with the last
+// healthcheck's output.
+func waitHealthy(ref string, timeout time.Duration, timings *Timings) error {
+	deadline := time.Now().Add(timeout)
+	waited := timings.Track("health wait")
+	defer waited()
+
+	for announced := false; ; announced = true {
+		state, health, err := podman.InspectContainerHealth(ref)
+		if errors.Is(err, podman.ErrNoHealthcheck) {
+			return fmt.Errorf("--wait-healthy: container %s has no healthcheck configured", ref)
+		}
+		if err != nil {
+			// Not wrapped: this must not read as
+			// ErrContainerNotFound and send us on to image lookup.
+			return fmt.Errorf("container %s went away while waiting for it to become healthy", ref)
+		}
+		if state == "running" && health.Status == "healthy" {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			msg := fmt.Sprintf("container %s did not become healthy within %s (state %s, health %s)", ref, timeout, state, health.Status)
+			if n := len(health.Log); n > 0 {
+				last := health.Log[n-1]
+				msg += fmt.Sprintf("; last healthcheck exited %d: %s", last.ExitCode, strings.TrimSpace(last.Output))
+			}
+			return errors.New(msg)
+		}
+		if !announced {
+			Log.Note("Waiting for container %s to become healthy (state %s, health %s)...", ref, state, health.Status)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// matchProcess is the last resort for a target that is neither a
+// container nor an image: the running container whose main process is
+// named name.  It returns nil if none matches, and an
+// *podman.AmbiguousProcessError if several do.
+func matchProcess(name string) (*podman.ProcessMatch, error) {
+	matches, err := podman.FindByProcess(name)
+	if err != nil || len(matches) == 0 {
+		return nil, nil
+	}
+	if len(matches) > 1 {
+		return nil, &podman.AmbiguousProcessError{Process: name, Candidates: matches}
+	}
+	return &matches[0], nil
+}
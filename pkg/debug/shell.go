@@ -3,33 +3,114 @@
 package debug
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"golang.org/x/sys/unix"
+	"golang.org/x/term"
 )
 
-// DetectShell determines which shell binary to use based on user
-// preference.  "auto" defaults to bash from the nix profile.
-func DetectShell(preference string) string {
-	const nixBinPath = "/nix/var/nix/profiles/default/bin"
+// autoShells are the debug image shells "auto" falls back to, in
+// order of preference.
+var autoShells = []string{"bash", "sh"}
+
+// DetectShell resolves a shell preference to a path in the session.
+// Bare names (bash, sh, zsh, fish, ...) are looked up in the debug
+// image's nix profile, in the image mounted at the parent of nixPath;
+// absolute paths are used as-is.  "auto" is the profile's bash, or its
+// sh without bash.  A shell the profile lacks is an error, rather than
+// a failed exec once the session is set up.
+func DetectShell(preference, nixPath string) (string, error) {
+	if filepath.IsAbs(preference) {
+		return preference, nil
+	}
+	names := []string{preference}
+	if preference == "" || preference == "auto" {
+		names = autoShells
+	}
+	for _, name := range names {
+		shell := filepath.Join(nixProfileBin, name)
+		if existsInRoot(filepath.Dir(nixPath), shell) {
+			return shell, nil
+		}
+	}
+	available := nixShells(nixPath)
+	if len(names) > 1 {
+		return "", shellNotFound(fmt.Sprintf("the debug image has no %s in %s", strings.Join(names, " or "), nixProfileBin), available)
+	}
+	return "", shellNotFound(fmt.Sprintf("shell %q not found in the debug image's %s", preference, nixProfileBin), available)
+}
+
+// ShellEnvVar names the environment variable consulted when --shell is
+// left at "auto".
+const ShellEnvVar = "PODMAN_DEBUG_SHELL"
+
+// ResolveShell picks the shell for a session.  The order of precedence
+// is an explicit preference (anything but "auto"), then
+// $PODMAN_DEBUG_SHELL, then the target's configured Shell, then bash
+// (or sh) from the nix profile.  Paths under /nix are looked up in the
+// debug image (the parent of nixPath), anything else in the target's
+// root filesystem.  An explicit preference that doesn't exist is an
+// error listing the shells that do; the environment and image
+// candidates are skipped instead.
+func ResolveShell(preference string, imageShell []string, nixPath, rootfs string) (string, error) {
+	exists := func(shell string) bool {
+		if strings.HasPrefix(shell, "/nix/") {
+			return existsInRoot(filepath.Dir(nixPath), shell)
+		}
+		return existsInRoot(rootfs, shell)
+	}
 
 	if preference != "" && preference != "auto" {
-		if filepath.IsAbs(preference) {
-			return preference
+		shell, err := DetectShell(preference, nixPath)
+		if err != nil || exists(shell) {
+			return shell, err
 		}
-		return filepath.Join(nixBinPath, preference)
+		var available []string
+		for _, c := range ListShells(rootfs, nixPath) {
+			available = append(available, c.Path)
+		}
+		where := "the target"
+		if strings.HasPrefix(shell, "/nix/") {
+			where = "the debug image"
+		}
+		return "", shellNotFound(fmt.Sprintf("shell %s not found in %s", shell, where), available)
+	}
+
+	if env := os.Getenv(ShellEnvVar); env != "" && env != "auto" {
+		if shell, err := DetectShell(env, nixPath); err == nil && exists(shell) {
+			return shell, nil
+		}
+		Log.Note("%s=%s not found, ignoring.", ShellEnvVar, env)
 	}
 
-	return filepath.Join(nixBinPath, "bash")
+	if len(imageShell) > 0 && filepath.IsAbs(imageShell[0]) {
+		if exists(imageShell[0]) {
+			return imageShell[0], nil
+		}
+	}
+
+	return DetectShell("auto", nixPath)
 }
 
-func runShell(cmd *exec.Cmd, streams Streams, interactive bool, ptyChan chan<- *os.File, doneChan chan struct{}) (int, error) {
+// runShell runs the session command and returns its exit status.  A
+// command that cannot be started is reported on streams.Stderr and
+// yields ExitNotFound or ExitCannotExec, like a shell would; the error
+// is only non-nil for failures of the session itself.  One still
+// running after timeout (if not zero) is killed, yielding ExitTimedOut;
+// one killed by a signal yields 128 plus the signal number.  While it
+// runs, ForwardSignal passes signals on to it.
+func runShell(cmd *exec.Cmd, streams Streams, interactive bool, timeout time.Duration, ptyChan chan<- *os.File, doneChan chan struct{}) (int, error) {
 	var exitCode int
 
 	isInteractive := streams.Stdin != nil && interactive
@@ -37,10 +118,15 @@ func runShell(cmd *exec.Cmd, streams Streams, interactive bool, ptyChan chan<- *
 	if isInteractive {
 		ptmx, err := pty.Start(cmd)
 		if err != nil {
+			// The session is set up; only the command failed.
 			close(doneChan)
-			return 125, err
+			fmt.Fprintf(streams.Stderr, "podman-debug: %v\r\n", err)
+			return ExecFailureCode(err), nil
 		}
 		defer ptmx.Close()
+		defer watchHangup(cmd, streams.Hangup)()
+		timedOut := watchTimeout(cmd, timeout)
+		defer setRunning(cmd, true)()
 
 		if size, err := pty.GetsizeFull(streams.Stdin); err == nil {
 			_ = pty.Setsize(ptmx, size)
@@ -69,23 +155,50 @@ func runShell(cmd *exec.Cmd, streams Streams, interactive bool, ptyChan chan<- *
 
 		if err != nil {
 			if exitErr, ok := err.(*exec.ExitError); ok {
-				exitCode = exitErr.ExitCode()
+				exitCode = exitStatus(exitErr)
 				err = nil
 			}
 		}
+		if timedOut() {
+			fmt.Fprintf(streams.Stderr, "\r\npodman-debug: session timed out after %s\r\n", timeout)
+			return ExitTimedOut, nil
+		}
 	} else {
 		cmd.Stdin = streams.Stdin
 		cmd.Stdout = streams.Stdout
 		cmd.Stderr = streams.Stderr
+		if streams.Stdin == nil || !term.IsTerminal(int(streams.Stdin.Fd())) {
+			// A group of its own, for a timeout or forwarded signal
+			// to reach whatever it started too; not with a terminal,
+			// which would make it a background job.
+			if cmd.SysProcAttr == nil {
+				cmd.SysProcAttr = &syscall.SysProcAttr{}
+			}
+			cmd.SysProcAttr.Setpgid = true
+		}
 
-		err := cmd.Run()
+		err := cmd.Start()
+		timedOut := func() bool { return false }
+		if err == nil {
+			stop := watchHangup(cmd, streams.Hangup)
+			timedOut = watchTimeout(cmd, timeout)
+			notRunning := setRunning(cmd, false)
+			err = cmd.Wait()
+			notRunning()
+			stop()
+		}
 		close(doneChan)
+		if timedOut() {
+			fmt.Fprintf(streams.Stderr, "podman-debug: session timed out after %s\n", timeout)
+			return ExitTimedOut, nil
+		}
 		if err != nil {
 			if exitErr, ok := err.(*exec.ExitError); ok {
-				exitCode = exitErr.ExitCode()
+				exitCode = exitStatus(exitErr)
 				err = nil
 			} else {
-				return 125, err
+				fmt.Fprintf(streams.Stderr, "podman-debug: %v\n", err)
+				return ExecFailureCode(err), nil
 			}
 		}
 	}
@@ -93,6 +206,168 @@ func runShell(cmd *exec.Cmd, streams Streams, interactive bool, ptyChan chan<- *
 	return exitCode, nil
 }
 
+// releasableStdin returns a non-blocking duplicate of stdin for an
+// interactive session to read from, and a func that interrupts a read
+// still pending on it once the shell has exited.  Otherwise that read
+// would swallow the keypress --keep-session waits for.  If stdin can't
+// be duplicated it is returned as is.
+func releasableStdin(stdin *os.File) (*os.File, func()) {
+	fd, err := unix.Dup(int(stdin.Fd()))
+	if err != nil {
+		return stdin, func() {}
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return stdin, func() {}
+	}
+	dup := os.NewFile(uintptr(fd), stdin.Name())
+	return dup, func() {
+		_ = dup.SetReadDeadline(time.Now())
+		// O_NONBLOCK is shared with stdin itself.
+		if raw, err := dup.SyscallConn(); err == nil {
+			_ = raw.Control(func(fd uintptr) { _ = unix.SetNonblock(int(fd), false) })
+		}
+		_ = dup.Close()
+	}
+}
+
+// watchHangup sends SIGHUP to the started cmd if hangup is closed
+// before the returned stop func is called.
+func watchHangup(cmd *exec.Cmd, hangup <-chan struct{}) (stop func()) {
+	if hangup == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-hangup:
+			_ = cmd.Process.Signal(unix.SIGHUP)
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// exitStatus returns the status a shell would report for a command
+// that ended with exitErr: its exit code, or 128 plus the number of
+// the signal that killed it.
+func exitStatus(exitErr *exec.ExitError) int {
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// running is the session command ForwardSignal passes signals on to,
+// set while runShell waits for it.
+var running struct {
+	sync.Mutex
+	cmd         *exec.Cmd
+	interactive bool // on a pty of its own
+}
+
+// setRunning records the started cmd as the running session command
+// and returns the func that clears it again.
+func setRunning(cmd *exec.Cmd, interactive bool) func() {
+	running.Lock()
+	defer running.Unlock()
+	running.cmd, running.interactive = cmd, interactive
+	return func() {
+		running.Lock()
+		defer running.Unlock()
+		running.cmd = nil
+	}
+}
+
+// ForwardSignal passes sig, which podman-debug itself received, on to
+// the running session command's process group, so it can exit and the
+// session wind down as after any other exit, and reports whether there
+// was one.  An interactive shell, which ignores SIGTERM and SIGINT, is
+// hung up as well, like a closed terminal.  SIGINT is not passed on to
+// a command that shares podman-debug's process group: that came from
+// the terminal, which has sent it the same.
+func ForwardSignal(sig unix.Signal) bool {
+	running.Lock()
+	defer running.Unlock()
+	if running.cmd == nil {
+		return false
+	}
+	if sig == unix.SIGINT && !running.interactive {
+		if pgid, err := unix.Getpgid(running.cmd.Process.Pid); err == nil && pgid == unix.Getpgrp() {
+			return true
+		}
+	}
+	signalGroup(running.cmd, sig)
+	if running.interactive && sig != unix.SIGHUP {
+		signalGroup(running.cmd, unix.SIGHUP)
+	}
+	return true
+}
+
+// timeoutKillGrace is how long a timed-out session command gets to
+// exit after SIGTERM before it is sent SIGKILL.
+const timeoutKillGrace = 5 * time.Second
+
+// watchTimeout ends the started cmd once timeout has passed, sending
+// SIGTERM and, if it is still there timeoutKillGrace later, SIGKILL to
+// its process group (or to it alone, if it doesn't lead one).  The
+// returned func cancels the timer and reports whether it fired; call
+// it once cmd has been waited for.  A zero timeout never fires.
+func watchTimeout(cmd *exec.Cmd, timeout time.Duration) (timedOut func() bool) {
+	if timeout <= 0 {
+		return func() bool { return false }
+	}
+	var fired atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-done:
+			return
+		}
+		fired.Store(true)
+		signalGroup(cmd, unix.SIGTERM)
+		select {
+		case <-time.After(timeoutKillGrace):
+			signalGroup(cmd, unix.SIGKILL)
+		case <-done:
+		}
+	}()
+	return func() bool {
+		close(done)
+		return fired.Load()
+	}
+}
+
+// signalGroup sends sig to the process group the started cmd leads,
+// or to cmd alone if it doesn't lead one.
+func signalGroup(cmd *exec.Cmd, sig unix.Signal) {
+	pid := cmd.Process.Pid
+	if pgid, err := unix.Getpgid(pid); err == nil && pgid == pid {
+		_ = unix.Kill(-pid, sig)
+		return
+	}
+	_ = cmd.Process.Signal(sig)
+}
+
+// mergeHangup returns a channel closed as soon as either a or b is
+// (a nil channel never is), and a func that releases the watcher.
+func mergeHangup(a, b <-chan struct{}) (<-chan struct{}, func()) {
+	hangup := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(hangup)
+		select {
+		case <-a:
+		case <-b:
+		case <-done:
+		}
+	}()
+	return hangup, func() { close(done) }
+}
+
 func waitForResult(resChan <-chan result, ptyChan <-chan *os.File, doneChan <-chan struct{}, stdin *os.File) (int, error) {
 	sigwinchChan := make(chan os.Signal, 1)
 	signal.Notify(sigwinchChan, unix.SIGWINCH)
@@ -124,18 +399,69 @@ func waitForResult(resChan <-chan result, ptyChan <-chan *os.File, doneChan <-ch
 	return res.exitCode, res.err
 }
 
+// sessionCommand builds what the session runs: opts.Argv exec'd as-is
+// when set, otherwise the shell with shellArgs.  With pidns the command
+// is started through the init wrapper in a new PID namespace.  The
+// returned bool reports whether the command is an interactive shell.
+// Must be called after chroot, so opts.Argv[0] is looked up on the
+// PATH in env, the session's, inside its filesystem.
+func sessionCommand(shell string, shellArgs []string, opts *Options, env []string, pidns bool) (*exec.Cmd, bool, error) {
+	name, args, interactive := shell, shellArgs, len(shellArgs) == 0
+	if interactive && opts.RCFile != nil && filepath.Base(shell) == "bash" {
+		args = []string{"--rcfile", RCFilePath}
+	}
+	if len(opts.Argv) > 0 {
+		path, err := lookPath(opts.Argv[0], env)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: command not found in session", opts.Argv[0])
+		}
+		name, args, interactive = path, opts.Argv[1:], false
+	}
+	if pidns {
+		return wrapWithPIDNS(name, args, opts.RestrictSys), interactive, nil
+	}
+	return exec.Command(name, args...), interactive, nil
+}
+
+// runPostInstall runs opts.PostInstall with the session's shell, after
+// setup and before the session command starts, in the same cgroup and
+// (with pidns) its own PID namespace.  A failure is only reported: the
+// session goes ahead without it.
+func runPostInstall(shell string, opts *Options, env []string, pidns bool, cgroup *sessionCgroup, streams Streams) {
+	var cmd *exec.Cmd
+	if pidns {
+		cmd = wrapWithPIDNS(shell, []string{"-c", opts.PostInstall}, opts.RestrictSys)
+	} else {
+		cmd = exec.Command(shell, "-c", opts.PostInstall)
+	}
+	cmd.Dir = "/"
+	cmd.Env = env
+	cmd.Stdout = streams.Stdout
+	cmd.Stderr = streams.Stderr
+	cgroup.apply(cmd)
+
+	if err := cmd.Run(); err != nil {
+		Log.Warn("post-install command failed: %v", err)
+	}
+}
+
 // initBinaryPath is where the podman-debug binary is placed inside
 // the overlay for use as the --init-proc PID 1 helper.
 const initBinaryPath = "/.podman-debug/bin/init"
 
 // wrapWithPIDNS creates an exec.Cmd that runs the shell inside a new
 // PID namespace.  The child process is the podman-debug binary invoked
-// with --init-proc, which mounts a fresh /proc and then execs the
-// actual shell.  This ensures ps/top only show the debug session's
-// own processes.
-func wrapWithPIDNS(shell string, shellArgs []string) *exec.Cmd {
-	// The init binary mounts /proc and execs the shell.
-	args := append([]string{initBinaryPath, "--init-proc", shell}, shellArgs...)
+// with --init-proc, which mounts a fresh /proc and then runs the
+// actual shell as its child, passing signals on to it.  This ensures ps/top only show the debug session's
+// own processes.  With restrictProc the init binary is invoked as
+// --init-proc-restricted instead, and its /proc shows processes only.
+func wrapWithPIDNS(shell string, shellArgs []string, restrictProc bool) *exec.Cmd {
+	// The init binary mounts /proc and runs the shell.
+	mode := "--init-proc"
+	if restrictProc {
+		mode = "--init-proc-restricted"
+	}
+	args := append([]string{initBinaryPath, mode, shell}, shellArgs...)
 	cmd := exec.Command(initBinaryPath, args[1:]...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Cloneflags: syscall.CLONE_NEWPID,
@@ -0,0 +1,73 @@
+//go:build linux
+
+package debug
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// shellNames are the executables ListShells looks for, roughly in
+// order of preference.
+var shellNames = []string{"bash", "zsh", "fish", "ksh", "mksh", "dash", "ash", "sh", "tcsh", "csh"}
+
+// shellDirs are the target directories ListShells searches.
+var shellDirs = []string{"/bin", "/usr/bin", "/usr/local/bin", "/sbin", "/usr/sbin"}
+
+// nixProfileBin is where the debug image's default profile keeps its
+// executables.
+const nixProfileBin = "/nix/var/nix/profiles/default/bin"
+
+// ShellCandidate is a shell found by ListShells.
+type ShellCandidate struct {
+	Path   string `json:"path"`   // path inside the session
+	Source string `json:"source"` // "target" or "debug image"
+}
+
+// ListShells returns the shells present in the target root filesystem
+// rootfs and in the debug image's nix profile (the parent of nixPath).
+// A target shell reachable under several directories (/bin linked to
+// /usr/bin) is listed once, under the first.
+func ListShells(rootfs, nixPath string) []ShellCandidate {
+	var shells []ShellCandidate
+	seen := map[string]bool{}
+	for _, dir := range shellDirs {
+		for _, name := range shellNames {
+			p := filepath.Join(dir, name)
+			hostPath, err := resolveInRoot(rootfs, p)
+			if err != nil || seen[hostPath] || !existsInRoot(rootfs, p) {
+				continue
+			}
+			seen[hostPath] = true
+			shells = append(shells, ShellCandidate{Path: p, Source: "target"})
+		}
+	}
+
+	for _, p := range nixShells(nixPath) {
+		shells = append(shells, ShellCandidate{Path: p, Source: "debug image"})
+	}
+	return shells
+}
+
+// nixShells returns the shells in the debug image's nix profile.
+func nixShells(nixPath string) []string {
+	var shells []string
+	for _, name := range shellNames {
+		p := filepath.Join(nixProfileBin, name)
+		if existsInRoot(filepath.Dir(nixPath), p) {
+			shells = append(shells, p)
+		}
+	}
+	return shells
+}
+
+// shellNotFound returns an error for a shell the session lacks, listing
+// the available ones to pass to --shell instead.
+func shellNotFound(msg string, available []string) error {
+	if len(available) == 0 {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%s; available shells: %s (pass one to --shell)", msg, strings.Join(available, ", "))
+}
@@ -5,7 +5,9 @@ package debug
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
@@ -13,88 +15,254 @@ import (
 // ExecSnapshot executes a debug shell using a host-side mount point.
 // Used for stopped containers and images.
 func ExecSnapshot(nixPath, hostMountpoint, shell string, shellArgs []string, streams Streams, opts *Options) (int, error) {
+	if err := ValidateEnv(opts.EnvOverride); err != nil {
+		return ExitSetupFailed, err
+	}
+
 	resChan := make(chan result, 1)
 	ptyChan := make(chan *os.File, 1)
 	doneChan := make(chan struct{})
 
+	base := newOverlayBase()
+	defer removeOverlayBase("", base)
+
 	go func() {
 		runtime.LockOSThread()
 
 		_ = unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(unix.SIGKILL), 0, 0, 0)
-		_ = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		if !opts.AllowNewPrivs {
+			_ = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		}
 
 		// No user namespace setup needed here: when running rootless
 		// the binary has already been re-exec'd via "podman unshare",
 		// which puts us in podman's user namespace with CAP_SYS_ADMIN.
 
+		// Create the session cgroup while /sys/fs/cgroup is still
+		// the host's.
+		cgroup := newSessionCgroup(opts.CgroupLimits)
+		defer cgroup.Close()
+
 		nixTreeFD, err := unix.OpenTree(unix.AT_FDCWD, nixPath,
 			unix.OPEN_TREE_CLONE|unix.AT_RECURSIVE)
 		if err != nil {
-			resChan <- result{125, fmt.Errorf("open_tree(%s): %w (requires Linux 5.2+)", nixPath, err)}
+			resChan <- result{ExitSetupFailed, fmt.Errorf("open_tree(%s): %w (requires Linux 5.2+)", nixPath, err)}
 			return
 		}
 		defer unix.Close(nixTreeFD)
 
+		// Open our own binary while its host path is still reachable.
+		self := openSelfExe()
+		defer self.Close()
+
+		copyOutFD, err := openCopyOut(opts.CopyOut)
+		if err != nil {
+			resChan <- result{ExitSetupFailed, err}
+			return
+		}
+		if copyOutFD >= 0 {
+			defer unix.Close(copyOutFD)
+		}
+
+		copyOutTargets, err := openCopyOutPaths(opts.CopyOutPaths)
+		if err != nil {
+			resChan <- result{ExitSetupFailed, err}
+			return
+		}
+		defer closeCopyOutPaths(copyOutTargets)
+
+		hostMounts, err := openHostMounts(opts.HostMounts)
+		if err != nil {
+			resChan <- result{ExitSetupFailed, err}
+			return
+		}
+		defer closeHostMounts(hostMounts)
+
+		var preserveRoot *os.Root
+		if opts.PreserveOverlay != "" {
+			if preserveRoot, err = os.OpenRoot(opts.PreserveOverlay); err != nil {
+				resChan <- result{ExitSetupFailed, fmt.Errorf("--preserve-overlay: %w", err)}
+				return
+			}
+			defer preserveRoot.Close()
+		}
+
+		// setupFailed reports a setup error, first holding the
+		// session's mounts open for inspection when requested.
+		setupFailed := func(err error) {
+			if opts.NoCleanupOnError {
+				holdForInspection(base, err, streams.Stdin)
+			}
+			resChan <- result{ExitSetupFailed, err}
+		}
+
+		joined := opts.Timings.Track("namespace join")
 		if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
-			resChan <- result{125, fmt.Errorf("unshare mount namespace: %w", err)}
+			setupFailed(fmt.Errorf("unshare mount namespace: %w", err))
 			return
 		}
 		if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
-			resChan <- result{125, fmt.Errorf("making / private: %w", err)}
+			setupFailed(fmt.Errorf("making / private: %w", err))
 			return
 		}
+		joined()
 
-		mergedDir, err := setupSnapshotMode(hostMountpoint, nixTreeFD)
+		overlaid := opts.Timings.Track("overlay setup")
+		mergedDir, err := setupSnapshotMode(base, hostMountpoint, nixPath, nixTreeFD, hostMounts, opts)
+		overlaid()
 		if err != nil {
-			resChan <- result{125, err}
+			setupFailed(err)
+			return
+		}
+
+		writeNixConfig(mergedDir, opts.Offline)
+		writeBuiltins(mergedDir, opts, self)
+		if opts.builtinEnabled("diff") {
+			mountDiffViews(mergedDir, overlayUpperDir(base, opts), hostMountpoint)
+		}
+		if err := mountCopyOut(copyOutFD, mergedDir, opts.CopyOut); err != nil {
+			setupFailed(err)
 			return
 		}
 
-		writeNixConfig(mergedDir)
-		writeBuiltins(mergedDir, opts.Entrypoint)
+		// Keep a handle on the upper dir: it is outside the chroot.
+		upperFD := -1
+		if opts.ChangesOut != nil || opts.PreserveOverlay != "" {
+			upperFD, err = unix.Open(overlayUpperDir(base, opts), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+			if err != nil {
+				setupFailed(fmt.Errorf("opening overlay upper dir: %w", err))
+				return
+			}
+			defer unix.Close(upperFD)
+		}
+
+		var keptMounts []string
+		if opts.KeepSession {
+			keptMounts = sessionMounts(base)
+		}
 
 		if err := unix.Chroot(mergedDir); err != nil {
-			resChan <- result{125, fmt.Errorf("chroot to overlay: %w", err)}
+			setupFailed(fmt.Errorf("chroot to overlay: %w", err))
 			return
 		}
 		if err := unix.Chdir("/"); err != nil {
-			resChan <- result{125, fmt.Errorf("chdir to /: %w", err)}
+			setupFailed(fmt.Errorf("chdir to /: %w", err))
 			return
 		}
 
-		setupEnvironment(shell)
+		env := setupEnvironment(shell, opts)
+
+		var cred *syscall.Credential
+		var home string
+		if opts.User != "" {
+			if cred, home, err = resolveUser(opts.User); err != nil {
+				setupFailed(fmt.Errorf("session user: %w", err))
+				return
+			}
+		}
+
+		if opts.NoNetwork {
+			if err := isolateNetwork(); err != nil {
+				setupFailed(err)
+				return
+			}
+		}
+
+		if opts.PostInstall != "" {
+			postInstalled := opts.Timings.Track("post-install")
+			runPostInstall(shell, opts, env, !opts.HostPID, cgroup, streams)
+			postInstalled()
+		}
 
 		// Run the shell in a new PID namespace so /proc only shows
 		// the debug session's own processes, not the host.  The
 		// wrapper mounts a fresh /proc from within the new namespace
-		// before exec'ing the actual shell.
-		cmd := wrapWithPIDNS(shell, shellArgs)
-		cmd.Dir = "/"
-		cmd.Env = os.Environ()
+		// before exec'ing the actual shell.  With HostPID the shell
+		// shares the host's PID namespace and bound /proc instead.
+		cmd, interactive, err := sessionCommand(shell, shellArgs, opts, env, !opts.HostPID)
+		if err != nil {
+			// Reported like a shell would, as the command's own
+			// status rather than a podman-debug failure.
+			fmt.Fprintf(streams.Stderr, "podman-debug: %v\n", err)
+			resChan <- result{ExitNotFound, nil}
+			return
+		}
+		cmd.Dir = sessionDir(opts)
+		if cred != nil {
+			// After --post-install, which still runs as root.
+			env = setUserHome(env, home, opts)
+		}
+		cmd.Env = env
+		cgroup.apply(cmd)
+		if cred != nil {
+			applyUser(cmd, cred, !opts.HostPID)
+		}
 
-		exitCode, err := runShell(cmd, streams, len(shellArgs) == 0, ptyChan, doneChan)
+		opts.Timings.Mark("time to shell")
+		shellStreams, release := streams, func() {}
+		if opts.KeepSession && interactive && streams.Stdin != nil {
+			shellStreams.Stdin, release = releasableStdin(streams.Stdin)
+		}
+		exitCode, err := runShell(cmd, shellStreams, interactive, opts.Timeout, ptyChan, doneChan)
+		release()
+		if opts.Script != nil {
+			// With --writable the script would be left in the container.
+			_ = os.Remove(ScriptPath)
+		}
+		if opts.RCFile != nil {
+			_ = os.Remove(RCFilePath)
+		}
+		if opts.KeepSession {
+			keepSession(mergedDir, opts.HostMountpoint, nixPath, keptMounts, streams.Stdin, streams.Hangup)
+		}
+		copyOutPaths(copyOutTargets)
+		if preserveRoot != nil && upperFD >= 0 {
+			preserveOverlay(upperFD, preserveRoot)
+		}
+
+		if err == nil && exitCode == 0 && opts.ChangesOut != nil && upperFD >= 0 {
+			if err := exportChanges(upperFD, opts.ChangesOut); err != nil {
+				resChan <- result{ExitSetupFailed, fmt.Errorf("exporting session changes: %w", err)}
+				return
+			}
+		}
 		resChan <- result{exitCode, err}
 	}()
 
 	return waitForResult(resChan, ptyChan, doneChan, streams.Stdin)
 }
 
-func setupSnapshotMode(hostMountpoint string, nixTreeFD int) (string, error) {
-	mergedDir, err := createOverlay(hostMountpoint, false)
+func setupSnapshotMode(base, hostMountpoint, nixPath string, nixTreeFD int, hostMounts []hostMountTree, opts *Options) (string, error) {
+	lowerDirs := []string{hostMountpoint}
+	if opts.LayerDebugImage {
+		// Beneath the target, so the target's own files win.
+		lowerDirs = append(lowerDirs, filepath.Dir(nixPath))
+	}
+	mergedDir, err := createOverlay(base, lowerDirs, false, opts.UpperDir, opts.WorkDir, opts.OverlaySize)
 	if err != nil {
 		return "", err
 	}
 
-	nixMountPoint := mergedDir + "/nix"
+	nixMountPoint, err := resolveForCreate(mergedDir, "/nix")
+	if err != nil {
+		return "", fmt.Errorf("resolving /nix in overlay: %w", err)
+	}
 	if err := os.MkdirAll(nixMountPoint, 0755); err != nil {
 		return "", fmt.Errorf("creating /nix in overlay: %w", err)
 	}
 
-	if err := mountNixStore(nixTreeFD, nixMountPoint, overlayBasePath); err != nil {
+	if err := mountNixStore(nixTreeFD, nixMountPoint, base); err != nil {
 		return "", err
 	}
 
-	bindSnapshotMounts(mergedDir)
+	bindSnapshotMounts(mergedDir, opts.MinimalDev, opts.HostPID, opts.RestrictSys)
+	bindNetworkConfig(mergedDir, opts)
+	if opts.Mode == ModeSnapshot && !opts.NoVolumes {
+		bindContainerMounts(mergedDir, opts.Mounts, opts.WritableVolumes)
+	}
+	if err := attachHostMounts(mergedDir, hostMounts); err != nil {
+		return "", err
+	}
 
 	return mergedDir, nil
 }
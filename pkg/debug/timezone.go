@@ -0,0 +1,88 @@
+//go:build linux
+
+package debug
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// zoneinfoDirs are searched, in order, for the session's zone file.
+// The container's own tzdata comes first; the nix profile covers
+// images that ship none once tzdata is installed.
+var zoneinfoDirs = []string{
+	"/usr/share/zoneinfo",
+	"/etc/zoneinfo",
+	"/nix/var/nix/profiles/default/share/zoneinfo",
+	"/root/.nix-profile/share/zoneinfo",
+}
+
+// ContainerTimezone returns the zone name the rootfs is configured
+// for, taken from the /etc/localtime symlink or, failing that,
+// /etc/timezone.  It returns "" if neither says.
+func ContainerTimezone(rootfs string) string {
+	etc, err := resolveInRoot(rootfs, "/etc")
+	if err != nil {
+		return ""
+	}
+	if target, err := os.Readlink(filepath.Join(etc, "localtime")); err == nil {
+		if _, zone, ok := strings.Cut(target, "zoneinfo/"); ok && zone != "" {
+			return zone
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(etc, "timezone")); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return ""
+}
+
+// setupTimezone returns env with TZ set for the session.  Nix-built
+// tools don't look in the container's zoneinfo directory on their own,
+// so TZDIR is pointed at the first directory that has the zone.  When
+// no tzdata has it, times are shown in UTC and we say so rather than
+// failing.
+func setupTimezone(env []string, tz string) []string {
+	env = setEnv(env, "TZ", tz)
+
+	zone := strings.TrimPrefix(tz, ":")
+	if filepath.IsAbs(zone) {
+		if _, err := os.Stat(zone); err != nil {
+			Log.Note("Zone file %s does not exist in the session; times will show as UTC.", zone)
+		}
+		return env
+	}
+	if !isZoneName(zone) {
+		// A POSIX TZ string ("UTC0", "EST5EDT,M3.2.0,M11.1.0")
+		// needs no tzdata.
+		return env
+	}
+
+	dirs := zoneinfoDirs
+	if dir := getEnv(env, "TZDIR"); dir != "" {
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, zone)); err == nil {
+			if getEnv(env, "TZDIR") == "" {
+				env = setEnv(env, "TZDIR", dir)
+			}
+			return env
+		}
+	}
+	Log.Note("No zoneinfo for %s in the session; times will show as UTC until tzdata is installed (install tzdata).", zone)
+	return env
+}
+
+// isZoneName reports whether tz names a zoneinfo file, as opposed to a
+// POSIX TZ string.  Zone names never contain digits outside of the
+// Etc/GMT+N family, which is also a file.
+func isZoneName(tz string) bool {
+	if tz == "" {
+		return false
+	}
+	if strings.Contains(tz, "/") {
+		return true
+	}
+	return !strings.ContainsAny(tz, "0123456789,<>")
+}
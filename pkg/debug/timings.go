@@ -0,0 +1,78 @@
+package debug
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Timings records how long each setup phase of a run takes, for
+// --timings.  A nil *Timings records nothing, so instrumented code
+// costs a nil check when timings are off.
+type Timings struct {
+	mu     sync.Mutex
+	start  time.Time
+	phases []Phase
+}
+
+// Phase is one timed setup phase.
+type Phase struct {
+	Name     string        `json:"phase"`
+	Duration time.Duration `json:"-"`
+	Millis   float64       `json:"ms"`
+}
+
+// NewTimings starts timing a run.  Marks are measured from now.
+func NewTimings() *Timings {
+	return &Timings{start: time.Now(), phases: []Phase{}}
+}
+
+// Track starts timing the named phase; calling the returned func ends
+// it.
+func (t *Timings) Track(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	begin := time.Now()
+	return func() { t.add(name, time.Since(begin)) }
+}
+
+// Mark records the time from the start of the run until now under name.
+func (t *Timings) Mark(name string) {
+	if t == nil {
+		return
+	}
+	t.add(name, time.Since(t.start))
+}
+
+func (t *Timings) add(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phases = append(t.phases, Phase{Name: name, Duration: d, Millis: float64(d.Microseconds()) / 1000})
+}
+
+// WriteTable writes the recorded phases as an aligned table.
+func (t *Timings) WriteTable(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tDURATION")
+	for _, p := range t.phases {
+		fmt.Fprintf(tw, "%s\t%s\n", p.Name, p.Duration.Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the recorded phases as a JSON array.
+func (t *Timings) WriteJSON(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t.phases)
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package debug
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ListTools returns the executables in the debug image's default nix
+// profile (the parent of nixPath), sorted by name.  Names that resolve
+// to the same store file are listed once, under the first.
+func ListTools(nixPath string) ([]string, error) {
+	root := filepath.Dir(nixPath)
+	binDir, err := resolveInRoot(root, nixProfileBin)
+	if err != nil {
+		return nil, fmt.Errorf("debug image has no default nix profile: %w", err)
+	}
+	entries, err := os.ReadDir(binDir)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", nixProfileBin, err)
+	}
+
+	var tools []string
+	seen := map[string]bool{}
+	for _, e := range entries {
+		hostPath, err := resolveInRoot(root, filepath.Join(nixProfileBin, e.Name()))
+		if err != nil || seen[hostPath] {
+			continue
+		}
+		info, err := os.Stat(hostPath)
+		if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+			continue
+		}
+		seen[hostPath] = true
+		tools = append(tools, e.Name())
+	}
+	return tools, nil
+}
@@ -0,0 +1,176 @@
+//go:build linux
+
+package debug
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// credEnvVar passes the session user to the init binary, which has to
+// mount /proc as root before dropping to it (see DropToEnvCred).  Its
+// value is "uid:gid:group,group,...".
+const credEnvVar = "_PODMAN_DEBUG_CRED"
+
+// resolveUser resolves a user spec as podman accepts it ("user",
+// "uid", "user:group", "uid:gid") against /etc/passwd and /etc/group,
+// so it must be called after chroot.  Like podman, a user without a
+// group gets their passwd primary group (or 0 for an unknown numeric
+// UID), and the supplementary groups are every /etc/group entry that
+// lists the user by name.  It also returns the user's home directory,
+// "/" if passwd doesn't list one.
+func resolveUser(spec string) (*syscall.Credential, string, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	if userPart == "" {
+		return nil, "", fmt.Errorf("invalid user %q", spec)
+	}
+
+	passwd, _ := readColonFile("/etc/passwd")
+	groups, _ := readColonFile("/etc/group")
+
+	cred := &syscall.Credential{}
+	name, home := "", "/"
+	var entry []string
+	if uid, err := strconv.ParseUint(userPart, 10, 32); err == nil {
+		cred.Uid = uint32(uid)
+		for _, e := range passwd {
+			if len(e) >= 4 && e[2] == userPart {
+				entry = e
+				cred.Gid = parseID(e[3])
+				break
+			}
+		}
+	} else {
+		for _, e := range passwd {
+			if len(e) >= 4 && e[0] == userPart {
+				entry = e
+				cred.Uid, cred.Gid = parseID(e[2]), parseID(e[3])
+				break
+			}
+		}
+		if entry == nil {
+			return nil, "", fmt.Errorf("user %q not found in /etc/passwd", userPart)
+		}
+	}
+	if entry != nil {
+		name = entry[0]
+		if len(entry) >= 6 && entry[5] != "" {
+			home = entry[5]
+		}
+	}
+
+	if hasGroup {
+		if gid, err := strconv.ParseUint(groupPart, 10, 32); err == nil {
+			cred.Gid = uint32(gid)
+		} else {
+			found := false
+			for _, e := range groups {
+				if len(e) >= 3 && e[0] == groupPart {
+					cred.Gid, found = parseID(e[2]), true
+					break
+				}
+			}
+			if !found {
+				return nil, "", fmt.Errorf("group %q not found in /etc/group", groupPart)
+			}
+		}
+	}
+
+	cred.Groups = []uint32{cred.Gid}
+	if name != "" {
+		for _, e := range groups {
+			if len(e) < 4 {
+				continue
+			}
+			for _, member := range strings.Split(e[3], ",") {
+				if member == name {
+					if gid := parseID(e[2]); gid != cred.Gid {
+						cred.Groups = append(cred.Groups, gid)
+					}
+					break
+				}
+			}
+		}
+	}
+	return cred, home, nil
+}
+
+// readColonFile reads a passwd(5)-style file into its fields.
+func readColonFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
+
+func parseID(s string) uint32 {
+	id, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(id)
+}
+
+// applyUser makes cmd run as cred.  Through the PID namespace wrapper
+// the credential is handed to the init binary instead, which needs
+// root until it has mounted /proc.
+func applyUser(cmd *exec.Cmd, cred *syscall.Credential, pidns bool) {
+	if pidns {
+		groups := make([]string, len(cred.Groups))
+		for i, g := range cred.Groups {
+			groups[i] = strconv.FormatUint(uint64(g), 10)
+		}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d:%d:%s", credEnvVar, cred.Uid, cred.Gid, strings.Join(groups, ",")))
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+}
+
+// DropToEnvCred switches the process to the user passed in credEnvVar,
+// if any, and removes the variable from the environment.  The init
+// binary calls it once it no longer needs root.
+func DropToEnvCred() error {
+	value, ok := os.LookupEnv(credEnvVar)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(credEnvVar)
+
+	fields := strings.SplitN(value, ":", 3)
+	if len(fields) != 3 {
+		return fmt.Errorf("malformed %s %q", credEnvVar, value)
+	}
+	var groups []int
+	for _, g := range strings.Split(fields[2], ",") {
+		if g != "" {
+			groups = append(groups, int(parseID(g)))
+		}
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(int(parseID(fields[1]))); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(int(parseID(fields[0]))); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	return nil
+}
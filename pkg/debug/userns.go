@@ -0,0 +1,36 @@
+//go:build linux
+
+package debug
+
+import (
+	"os"
+
+	"github.com/rsturla/podman-debug/pkg/podman"
+	"golang.org/x/sys/unix"
+)
+
+// RootlessOwner reports whether the process pid lives in a user
+// namespace other than ours that belongs to an unprivileged user (as a
+// rootless podman container's does), and if so returns that user's
+// UID.  Joining such a container's other namespaces as real root works,
+// but without its user namespace the session sees file ownership
+// shifted by the user's subordinate UID range.  The user namespace
+// itself can't be joined from a multithreaded Go process.
+func RootlessOwner(pid int) (int, bool) {
+	same, err := sameNamespace(podman.NamespacePath(pid, "user"), "/proc/self/ns/user")
+	if err != nil || same {
+		return 0, false
+	}
+
+	f, err := os.Open(podman.NamespacePath(pid, "user"))
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	uid, err := unix.IoctlGetUint32(int(f.Fd()), unix.NS_GET_OWNER_UID)
+	if err != nil || uid == 0 {
+		return 0, false
+	}
+	return int(uid), true
+}
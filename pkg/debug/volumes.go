@@ -0,0 +1,95 @@
+//go:build linux
+
+package debug
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rsturla/podman-debug/pkg/podman"
+	"golang.org/x/sys/unix"
+)
+
+// bindContainerMounts attaches a stopped container's runtime mounts to
+// the overlay so their data is visible: volumes and bind mounts are
+// bound from their host-side source, tmpfs mounts get a fresh tmpfs.
+// Binds are read-only unless writable, and a mount the container has
+// read-only stays that way regardless.  Like the other session mounts
+// this is best-effort; a mount that cannot be attached is reported and
+// skipped.
+func bindContainerMounts(mergedDir string, mounts []podman.Mount, writable bool) {
+	for _, m := range mounts {
+		if err := bindContainerMount(mergedDir, m, writable); err != nil {
+			Log.Warn("Not attaching %s mount at %s: %v.", m.Type, m.Destination, err)
+		}
+	}
+}
+
+func bindContainerMount(mergedDir string, m podman.Mount, writable bool) error {
+	// Resolve the destination inside the overlay so a symlink in the
+	// image cannot redirect the mount onto the host.
+	target, err := resolveForCreate(mergedDir, m.Destination)
+	if err != nil {
+		return err
+	}
+
+	if m.Type == "tmpfs" {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		return unix.Mount("tmpfs", target, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777")
+	}
+
+	if m.Source == "" {
+		return fmt.Errorf("no host source")
+	}
+	info, err := os.Stat(m.Source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		err = createMountFile(target)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Mount(m.Source, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return err
+	}
+	if !writable || !m.RW {
+		if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+			_ = unix.Unmount(target, unix.MNT_DETACH)
+			return fmt.Errorf("making read-only: %w", err)
+		}
+	}
+	return nil
+}
+
+// createMountFile creates an empty file to bind a file mount over.
+func createMountFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// ResolveVolumeSources fills in the host path of each named volume from
+// podman volume inspect, which knows about volume drivers that the
+// container's own inspect output may not reflect.
+func ResolveVolumeSources(mounts []podman.Mount) {
+	for i, m := range mounts {
+		if m.Type != "volume" || m.Name == "" {
+			continue
+		}
+		if source, err := podman.VolumeMountpoint(m.Name); err == nil && source != "" {
+			mounts[i].Source = source
+		}
+	}
+}
@@ -3,61 +3,626 @@
 package podman
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
 // DefaultDebugImage is the default nix toolbox image.
 const DefaultDebugImage = "docker.io/nixos/nix:latest"
 
+// Binary is the podman executable every call runs: a name looked up in
+// PATH, or a path to a specific build.
+var Binary = "podman"
+
+// Connection names the podman system connection every call goes to, as
+// podman --connection does.  Empty means the local podman.  Only
+// metadata calls are useful remotely: mounts and the processes whose
+// namespaces a session joins stay on the remote host.
+var Connection string
+
+// Remote reports whether podman calls go to a remote connection.
+func Remote() bool {
+	return Connection != ""
+}
+
+// Timeouts bound every podman invocation, so a hung podman (stuck on
+// a storage lock, say) cannot block podman-debug forever.  Zero means
+// no limit.
+var (
+	Timeout     = time.Minute      // metadata and mount operations
+	PullTimeout = 10 * time.Minute // pulls, and commits, which copy a whole filesystem
+)
+
+// PullRetries is how many times a pull that failed for a transient
+// reason (a network error, a registry timeout or overload) is retried,
+// after 1s, 2s, 4s, and so on.
+var PullRetries = 2
+
+// ErrTimeout is wrapped by the error of a podman invocation that ran
+// past its timeout and was killed.
+var ErrTimeout = errors.New("timed out")
+
+// podmanCmd is a podman invocation killed once its timeout passes.
+// Its Run, Output, and CombinedOutput report an overrun as ErrTimeout,
+// naming the operation.
+type podmanCmd struct {
+	*exec.Cmd
+	args    []string // as given, without the --connection prefix
+	timeout time.Duration
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func command(timeout time.Duration, args ...string) *podmanCmd {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	full := args
+	if Connection != "" {
+		full = append([]string{"--connection", Connection}, args...)
+	}
+	cmd := exec.CommandContext(ctx, Binary, full...)
+	// Don't wait on pipes held open by podman's own children once
+	// podman itself has been killed.
+	cmd.WaitDelay = time.Second
+	return &podmanCmd{Cmd: cmd, args: args, timeout: timeout, ctx: ctx, cancel: cancel}
+}
+
+func (c *podmanCmd) Run() error {
+	defer c.cancel()
+	return c.check(c.Cmd.Run())
+}
+
+func (c *podmanCmd) Output() ([]byte, error) {
+	defer c.cancel()
+	out, err := c.Cmd.Output()
+	return out, c.check(err)
+}
+
+func (c *podmanCmd) CombinedOutput() ([]byte, error) {
+	defer c.cancel()
+	out, err := c.Cmd.CombinedOutput()
+	return out, c.check(err)
+}
+
+func (c *podmanCmd) check(err error) error {
+	if err == nil || !errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	// Name the operation by its subcommand words: "podman image mount".
+	op := []string{"podman"}
+	for _, arg := range c.args {
+		if strings.HasPrefix(arg, "-") || len(op) == 3 {
+			break
+		}
+		op = append(op, arg)
+	}
+	return fmt.Errorf("%s: %w after %s", strings.Join(op, " "), ErrTimeout, c.timeout)
+}
+
+// EnsureAvailable checks that the podman binary can be found and run,
+// and returns its version.  Every other function here shells out to
+// podman, so callers check this first to fail with installation
+// guidance rather than a confusing error halfway through.
+func EnsureAvailable() (string, error) {
+	if _, err := exec.LookPath(Binary); err != nil {
+		if Binary != "podman" {
+			return "", fmt.Errorf("podman binary %s: %w", Binary, err)
+		}
+		return "", fmt.Errorf("podman not found in PATH; install podman (https://podman.io/docs/installation) and try again")
+	}
+	out, err := command(Timeout, "version", "--format", "{{.Client.Version}}").Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("running podman version: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("running podman version: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ErrRootlessSetup is wrapped by the error of CheckUnshare when podman
+// can't create its user namespace because the user has no subordinate
+// ID ranges or the newuidmap and newgidmap helpers are missing.
+var ErrRootlessSetup = errors.New("podman is not set up for rootless use")
+
+// UnshareRetries is how many times CheckUnshare retries a podman
+// unshare that failed for a reason other than ErrRootlessSetup, such as
+// another podman still starting the rootless pause process, after
+// 250ms, 500ms, and so on.
+var UnshareRetries = 2
+
+// Markers in podman unshare's stderr of a missing rootless setup.
+var rootlessSetupErrors = []string{
+	"newuidmap", "newgidmap", "subuid", "subgid", "cannot find mappings for user",
+	"no subuid ranges", "no subgid ranges",
+}
+
+// CheckUnshare runs "podman unshare true", so that a rootless caller
+// about to exec podman unshare can explain a failure instead of
+// leaving it to podman's own message once the process is gone.
+func CheckUnshare() error {
+	delay := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		_, err := command(Timeout, "unshare", "true").Output()
+		if err == nil {
+			return nil
+		}
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return fmt.Errorf("running podman unshare: %w", err)
+		}
+		stderr := podmanStderr(exitErr)
+		lower := strings.ToLower(stderr)
+		for _, marker := range rootlessSetupErrors {
+			if strings.Contains(lower, marker) {
+				return fmt.Errorf("%w: %s", ErrRootlessSetup, stderr)
+			}
+		}
+		if attempt > UnshareRetries {
+			return fmt.Errorf("running podman unshare: %s (gave up after %d attempts)", stderr, attempt)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// StorageDriver returns the storage driver podman uses, such as
+// "overlay" or "vfs", as configured by storage.conf or
+// CONTAINERS_STORAGE_CONF.
+func StorageDriver() (string, error) {
+	out, err := command(Timeout, "info", "--format", "{{.Store.GraphDriverName}}").Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("running podman info: %s", podmanStderr(exitErr))
+		}
+		return "", fmt.Errorf("running podman info: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 // ContainerInfo holds the subset of container metadata needed for
 // debug sessions.
 type ContainerInfo struct {
 	ID    string
+	Name  string
 	State string // "running", "paused", "stopped", "exited", "created", "configured"
 	PID   int    // Only valid when running/paused
 }
 
-// inspectResult is the subset of podman inspect JSON we care about.
-type inspectResult struct {
+// containerInspect is the subset of podman container inspect JSON we
+// care about, parsed once per container and shared by the typed
+// accessors (InspectContainer, InspectContainerEntrypoint, ...).
+type containerInspect struct {
 	ID    string `json:"Id"`
-	State struct {
-		Status string `json:"Status"`
-		PID    int    `json:"Pid"`
+	Name  string `json:"Name"`
+	State *struct {
+		Status      string       `json:"Status"`
+		PID         int          `json:"Pid"`
+		Health      *HealthState `json:"Health"`
+		Healthcheck *HealthState `json:"Healthcheck"` // podman < 4.3
 	} `json:"State"`
+	Config *struct {
+		Entrypoint  []string `json:"Entrypoint"`
+		Cmd         []string `json:"Cmd"`
+		WorkingDir  string   `json:"WorkingDir"`
+		Env         []string `json:"Env"`
+		User        string   `json:"User"`
+		Healthcheck *struct {
+			Test []string `json:"Test"`
+		} `json:"Healthcheck"`
+	} `json:"Config"`
+	Mounts []struct {
+		Type        string   `json:"Type"`
+		Name        string   `json:"Name"`
+		Source      string   `json:"Source"`
+		Destination string   `json:"Destination"`
+		RW          bool     `json:"RW"`
+		Options     []string `json:"Options"`
+	} `json:"Mounts"`
 }
 
-// InspectContainer shells out to `podman container inspect` and
-// returns the container's ID, state, and PID.  Using "container
-// inspect" (not bare "inspect") ensures we only match containers,
-// so image references correctly fall through to image mode.
-func InspectContainer(nameOrID string) (*ContainerInfo, error) {
-	out, err := exec.Command("podman", "container", "inspect", "--format", "json", nameOrID).Output()
+// inspectCache holds the parsed inspect output of every container
+// looked up during this run, keyed by the name or ID it was looked up
+// by, so each metadata feature costs no extra podman call.
+var inspectCache = struct {
+	sync.Mutex
+	m map[string]*containerInspect
+}{m: map[string]*containerInspect{}}
+
+// inspectContainer returns the parsed `podman container inspect`
+// output for nameOrID, shelling out only on the first call.  Failed
+// lookups are not cached.
+func inspectContainer(nameOrID string) (*containerInspect, error) {
+	inspectCache.Lock()
+	defer inspectCache.Unlock()
+
+	if c, ok := inspectCache.m[nameOrID]; ok {
+		return c, nil
+	}
+
+	out, err := command(Timeout, "container", "inspect", "--format", "json", nameOrID).Output()
 	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr := strings.TrimSpace(string(exitErr.Stderr))
+			if strings.Contains(stderr, "no such container") || strings.Contains(stderr, "no container with name or ID") {
+				return nil, fmt.Errorf("inspecting container %s: %w", nameOrID, ErrContainerNotFound)
+			}
+			if stderr != "" {
+				return nil, fmt.Errorf("inspecting container %s: %s", nameOrID, stderr)
+			}
+		}
 		return nil, fmt.Errorf("inspecting container %s: %w", nameOrID, err)
 	}
+	c, err := parseContainerInspect(out)
+	if err != nil {
+		return nil, err
+	}
+	inspectCache.m[nameOrID] = c
+	return c, nil
+}
 
-	var results []inspectResult
-	if err := json.Unmarshal(out, &results); err != nil {
+// InvalidateInspect drops the cached inspect output for nameOrID, so
+// the next lookup sees the container's current state.  Callers that
+// poll a container (waiting for it to start, say) use this between
+// polls.
+func InvalidateInspect(nameOrID string) {
+	inspectCache.Lock()
+	defer inspectCache.Unlock()
+	delete(inspectCache.m, nameOrID)
+}
+
+// containerStates are the State.Status values podman reports.
+var containerStates = []string{
+	"configured", "created", "initialized", "running", "paused",
+	"stopping", "stopped", "exited", "removing", "unknown",
+}
+
+// parseContainerInspect decodes podman container inspect output, a
+// JSON array holding one container, and returns it.  It checks the
+// data really describes a podman container (a full container ID, a
+// State with a status podman reports, and a Config) so that, say,
+// image inspect output, or another tool's, is rejected rather than
+// silently yielding empty metadata.
+func parseContainerInspect(data []byte) (*containerInspect, error) {
+	var results []containerInspect
+	if err := json.Unmarshal(data, &results); err != nil {
 		return nil, fmt.Errorf("parsing inspect output: %w", err)
 	}
-	if len(results) == 0 {
-		return nil, fmt.Errorf("no inspect data for %s", nameOrID)
+	if len(results) != 1 {
+		return nil, fmt.Errorf("inspect output holds %d containers, expected 1", len(results))
+	}
+	c := &results[0]
+	if c.ID == "" || c.State == nil || c.Config == nil {
+		return nil, fmt.Errorf("not podman container inspect output: missing Id, State, or Config")
+	}
+	if len(c.ID) != 64 || strings.Trim(c.ID, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("not podman container inspect output: Id %q is not a container ID", c.ID)
 	}
+	if !slices.Contains(containerStates, c.State.Status) {
+		return nil, fmt.Errorf("not podman container inspect output: unknown State.Status %q", c.State.Status)
+	}
+	return c, nil
+}
 
+// InspectContainer returns the container's ID, state, and PID from
+// `podman container inspect`.  Using "container inspect" (not bare
+// "inspect") ensures we only match containers, so image references
+// correctly fall through to image mode.
+//
+// A nameOrID that no container has yields an error wrapping
+// ErrContainerNotFound, unless it is an ID prefix shared by several
+// containers: then an *AmbiguousError listing their full IDs is
+// returned.
+func InspectContainer(nameOrID string) (*ContainerInfo, error) {
+	c, err := inspectContainer(nameOrID)
+	if err != nil {
+		if !errors.Is(err, ErrContainerNotFound) {
+			return nil, err
+		}
+		if ids, _ := containerIDsWithPrefix(nameOrID); len(ids) > 1 {
+			return nil, &AmbiguousError{Ref: nameOrID, Candidates: ids}
+		}
+		return nil, err
+	}
+	return c.info(), nil
+}
+
+// ParseContainerInspect parses saved `podman container inspect` output.
+func ParseContainerInspect(data []byte) (*ContainerInfo, error) {
+	c, err := parseContainerInspect(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.info(), nil
+}
+
+// CheckInspectTarget checks that saved `podman container inspect`
+// output describes the container with the given ID or name.  The name
+// alone is enough, as the output may be of a container since recreated
+// under it.
+func CheckInspectTarget(data []byte, id, name string) error {
+	c, err := parseContainerInspect(data)
+	if err != nil {
+		return err
+	}
+	if c.ID == id || strings.TrimPrefix(c.Name, "/") == name {
+		return nil
+	}
+	return fmt.Errorf("inspect output is of container %s (%.12s), not %s (%.12s)", c.Name, c.ID, name, id)
+}
+
+func (c *containerInspect) info() *ContainerInfo {
 	return &ContainerInfo{
-		ID:    results[0].ID,
-		State: results[0].State.Status,
-		PID:   results[0].State.PID,
-	}, nil
+		ID:    c.ID,
+		Name:  c.Name,
+		State: c.State.Status,
+		PID:   c.State.PID,
+	}
+}
+
+// ErrContainerNotFound is wrapped by lookups of a name or ID that no
+// container has.  Any other lookup failure means podman could not
+// answer, not that the target is something other than a container.
+var ErrContainerNotFound = errors.New("no such container")
+
+// ErrAmbiguousReference matches an *AmbiguousError with errors.Is.
+var ErrAmbiguousReference = errors.New("ambiguous container reference")
+
+// AmbiguousError is returned when a container ID prefix matches more
+// than one container.
+type AmbiguousError struct {
+	Ref        string
+	Candidates []string
+}
+
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("container ID prefix %q is ambiguous, it matches: %s", e.Ref, strings.Join(e.Candidates, ", "))
+}
+
+func (e *AmbiguousError) Is(target error) bool {
+	return target == ErrAmbiguousReference
+}
+
+// containerIDsWithPrefix returns the full IDs of all containers whose
+// ID starts with prefix.  Non-hex strings cannot be ID prefixes and
+// return nothing without shelling out.
+func containerIDsWithPrefix(prefix string) ([]string, error) {
+	if prefix == "" || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return nil, nil
+	}
+
+	out, err := command(Timeout, "ps", "--all", "--no-trunc", "--format", "{{.ID}}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+
+	var ids []string
+	for _, id := range strings.Fields(string(out)) {
+		if strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// psResult is the subset of podman ps JSON needed to list containers
+// and match them by their main process.
+type psResult struct {
+	ID      string   `json:"Id"`
+	Names   []string `json:"Names"`
+	Image   string   `json:"Image"`
+	State   string   `json:"State"`
+	Command []string `json:"Command"`
+}
+
+// listContainers runs podman ps, including stopped containers if all
+// is set, with any extra ps arguments such as filters.
+func listContainers(all bool, extra ...string) ([]psResult, error) {
+	args := []string{"ps", "--format", "json"}
+	if all {
+		args = append(args, "--all")
+	}
+	args = append(args, extra...)
+	out, err := command(Timeout, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+	var results []psResult
+	if err := json.Unmarshal(out, &results); err != nil {
+		return nil, fmt.Errorf("parsing podman ps output: %w", err)
+	}
+	return results, nil
+}
+
+// ContainerSummary is one entry of ListContainers.
+type ContainerSummary struct {
+	ID    string
+	Name  string
+	Image string
+	State string
+}
+
+// ListContainers returns all containers, running or not, in the order
+// podman ps lists them.
+func ListContainers() ([]ContainerSummary, error) {
+	results, err := listContainers(true)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]ContainerSummary, len(results))
+	for i, r := range results {
+		containers[i] = ContainerSummary{ID: r.ID, Image: r.Image, State: r.State}
+		if len(r.Names) > 0 {
+			containers[i].Name = r.Names[0]
+		}
+	}
+	return containers, nil
+}
+
+// FindContainersByLabel returns the containers with label, KEY or
+// KEY=VALUE as podman ps --filter label= takes it: the running and
+// paused ones, or all of them if all is set.
+func FindContainersByLabel(label string, all bool) ([]ContainerSummary, error) {
+	results, err := listContainers(true, "--filter", "label="+label)
+	if err != nil {
+		return nil, err
+	}
+	var containers []ContainerSummary
+	for _, r := range results {
+		if !all && r.State != "running" && r.State != "paused" {
+			continue
+		}
+		c := ContainerSummary{ID: r.ID, Image: r.Image, State: r.State}
+		if len(r.Names) > 0 {
+			c.Name = r.Names[0]
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// LatestContainer returns the most recently created container, in any
+// state, as podman ps --latest picks it, or nil if there are none.
+func LatestContainer() (*ContainerSummary, error) {
+	results, err := listContainers(true, "--latest")
+	if err != nil || len(results) == 0 {
+		return nil, err
+	}
+	r := results[0]
+	c := &ContainerSummary{ID: r.ID, Image: r.Image, State: r.State}
+	if len(r.Names) > 0 {
+		c.Name = r.Names[0]
+	}
+	return c, nil
+}
+
+// ProcessMatch is a running container whose main process matched.
+type ProcessMatch struct {
+	ID      string
+	Name    string
+	Command string
+}
+
+// FindByProcess returns the running containers whose main process is
+// name: the base name of the command's executable, so "nginx" matches
+// both "nginx -g ..." and "/usr/sbin/nginx".
+func FindByProcess(name string) ([]ProcessMatch, error) {
+	if name == "" || strings.ContainsAny(name, "/:@") {
+		// Image references and paths are never process names.
+		return nil, nil
+	}
+
+	results, err := listContainers(false)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []ProcessMatch
+	for _, r := range results {
+		if len(r.Command) == 0 || path.Base(r.Command[0]) != name {
+			continue
+		}
+		m := ProcessMatch{ID: r.ID, Command: strings.Join(r.Command, " ")}
+		if len(r.Names) > 0 {
+			m.Name = r.Names[0]
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+// AmbiguousProcessError is returned when a process name matches the
+// main process of more than one running container.
+type AmbiguousProcessError struct {
+	Process    string
+	Candidates []ProcessMatch
+}
+
+func (e *AmbiguousProcessError) Error() string {
+	names := make([]string, len(e.Candidates))
+	for i, c := range e.Candidates {
+		names[i] = c.Name
+	}
+	return fmt.Sprintf("process name %q matches several running containers: %s; pass a container name instead", e.Process, strings.Join(names, ", "))
+}
+
+// PodInfo holds the subset of pod metadata needed to pick one of its
+// containers to debug.
+type PodInfo struct {
+	ID               string
+	Name             string
+	InfraContainerID string
+	Containers       []PodContainer
+}
+
+// PodContainer is one member container of a pod.
+type PodContainer struct {
+	ID    string
+	Name  string
+	State string
+}
+
+// InspectPod returns the pod's members from `podman pod inspect`.
+// Podman 5 prints a JSON array and older versions a single object, so
+// both are accepted.
+func InspectPod(nameOrID string) (*PodInfo, error) {
+	out, err := command(Timeout, "pod", "inspect", "--format", "json", nameOrID).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("inspecting pod %s: %s", nameOrID, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("inspecting pod %s: %w", nameOrID, err)
+	}
+
+	type podInspect struct {
+		ID               string `json:"Id"`
+		Name             string `json:"Name"`
+		InfraContainerID string `json:"InfraContainerID"`
+		Containers       []struct {
+			ID    string `json:"Id"`
+			Name  string `json:"Name"`
+			State string `json:"State"`
+		} `json:"Containers"`
+	}
+	var pods []podInspect
+	data := strings.TrimSpace(string(out))
+	if strings.HasPrefix(data, "{") {
+		data = "[" + data + "]"
+	}
+	if err := json.Unmarshal([]byte(data), &pods); err != nil {
+		return nil, fmt.Errorf("parsing pod inspect output: %w", err)
+	}
+	if len(pods) == 0 || pods[0].ID == "" {
+		return nil, fmt.Errorf("pod inspect output for %s holds no pod", nameOrID)
+	}
+
+	p := pods[0]
+	info := &PodInfo{ID: p.ID, Name: p.Name, InfraContainerID: p.InfraContainerID}
+	for _, c := range p.Containers {
+		info.Containers = append(info.Containers, PodContainer{ID: c.ID, Name: c.Name, State: c.State})
+	}
+	return info, nil
 }
 
 // MountContainer shells out to `podman mount` and returns the
 // host-side root filesystem path.
 func MountContainer(nameOrID string) (string, error) {
-	out, err := exec.Command("podman", "mount", nameOrID).Output()
+	out, err := command(Timeout, "mount", nameOrID).Output()
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			return "", fmt.Errorf("mounting container %s: %s", nameOrID, strings.TrimSpace(string(exitErr.Stderr)))
@@ -67,33 +632,339 @@ func MountContainer(nameOrID string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+// MountedContainers returns the IDs of the containers podman currently
+// has mounted (`podman mount` with no arguments).
+func MountedContainers() ([]string, error) {
+	out, err := command(Timeout, "mount", "--notruncate").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing mounted containers: %w", err)
+	}
+	return firstFields(out), nil
+}
+
+// MountedImages returns the images podman currently has mounted
+// (`podman image mount` with no arguments), as it names them.
+func MountedImages() ([]string, error) {
+	out, err := command(Timeout, "image", "mount").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing mounted images: %w", err)
+	}
+	return firstFields(out), nil
+}
+
+// firstFields returns the first field of every non-empty line.
+func firstFields(out []byte) []string {
+	var fields []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if f := strings.Fields(line); len(f) > 0 {
+			fields = append(fields, f[0])
+		}
+	}
+	return fields
+}
+
 // UnmountContainer shells out to `podman unmount`.
 func UnmountContainer(nameOrID string) error {
-	return exec.Command("podman", "unmount", nameOrID).Run()
+	return command(Timeout, "unmount", nameOrID).Run()
+}
+
+// UnmountAll shells out to `podman unmount --all` and `podman image
+// unmount --all`, releasing every container and image mount podman
+// holds, whoever made it.
+func UnmountAll() error {
+	var errs []error
+	for _, args := range [][]string{{"unmount", "--all"}, {"image", "unmount", "--all"}} {
+		_, err := command(Timeout, args...).Output()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			err = errors.New(podmanStderr(exitErr))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("podman %s: %w", strings.Join(args, " "), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Commit shells out to `podman commit` to save a container's
+// filesystem as image.
+func Commit(nameOrID, image string) error {
+	out, err := command(PullTimeout, "commit", "--quiet", nameOrID, image).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("committing %s as %s: %s", nameOrID, image, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// CommitChanges creates a throwaway container from base, lets apply
+// modify its mounted root filesystem, commits the result as image,
+// and removes the container again.  The new image keeps base's
+// configuration (entrypoint, env, ...).
+func CommitChanges(base, image string, apply func(rootfs string) error) error {
+	out, err := command(Timeout, "create", "--pull=never", base).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("creating container from %s: %s", base, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return fmt.Errorf("creating container from %s: %w", base, err)
+	}
+	id := strings.TrimSpace(string(out))
+	defer command(Timeout, "rm", "--force", id).Run()
+
+	mountPoint, err := MountContainer(id)
+	if err != nil {
+		return err
+	}
+	err = apply(mountPoint)
+	_ = UnmountContainer(id)
+	if err != nil {
+		return err
+	}
+
+	return Commit(id, image)
 }
 
 // PullImage shells out to `podman pull` according to the given policy.
-func PullImage(image, pullPolicy string) error {
-	switch pullPolicy {
-	case "always":
-		return exec.Command("podman", "pull", image).Run()
-	case "never":
-		if err := exec.Command("podman", "image", "exists", image).Run(); err != nil {
-			return fmt.Errorf("image %s not found and pull policy is 'never'", image)
+// A failed pull reports podman's own explanation (not found, denied, a
+// network error) rather than just its exit status, and matches
+// ErrImageNotFound if it says there is no such image.  A platform such
+// as linux/amd64 pulls that variant of a multi-arch image, and a local
+// copy for another platform counts as missing; "" means the host's.
+func PullImage(image, pullPolicy, platform string) error {
+	if pullPolicy == "always" {
+		return pull(image, platform)
+	}
+	exists, err := ImageExists(image)
+	if err != nil {
+		return err
+	}
+	if exists && platform != "" {
+		if exists, err = imageMatchesPlatform(image, platform); err != nil {
+			return err
 		}
+	}
+	switch {
+	case exists:
 		return nil
+	case pullPolicy == "never" && platform != "":
+		return &imageNotFoundError{fmt.Sprintf("image %s not found locally for platform %s and pull policy is 'never'", image, platform)}
+	case pullPolicy == "never":
+		return &imageNotFoundError{fmt.Sprintf("image %s not found locally and pull policy is 'never'", image)}
 	default: // "missing"
-		if err := exec.Command("podman", "image", "exists", image).Run(); err != nil {
-			return exec.Command("podman", "pull", image).Run()
+		return pull(image, platform)
+	}
+}
+
+// ErrImageNotFound matches, with errors.Is, a PullImage error saying
+// the image isn't in local storage or any registry podman searched.
+// Any other pull failure means podman could not answer, not that the
+// target is something other than an image.
+var ErrImageNotFound = errors.New("no such image")
+
+// imageNotFoundError keeps podman's explanation of a missing image as
+// its message and matches ErrImageNotFound.
+type imageNotFoundError struct {
+	msg string
+}
+
+func (e *imageNotFoundError) Error() string {
+	return e.msg
+}
+
+func (e *imageNotFoundError) Is(target error) bool {
+	return target == ErrImageNotFound
+}
+
+// ValidatePlatform checks that platform has the OS/ARCH[/VARIANT] form
+// podman pull --platform takes, such as linux/arm64/v8.
+func ValidatePlatform(platform string) error {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("invalid platform %q: expected OS/ARCH or OS/ARCH/VARIANT, such as linux/amd64", platform)
+	}
+	for _, p := range parts {
+		if p == "" || strings.Trim(p, "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+			return fmt.Errorf("invalid platform %q: expected OS/ARCH or OS/ARCH/VARIANT, such as linux/amd64", platform)
+		}
+	}
+	return nil
+}
+
+// imageMatchesPlatform reports whether the local image was built for
+// platform.  A platform without a variant matches any variant.
+func imageMatchesPlatform(image, platform string) (bool, error) {
+	out, err := command(Timeout, "image", "inspect", "--format", "json", image).Output()
+	if err != nil {
+		return false, fmt.Errorf("inspecting image %s: %w", image, err)
+	}
+	var results []struct {
+		Os           string `json:"Os"`
+		Architecture string `json:"Architecture"`
+		Variant      string `json:"Variant"`
+	}
+	if err := json.Unmarshal(out, &results); err != nil {
+		return false, fmt.Errorf("parsing image inspect output: %w", err)
+	}
+	if len(results) == 0 {
+		return false, fmt.Errorf("no inspect data for %s", image)
+	}
+	img := results[0]
+	osName, arch, variant := splitPlatform(platform)
+	return img.Os == osName && img.Architecture == arch && (variant == "" || img.Variant == variant), nil
+}
+
+// splitPlatform splits a platform checked by ValidatePlatform into its
+// parts, variant being "" if it has none.
+func splitPlatform(platform string) (osName, arch, variant string) {
+	osName, rest, _ := strings.Cut(platform, "/")
+	arch, variant, _ = strings.Cut(rest, "/")
+	return osName, arch, variant
+}
+
+// archiveTransports are the image reference prefixes that name an
+// image on disk rather than in a registry or podman's storage.
+var archiveTransports = []string{"oci-archive:", "docker-archive:", "oci:", "dir:"}
+
+// IsArchiveReference reports whether ref names an image on disk, such
+// as oci-archive:/tmp/img.tar, that LoadImageArchive must load first.
+func IsArchiveReference(ref string) bool {
+	for _, t := range archiveTransports {
+		if strings.HasPrefix(ref, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadImageArchive copies the on-disk image ref into podman's storage
+// by pulling it through its transport, and returns the ID the image
+// can then be mounted and inspected by.  Nothing goes over the network,
+// so unlike pull it is not retried.
+func LoadImageArchive(ref string) (string, error) {
+	out, err := command(PullTimeout, "pull", "--quiet", ref).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", errors.New(podmanStderr(exitErr))
+		}
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("podman pull printed no image ID")
+	}
+	return fields[len(fields)-1], nil
+}
+
+// ImageExists runs podman image exists, which exits 1 for an image
+// that isn't in local storage.  Any other failure is an error.
+func ImageExists(image string) (bool, error) {
+	_, err := command(Timeout, "image", "exists", image).Output()
+	if err == nil {
+		return true, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if exitErr.ExitCode() == 1 {
+			return false, nil
+		}
+		return false, fmt.Errorf("checking for image %s: %s", image, podmanStderr(exitErr))
+	}
+	return false, fmt.Errorf("checking for image %s: %w", image, err)
+}
+
+// pull runs podman pull, for platform if it is set, retrying transient
+// failures up to PullRetries times with exponential backoff.  The error
+// is podman's stderr; callers add which image they were pulling.
+func pull(image, platform string) error {
+	args := []string{"pull", "--quiet"}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	args = append(args, image)
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		_, err := command(PullTimeout, args...).Output()
+		if err == nil {
+			return nil
+		}
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return err
+		}
+		stderr := podmanStderr(exitErr)
+		if attempt > PullRetries || !transientPullError(stderr) {
+			if attempt > 1 {
+				return fmt.Errorf("%s (gave up after %d attempts)", stderr, attempt)
+			}
+			if permanentPullError(stderr) {
+				return &imageNotFoundError{stderr}
+			}
+			return errors.New(stderr)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// podmanStderr returns what a failed podman invocation printed, without
+// the "Error: " podman starts its message with: the caller's error
+// gets one of its own.
+func podmanStderr(exitErr *exec.ExitError) string {
+	stderr := strings.TrimSpace(string(exitErr.Stderr))
+	if stderr == "" {
+		return exitErr.Error()
+	}
+	return strings.TrimPrefix(stderr, "Error: ")
+}
+
+// Markers in podman pull's stderr.  A failure matching a permanent
+// marker is never retried, whatever else the message says; one that
+// matches neither list isn't either.  A permanent failure means no
+// image by that name can be had: registries answer for a repository
+// that doesn't exist with denied or unauthorized as often as with not
+// found.
+var (
+	permanentPullErrors = []string{
+		"manifest unknown", "not found", "unauthorized", "authentication required",
+		"denied", "invalid reference", "short-name", "no such image",
+	}
+	transientPullErrors = []string{
+		"timeout", "timed out", "connection reset", "connection refused",
+		"temporary failure", "no such host", "network is unreachable",
+		"unexpected eof", "too many requests", "500 internal server error",
+		"502 bad gateway", "503 service unavailable", "504 gateway timeout",
+	}
+)
+
+// permanentPullError reports whether a pull that failed with stderr
+// failed because there is no such image.
+func permanentPullError(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, marker := range permanentPullErrors {
+		if strings.Contains(stderr, marker) {
+			return true
 		}
-		return nil
 	}
+	return false
+}
+
+// transientPullError reports whether a pull that failed with stderr is
+// worth retrying.
+func transientPullError(stderr string) bool {
+	if permanentPullError(stderr) {
+		return false
+	}
+	stderr = strings.ToLower(stderr)
+	for _, marker := range transientPullErrors {
+		if strings.Contains(stderr, marker) {
+			return true
+		}
+	}
+	return false
 }
 
 // MountImage shells out to `podman image mount` and returns the
 // host-side path to the image's root filesystem.
 func MountImage(image string) (string, error) {
-	out, err := exec.Command("podman", "image", "mount", image).Output()
+	out, err := command(Timeout, "image", "mount", image).Output()
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			return "", fmt.Errorf("mounting image %s: %s", image, strings.TrimSpace(string(exitErr.Stderr)))
@@ -103,66 +974,80 @@ func MountImage(image string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+// ValidateDebugImage checks that the debug image mounted at mountPoint
+// carries a nix store, and returns the host-side path to its /nix.
+// The error names the image and points at the default toolbox, since
+// a plain distribution image given to --image fails here.
+func ValidateDebugImage(image, mountPoint string) (string, error) {
+	nixPath := filepath.Join(mountPoint, "nix")
+	if fi, err := os.Stat(filepath.Join(nixPath, "store")); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("debug image %s has no nix store (/nix/store): the debug toolbox must be a nix image such as %s; the target itself is not the problem", image, DefaultDebugImage)
+	}
+	return nixPath, nil
+}
+
 // UnmountImage shells out to `podman image unmount`.
 func UnmountImage(image string) error {
-	return exec.Command("podman", "image", "unmount", image).Run()
+	return command(Timeout, "image", "unmount", image).Run()
 }
 
-// EntrypointInfo holds the ENTRYPOINT, CMD, and WorkingDir metadata
-// from a container or image configuration.
+// EntrypointInfo holds the ENTRYPOINT, CMD, WorkingDir, and SHELL
+// metadata from a container or image configuration.
 type EntrypointInfo struct {
 	Entrypoint []string `json:"entrypoint"`
 	Cmd        []string `json:"cmd"`
 	WorkingDir string   `json:"working_dir"`
-}
-
-// containerConfigResult is the subset of podman container inspect
-// JSON needed for entrypoint metadata.
-type containerConfigResult struct {
-	Config struct {
-		Entrypoint []string `json:"Entrypoint"`
-		Cmd        []string `json:"Cmd"`
-		WorkingDir string   `json:"WorkingDir"`
-	} `json:"Config"`
+	Shell      []string `json:"shell,omitempty"` // Docker-format SHELL, images only
+	User       string   `json:"user,omitempty"`  // configured USER, "" for root
 }
 
 // imageConfigResult is the subset of podman image inspect JSON
-// needed for entrypoint metadata.
+// needed for entrypoint metadata.  Shell is only present for
+// Docker-format images built with a SHELL instruction.
 type imageConfigResult struct {
 	Config struct {
 		Entrypoint []string `json:"Entrypoint"`
 		Cmd        []string `json:"Cmd"`
 		WorkingDir string   `json:"WorkingDir"`
+		Shell      []string `json:"Shell"`
+		User       string   `json:"User"`
+		Env        []string `json:"Env"`
 	} `json:"Config"`
 }
 
 // InspectContainerEntrypoint returns the entrypoint/cmd metadata for
 // a container.
 func InspectContainerEntrypoint(nameOrID string) (*EntrypointInfo, error) {
-	out, err := exec.Command("podman", "container", "inspect", "--format", "json", nameOrID).Output()
+	c, err := inspectContainer(nameOrID)
 	if err != nil {
-		return nil, fmt.Errorf("inspecting container %s: %w", nameOrID, err)
+		return nil, err
 	}
+	return c.entrypoint(), nil
+}
 
-	var results []containerConfigResult
-	if err := json.Unmarshal(out, &results); err != nil {
-		return nil, fmt.Errorf("parsing container inspect output: %w", err)
-	}
-	if len(results) == 0 {
-		return nil, fmt.Errorf("no inspect data for %s", nameOrID)
+// ParseContainerEntrypoint parses the entrypoint/cmd metadata from
+// saved `podman container inspect` output.
+func ParseContainerEntrypoint(data []byte) (*EntrypointInfo, error) {
+	c, err := parseContainerInspect(data)
+	if err != nil {
+		return nil, err
 	}
+	return c.entrypoint(), nil
+}
 
+func (c *containerInspect) entrypoint() *EntrypointInfo {
 	return &EntrypointInfo{
-		Entrypoint: results[0].Config.Entrypoint,
-		Cmd:        results[0].Config.Cmd,
-		WorkingDir: results[0].Config.WorkingDir,
-	}, nil
+		Entrypoint: c.Config.Entrypoint,
+		Cmd:        c.Config.Cmd,
+		WorkingDir: c.Config.WorkingDir,
+		User:       c.Config.User,
+	}
 }
 
-// InspectImageEntrypoint returns the entrypoint/cmd metadata for
-// an image.
-func InspectImageEntrypoint(image string) (*EntrypointInfo, error) {
-	out, err := exec.Command("podman", "image", "inspect", "--format", "json", image).Output()
+// inspectImageConfig returns the configuration part of `podman image
+// inspect` output.
+func inspectImageConfig(image string) (*imageConfigResult, error) {
+	out, err := command(Timeout, "image", "inspect", "--format", "json", image).Output()
 	if err != nil {
 		return nil, fmt.Errorf("inspecting image %s: %w", image, err)
 	}
@@ -174,14 +1059,143 @@ func InspectImageEntrypoint(image string) (*EntrypointInfo, error) {
 	if len(results) == 0 {
 		return nil, fmt.Errorf("no inspect data for %s", image)
 	}
+	return &results[0], nil
+}
+
+// InspectImageEntrypoint returns the entrypoint/cmd metadata for
+// an image.
+func InspectImageEntrypoint(image string) (*EntrypointInfo, error) {
+	img, err := inspectImageConfig(image)
+	if err != nil {
+		return nil, err
+	}
 
 	return &EntrypointInfo{
-		Entrypoint: results[0].Config.Entrypoint,
-		Cmd:        results[0].Config.Cmd,
-		WorkingDir: results[0].Config.WorkingDir,
+		Entrypoint: img.Config.Entrypoint,
+		Cmd:        img.Config.Cmd,
+		WorkingDir: img.Config.WorkingDir,
+		Shell:      img.Config.Shell,
+		User:       img.Config.User,
 	}, nil
 }
 
+// Mount describes one of a container's configured runtime mounts: a
+// volume, bind mount, or tmpfs.
+type Mount struct {
+	Type        string   `json:"type"`
+	Name        string   `json:"name,omitempty"` // volume name, volumes only
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	RW          bool     `json:"rw"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// InspectContainerMounts returns the runtime mounts configured for a
+// container.
+func InspectContainerMounts(nameOrID string) ([]Mount, error) {
+	c, err := inspectContainer(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	return c.mounts(), nil
+}
+
+// ParseContainerMounts parses the runtime mounts from saved `podman
+// container inspect` output.
+func ParseContainerMounts(data []byte) ([]Mount, error) {
+	c, err := parseContainerInspect(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.mounts(), nil
+}
+
+func (c *containerInspect) mounts() []Mount {
+	mounts := make([]Mount, 0, len(c.Mounts))
+	for _, m := range c.Mounts {
+		mounts = append(mounts, Mount{
+			Type:        m.Type,
+			Name:        m.Name,
+			Source:      m.Source,
+			Destination: m.Destination,
+			RW:          m.RW,
+			Options:     m.Options,
+		})
+	}
+	return mounts
+}
+
+// HealthState is a container's healthcheck status as podman reports it.
+type HealthState struct {
+	Status        string      `json:"Status"` // "starting", "healthy", or "unhealthy"
+	FailingStreak int         `json:"FailingStreak"`
+	Log           []HealthLog `json:"Log"`
+}
+
+// HealthLog is the result of one healthcheck run.
+type HealthLog struct {
+	Start    string `json:"Start"`
+	End      string `json:"End"`
+	ExitCode int    `json:"ExitCode"`
+	Output   string `json:"Output"`
+}
+
+// ErrNoHealthcheck is returned by InspectContainerHealth for a
+// container without a healthcheck.
+var ErrNoHealthcheck = errors.New("container has no healthcheck configured")
+
+// InspectContainerHealth returns the container's current state and
+// health.  It always asks podman, bypassing the inspect cache, since
+// it is meant for polling.
+func InspectContainerHealth(nameOrID string) (string, *HealthState, error) {
+	InvalidateInspect(nameOrID)
+	c, err := inspectContainer(nameOrID)
+	if err != nil {
+		return "", nil, err
+	}
+	hc := c.Config.Healthcheck
+	if hc == nil || len(hc.Test) == 0 || hc.Test[0] == "NONE" {
+		return c.State.Status, nil, ErrNoHealthcheck
+	}
+	health := c.State.Health
+	if health == nil {
+		health = c.State.Healthcheck
+	}
+	if health == nil {
+		health = &HealthState{Status: "starting"}
+	}
+	return c.State.Status, health, nil
+}
+
+// InspectContainerEnv returns a container's configured environment as
+// KEY=VALUE pairs.
+func InspectContainerEnv(nameOrID string) ([]string, error) {
+	c, err := inspectContainer(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	return c.Config.Env, nil
+}
+
+// InspectImageEnv returns an image's configured environment as
+// KEY=VALUE pairs.
+func InspectImageEnv(image string) ([]string, error) {
+	img, err := inspectImageConfig(image)
+	if err != nil {
+		return nil, err
+	}
+	return img.Config.Env, nil
+}
+
+// VolumeMountpoint returns the host path holding a named volume's data.
+func VolumeMountpoint(name string) (string, error) {
+	out, err := command(Timeout, "volume", "inspect", "--format", "{{.Mountpoint}}", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("inspecting volume %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 // NamespacePath returns /proc/<pid>/ns/<nstype> for the given PID.
 func NamespacePath(pid int, nstype string) string {
 	return fmt.Sprintf("/proc/%d/ns/%s", pid, nstype)
@@ -0,0 +1,217 @@
+package podman
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testID = "3f9c2e1b7a6d5c4b3a29180f7e6d5c4b3a29180f7e6d5c4b3a29180f7e6d5c4b"
+
+// testInspect is trimmed `podman container inspect` output for an
+// exited container named web.
+const testInspect = `[{
+	"Id": "` + testID + `",
+	"Name": "web",
+	"State": {"Status": "exited", "Pid": 0},
+	"Config": {
+		"Entrypoint": ["/docker-entrypoint.sh"],
+		"Cmd": ["nginx", "-g", "daemon off;"],
+		"WorkingDir": "/srv"
+	},
+	"Mounts": [{"Type": "volume", "Name": "data", "Source": "/var/lib/containers/storage/volumes/data/_data", "Destination": "/data", "RW": true}]
+}]`
+
+func TestParseContainerInspect(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string // a substring of the error, "" for none
+	}{
+		{"good", testInspect, ""},
+		{"not JSON", `Error: no such container web`, "parsing inspect output"},
+		{"empty array", `[]`, "holds 0 containers"},
+		{"two containers", `[` + testInspect[1:len(testInspect)-1] + `,` + testInspect[1:len(testInspect)-1] + `]`, "holds 2 containers"},
+		{"missing Id", `[{"State": {"Status": "exited"}, "Config": {}}]`, "missing Id"},
+		{"missing State", `[{"Id": "` + testID + `", "Config": {}}]`, "missing Id, State, or Config"},
+		{"image inspect", `[{"Id": "` + testID + `", "Config": {"Cmd": ["sh"]}, "RootFS": {"Type": "layers"}}]`, "missing Id, State, or Config"},
+		{"short Id", `[{"Id": "3f9c2e1b7a6d", "State": {"Status": "exited"}, "Config": {}}]`, "not a container ID"},
+		{"docker-style state", `[{"Id": "` + testID + `", "State": {"Running": false}, "Config": {}}]`, "unknown State.Status"},
+	}
+	for _, tt := range tests {
+		c, err := parseContainerInspect([]byte(tt.data))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: parseContainerInspect: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: parseContainerInspect error = %v, want one containing %q", tt.name, err, tt.err)
+		case err == nil && (c.ID != testID || c.Name != "web" || c.State.Status != "exited"):
+			t.Errorf("%s: parseContainerInspect = %s %s %s, want %s web exited", tt.name, c.ID, c.Name, c.State.Status, testID)
+		}
+	}
+}
+
+func TestParseContainerHelpers(t *testing.T) {
+	ep, err := ParseContainerEntrypoint([]byte(testInspect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ep.Entrypoint, " ") != "/docker-entrypoint.sh" || strings.Join(ep.Cmd, " ") != "nginx -g daemon off;" || ep.WorkingDir != "/srv" {
+		t.Errorf("ParseContainerEntrypoint = %+v", ep)
+	}
+
+	mounts, err := ParseContainerMounts([]byte(testInspect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 || mounts[0].Destination != "/data" || !mounts[0].RW {
+		t.Errorf("ParseContainerMounts = %+v, want the data volume at /data", mounts)
+	}
+
+	if _, err := ParseContainerMounts([]byte(`[{"Id": "` + testID + `"}]`)); err == nil {
+		t.Error("ParseContainerMounts accepted output missing State and Config")
+	}
+}
+
+func TestCheckInspectTarget(t *testing.T) {
+	otherID := strings.Repeat("0", 64)
+	tests := []struct {
+		name     string
+		id, ctr  string
+		mismatch bool
+	}{
+		{"same container", testID, "web", false},
+		{"recreated under the same name", otherID, "web", false},
+		{"renamed", testID, "frontend", false},
+		{"another container", otherID, "db", true},
+	}
+	for _, tt := range tests {
+		err := CheckInspectTarget([]byte(testInspect), tt.id, tt.ctr)
+		if (err != nil) != tt.mismatch {
+			t.Errorf("%s: CheckInspectTarget(%.12s, %s) = %v, want mismatch %v", tt.name, tt.id, tt.ctr, err, tt.mismatch)
+		}
+	}
+	if err := CheckInspectTarget([]byte(`[]`), testID, "web"); err == nil {
+		t.Error("CheckInspectTarget accepted output holding no container")
+	}
+}
+
+// stubPodman points Binary at a script that answers container inspect
+// with the contents of the returned inspect file, and empties the
+// inspect cache.  The returned func counts the calls made so far.
+func stubPodman(t *testing.T) (inspectFile string, calls func() int) {
+	dir := t.TempDir()
+	inspectFile = filepath.Join(dir, "inspect.json")
+	callsFile := filepath.Join(dir, "calls")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$*" >> %q
+case "$*" in
+*missing*) echo "Error: no such container missing" >&2; exit 125 ;;
+esac
+cat %q
+`, callsFile, inspectFile)
+	stub := filepath.Join(dir, "podman")
+	if err := os.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(inspectFile, []byte(testInspect), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	binary := Binary
+	Binary = stub
+	t.Cleanup(func() { Binary = binary })
+	clearCache := func() {
+		inspectCache.Lock()
+		clear(inspectCache.m)
+		inspectCache.Unlock()
+	}
+	clearCache()
+	t.Cleanup(clearCache)
+
+	return inspectFile, func() int {
+		data, err := os.ReadFile(callsFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "\n")
+	}
+}
+
+func TestInspectCache(t *testing.T) {
+	_, calls := stubPodman(t)
+
+	for range 3 {
+		if _, err := InspectContainer("web"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := InspectContainerEntrypoint("web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InspectContainerMounts("web"); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls(); n != 1 {
+		t.Errorf("podman ran %d times for repeated lookups of one container, want 1", n)
+	}
+
+	// Failed lookups are not cached.
+	for range 2 {
+		if _, err := inspectContainer("missing"); !errors.Is(err, ErrContainerNotFound) {
+			t.Fatalf("inspecting a missing container: %v, want ErrContainerNotFound", err)
+		}
+	}
+	if n := calls(); n != 3 {
+		t.Errorf("podman ran %d times after two failed lookups, want 3", n)
+	}
+}
+
+func TestInspectContainerHealthInvalidates(t *testing.T) {
+	inspectFile, calls := stubPodman(t)
+
+	ctr, err := InspectContainer("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctr.State != "exited" {
+		t.Fatalf("State = %q, want exited", ctr.State)
+	}
+
+	// The container starts, with a healthcheck.
+	running := strings.Replace(testInspect, `"Status": "exited", "Pid": 0`, `"Status": "running", "Pid": 4711, "Health": {"Status": "healthy"}`, 1)
+	running = strings.Replace(running, `"WorkingDir": "/srv"`, `"WorkingDir": "/srv", "Healthcheck": {"Test": ["CMD-SHELL", "true"]}`, 1)
+	if err := os.WriteFile(inspectFile, []byte(running), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ctr, _ := InspectContainer("web"); ctr.State != "exited" {
+		t.Errorf("cached State = %q, want exited until invalidated", ctr.State)
+	}
+
+	for i := 2; i <= 3; i++ {
+		state, health, err := InspectContainerHealth("web")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != "running" || health.Status != "healthy" {
+			t.Errorf("InspectContainerHealth = %s, %s, want running, healthy", state, health.Status)
+		}
+		if n := calls(); n != i {
+			t.Errorf("podman ran %d times after %d health checks, want %d", n, i-1, i)
+		}
+	}
+
+	// The health check refreshed what everything else sees.
+	if ctr, _ := InspectContainer("web"); ctr.State != "running" || ctr.PID != 4711 {
+		t.Errorf("InspectContainer after a health check = %s, %d, want running, 4711", ctr.State, ctr.PID)
+	}
+	if n := calls(); n != 3 {
+		t.Errorf("podman ran %d times, want 3: the health check's result is cached", n)
+	}
+}